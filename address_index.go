@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+const (
+	addrUtxoBucket    = "addrUtxo"    // PubKeyHash + txid + vout => TXOutput, 和 utxoSet 在同一个事务里维护
+	addrHistoryBucket = "addrHistory" // PubKeyHash + height + txid => nil
+)
+
+// 和地址相关的一笔交易
+type addrTx struct {
+	Height int64
+	TxID   []byte
+}
+
+func addrUtxoKey(pubKeyHash, txID []byte, outIdx int) []byte {
+	return bytes.Join([][]byte{pubKeyHash, txID, IntToHex(int64(outIdx))}, []byte{})
+}
+
+// 从 addrUtxo 的 key 中解析出 txid 和 vout
+func parseAddrUtxoKey(pubKeyHash, key []byte) ([]byte, int) {
+	rest := key[len(pubKeyHash):]
+	txID := append([]byte{}, rest[:len(rest)-8]...)
+	outIdx := int(binary.BigEndian.Uint64(rest[len(rest)-8:]))
+	return txID, outIdx
+}
+
+func addrHistoryKey(pubKeyHash []byte, height int64, txID []byte) []byte {
+	return bytes.Join([][]byte{pubKeyHash, IntToHex(height), txID}, []byte{})
+}
+
+// 不是标准脚本的 output 没有地址, 不加到索引中
+func putAddrUtxo(bucket StorageBucket, txID []byte, outIdx int, out TXOutput) error {
+	if out.AddressHash() == nil {
+		return nil
+	}
+	return bucket.Put(addrUtxoKey(out.AddressHash(), txID, outIdx), out.Serialize())
+}
+
+func deleteAddrUtxo(bucket StorageBucket, txID []byte, outIdx int, out TXOutput) error {
+	if out.AddressHash() == nil {
+		return nil
+	}
+	return bucket.Delete(addrUtxoKey(out.AddressHash(), txID, outIdx))
+}
+
+// 记录每个地址参与过的所有交易(收款或付款)
+type AddrIndex struct {
+	bc *BlockChain
+}
+
+func NewAddrIndex(bc *BlockChain) *AddrIndex {
+	return &AddrIndex{bc}
+}
+
+func (index *AddrIndex) Init() error {
+	var exists bool
+	index.bc.db.View(func(tx StorageTx) error {
+		exists = tx.Bucket([]byte(addrHistoryBucket)) != nil
+		return nil
+	})
+
+	if !exists {
+		return index.Reindex()
+	}
+	return nil
+}
+
+// 需要所有区块的数据和回滚数据, 被裁剪的链不能重建
+func (index *AddrIndex) Reindex() error {
+	if index.bc.IsPruned() {
+		return errors.New("can't build the address index of a pruned chain")
+	}
+
+	bucketName := []byte(addrHistoryBucket)
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		tx.DeleteBucket(bucketName)
+		_, err := tx.CreateBucket(bucketName)
+		return err
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	it := index.bc.Iterator()
+	for it.HasNext() {
+		block, err := it.Next()
+		if err != nil {
+			return fmt.Errorf("can't build the address index: %s", err)
+		}
+		index.ConnectBlock(block, index.bc.readUndo(block))
+	}
+	return nil
+}
+
+// 交易涉及到的所有地址: output 的收款地址, 以及 input 花费掉的 output 的地址
+func touchedPubKeyHashes(tx *Transaction, spent []TXOutput) [][]byte {
+	var hashes [][]byte
+
+	for _, out := range tx.Vout {
+		if hash := out.AddressHash(); hash != nil {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	for _, out := range spent {
+		if hash := out.AddressHash(); hash != nil {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes
+}
+
+func (index *AddrIndex) ConnectBlock(b *Block, undo *blockUndo) {
+	index.update(b, undo, func(bucket StorageBucket, key []byte) error {
+		return bucket.Put(key, []byte{})
+	})
+}
+
+func (index *AddrIndex) DisconnectBlock(b *Block, undo *blockUndo) {
+	index.update(b, undo, func(bucket StorageBucket, key []byte) error {
+		return bucket.Delete(key)
+	})
+}
+
+func (index *AddrIndex) update(b *Block, undo *blockUndo, apply func(bucket StorageBucket, key []byte) error) {
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		bucket := tx.Bucket([]byte(addrHistoryBucket))
+
+		for i, transaction := range b.Transactions {
+			for _, pubKeyHash := range touchedPubKeyHashes(transaction, undo.SpentOutputs[i]) {
+				key := addrHistoryKey(pubKeyHash, b.Height, transaction.ID)
+				if err := apply(bucket, key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 按区块高度从低到高返回地址参与过的所有交易
+func (index *AddrIndex) History(pubKeyHash []byte) []addrTx {
+	var history []addrTx
+
+	index.bc.db.View(func(tx StorageTx) error {
+		cursor := tx.Bucket([]byte(addrHistoryBucket)).Cursor()
+
+		for key, _ := cursor.Seek(pubKeyHash); key != nil && bytes.HasPrefix(key, pubKeyHash); key, _ = cursor.Next() {
+			rest := key[len(pubKeyHash):]
+			height := int64(binary.BigEndian.Uint64(rest[:8]))
+			txID := append([]byte{}, rest[8:]...)
+
+			history = append(history, addrTx{height, txID})
+		}
+		return nil
+	})
+
+	return history
+}
@@ -2,12 +2,8 @@ package main
 
 import (
 	"strconv"
-	"bytes"
-	"crypto/sha256"
 	"time"
 	"fmt"
-	"encoding/gob"
-	"log"
 )
 
 type Block struct {
@@ -19,8 +15,19 @@ type Block struct {
 	Height        int64
 }
 
+// 区块头, 不包含交易数据, 但是包含交易的 Merkle root, 可以单独校验工作量证明
+type BlockHeader struct {
+	Timestamp     int64
+	PrevBlockHash []byte
+	Hash          []byte
+	TxsHash       []byte
+	Nonce         int
+	Height        int64
+}
+
 func NewBlock(txs []*Transaction, prevBlockHash []byte, height int64) *Block {
 	block := &Block{time.Now().Unix(), txs, prevBlockHash, []byte{}, 0, height}
+	block.addWitnessCommitment()
 
 	// block.setHash()
 
@@ -47,19 +54,27 @@ func (b *Block) TransactionsHash() []byte {
 	//txsHash = sha256.Sum256(bytes.Join(txIds, []byte{}))
 	//return txsHash[:]
 
-	var transactions [][]byte
+	return b.MerkleTree().Root.Data
+}
+
+// 叶子是交易 ID, 有了交易 ID 和路径就能证明交易在区块中
+func (b *Block) MerkleTree() *MerkleTree {
+	var txIDs [][]byte
 
 	for _, tx := range b.Transactions {
-		transactions = append(transactions, tx.Serialize())
+		txIDs = append(txIDs, tx.ID)
 	}
-	mTree := NewMerkleTree(transactions)
+	return NewMerkleTree(txIDs)
+}
 
-	return mTree.Root.Data
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{b.Timestamp, b.PrevBlockHash, b.Hash, b.TransactionsHash(), b.Nonce, b.Height}
 }
 
 func (b *Block) String() string {
 
 	var res string
+	res += fmt.Sprintf("Height: %d\n", b.Height)
 	res += fmt.Sprintf("Prev. hash: %x\n", b.PrevBlockHash)
 	res += fmt.Sprintf("TransactionsHash: %x\n", b.TransactionsHash())
 	res += fmt.Sprintf("Hash: %x\n", b.Hash)
@@ -73,26 +88,15 @@ func (b *Block) String() string {
 }
 
 func (b *Block) Serialize() []byte {
-	var result bytes.Buffer
-	encoder := gob.NewEncoder(&result)
-	err := encoder.Encode(b)
-
-	if err != nil {
-		log.Panic(err)
-	}
-	return result.Bytes()
+	return serializeVersioned(b.encode)
 }
 
-func DeserializeBlock(b []byte) *Block {
-
+func DeserializeBlock(b []byte) (*Block, error) {
 	var block Block
-	reader := bytes.NewReader(b)
-	decoder := gob.NewDecoder(reader)
 
-	err := decoder.Decode(&block)
-	if err != nil {
-		log.Panic(err)
+	if err := deserializeVersioned(b, block.decode); err != nil {
+		return nil, err
 	}
 
-	return &block
+	return &block, nil
 }
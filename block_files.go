@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	originBlocksDir = "blocks_%s"
+	blockFileName   = "blk%05d.dat"
+	undoFileName    = "rev%05d.dat" // 和 blk 文件编号相同的 rev 文件中保存这些区块的回滚数据
+)
+
+// 超过这个大小就换下一个文件, testStorageBackends 中改小之后几个区块就会换文件
+var maxBlockFileSize int64 = 128 * 1024 * 1024
+
+// 每条记录的格式: magic(4) + 数据长度(4, 大端序) + 数据
+var blockFileMagic = []byte{0x73, 0x63, 0x68, 0x6e}
+
+const blockRecordHeaderLen = 8
+
+// 区块在文件中的位置, Offset 指向数据开始的地方(跳过了记录头)
+type blockPos struct {
+	File   int
+	Offset int64
+	Size   int64
+}
+
+// 只能追加的区块文件, 完整的区块保存在这里, 数据库中只保存区块头和位置
+type BlockFiles interface {
+	Append(data []byte) (blockPos, error)
+	Read(pos blockPos) ([]byte, error)
+	AppendUndo(file int, data []byte) (blockPos, error) // 回滚数据写到编号为 file 的 rev 文件
+	ReadUndo(pos blockPos) ([]byte, error)
+	Remove(file int) error // 删除编号为 file 的 blk 和 rev 文件, 用于裁剪
+	Close() error
+}
+
+// 写到 dir 目录下的 blk00000.dat, blk00001.dat ... 中
+type flatBlockFiles struct {
+	lock     sync.Mutex
+	dir      string
+	lastFile int   // 当前正在写的文件编号
+	lastSize int64 // 当前正在写的文件大小
+}
+
+func OpenFlatBlockFiles(dir string) (BlockFiles, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files := &flatBlockFiles{dir: dir}
+
+	// 找到编号最大的文件, 接着往里面写
+	names, err := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		var file int
+		if _, err := fmt.Sscanf(filepath.Base(name), blockFileName, &file); err != nil || file < files.lastFile {
+			continue
+		}
+
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+
+		files.lastFile = file
+		files.lastSize = info.Size()
+	}
+
+	return files, nil
+}
+
+func (files *flatBlockFiles) path(file int) string {
+	return filepath.Join(files.dir, fmt.Sprintf(blockFileName, file))
+}
+
+func (files *flatBlockFiles) undoPath(file int) string {
+	return filepath.Join(files.dir, fmt.Sprintf(undoFileName, file))
+}
+
+func (files *flatBlockFiles) Append(data []byte) (blockPos, error) {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+
+	recordLen := int64(blockRecordHeaderLen + len(data))
+	if files.lastSize > 0 && files.lastSize+recordLen > maxBlockFileSize {
+		files.lastFile++
+		files.lastSize = 0
+	}
+
+	pos, err := appendRecord(files.path(files.lastFile), files.lastFile, data)
+	if err != nil {
+		return blockPos{}, err
+	}
+
+	files.lastSize += recordLen
+	return pos, nil
+}
+
+func (files *flatBlockFiles) Read(pos blockPos) ([]byte, error) {
+	return readRecord(files.path(pos.File), pos)
+}
+
+func (files *flatBlockFiles) AppendUndo(file int, data []byte) (blockPos, error) {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+
+	return appendRecord(files.undoPath(file), file, data)
+}
+
+func (files *flatBlockFiles) ReadUndo(pos blockPos) ([]byte, error) {
+	return readRecord(files.undoPath(pos.File), pos)
+}
+
+func (files *flatBlockFiles) Remove(file int) error {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+
+	if file == files.lastFile {
+		return errors.New("block file: can't remove the file being written")
+	}
+
+	if err := os.Remove(files.path(file)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(files.undoPath(file)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (files *flatBlockFiles) Close() error {
+	return nil
+}
+
+// 在文件末尾追加一条记录
+func appendRecord(path string, file int, data []byte) (blockPos, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return blockPos{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return blockPos{}, err
+	}
+
+	if _, err = f.Write(encodeBlockRecord(data)); err != nil {
+		return blockPos{}, err
+	}
+	if err = f.Sync(); err != nil {
+		return blockPos{}, err
+	}
+
+	return blockPos{file, info.Size() + blockRecordHeaderLen, int64(len(data))}, nil
+}
+
+func readRecord(path string, pos blockPos) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	record := make([]byte, blockRecordHeaderLen+pos.Size)
+	if _, err = f.ReadAt(record, pos.Offset-blockRecordHeaderLen); err != nil {
+		return nil, err
+	}
+
+	return decodeBlockRecord(record)
+}
+
+// 纯内存的区块文件, 和 memStorage 一起使用
+type memBlockFiles struct {
+	lock      sync.RWMutex
+	files     [][]byte
+	undoFiles map[int][]byte
+}
+
+func NewMemBlockFiles() BlockFiles {
+	return &memBlockFiles{files: [][]byte{nil}, undoFiles: make(map[int][]byte)}
+}
+
+func (files *memBlockFiles) Append(data []byte) (blockPos, error) {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+
+	last := len(files.files) - 1
+	recordLen := int64(blockRecordHeaderLen + len(data))
+	if size := int64(len(files.files[last])); size > 0 && size+recordLen > maxBlockFileSize {
+		files.files = append(files.files, nil)
+		last++
+	}
+
+	offset := int64(len(files.files[last])) + blockRecordHeaderLen
+	files.files[last] = append(files.files[last], encodeBlockRecord(data)...)
+
+	return blockPos{last, offset, int64(len(data))}, nil
+}
+
+func (files *memBlockFiles) Read(pos blockPos) ([]byte, error) {
+	files.lock.RLock()
+	defer files.lock.RUnlock()
+
+	if pos.File >= len(files.files) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return readMemRecord(files.files[pos.File], pos)
+}
+
+func (files *memBlockFiles) AppendUndo(file int, data []byte) (blockPos, error) {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+
+	offset := int64(len(files.undoFiles[file])) + blockRecordHeaderLen
+	files.undoFiles[file] = append(files.undoFiles[file], encodeBlockRecord(data)...)
+
+	return blockPos{file, offset, int64(len(data))}, nil
+}
+
+func (files *memBlockFiles) ReadUndo(pos blockPos) ([]byte, error) {
+	files.lock.RLock()
+	defer files.lock.RUnlock()
+
+	return readMemRecord(files.undoFiles[pos.File], pos)
+}
+
+func (files *memBlockFiles) Remove(file int) error {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+
+	if file == len(files.files)-1 {
+		return errors.New("block file: can't remove the file being written")
+	}
+
+	files.files[file] = nil
+	delete(files.undoFiles, file)
+	return nil
+}
+
+func (files *memBlockFiles) Close() error {
+	return nil
+}
+
+func readMemRecord(content []byte, pos blockPos) ([]byte, error) {
+	if pos.Offset+pos.Size > int64(len(content)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return decodeBlockRecord(content[pos.Offset-blockRecordHeaderLen : pos.Offset+pos.Size])
+}
+
+func encodeBlockRecord(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(blockFileMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// 校验记录头, 返回记录中的数据
+func decodeBlockRecord(record []byte) ([]byte, error) {
+	if !bytes.Equal(record[:4], blockFileMagic) {
+		return nil, errors.New("block file: bad magic")
+	}
+
+	size := binary.BigEndian.Uint32(record[4:blockRecordHeaderLen])
+	if int(size) != len(record)-blockRecordHeaderLen {
+		return nil, errors.New("block file: bad record size")
+	}
+
+	return record[blockRecordHeaderLen:], nil
+}
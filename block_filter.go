@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+)
+
+// 区块的 compact filter (BIP157/158): 全节点给每个区块构建一个 GCS, 包含 output 的 PubKeyHash 和 input 花费的 output
+// 轻节点下载 filter 在本地检查, 匹配时再下载整个区块, 全节点不知道轻节点关注哪些地址
+// filter header 把每个区块的 filter 串成一条链, 轻节点从多个全节点得到的 filter header 一致时, 就可以相信 filter 没有被篡改
+const (
+	blockFilterBucket = "blockFilters" // 区块 hash => blockFilterEntry
+
+	maxCFiltersPerMsg  = 1000
+	maxCFHeadersPerMsg = 2000
+)
+
+type blockFilterEntry struct {
+	Filter []byte // 序列化后的 GCSFilter
+	Header []byte // filter header
+}
+
+// filter 的 SipHash key 是区块 hash 的前 16 字节
+func blockFilterKey(blockHash []byte) [16]byte {
+	var key [16]byte
+	copy(key[:], blockHash)
+	return key
+}
+
+// filter 中的元素: output 的 PubKeyHash 和 input 花费的 output, 只用区块本身就能得到, 不需要 UTXO 集
+func blockFilterElements(b *Block) [][]byte {
+	var elements [][]byte
+
+	for _, tx := range b.Transactions {
+		for _, out := range tx.Vout {
+			if hash := out.AddressHash(); hash != nil {
+				elements = append(elements, hash)
+			}
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Vin {
+			elements = append(elements, outpointKey(in.Txid, in.Vout))
+		}
+	}
+
+	return elements
+}
+
+func NewBlockFilter(b *Block) *GCSFilter {
+	return NewGCSFilter(blockFilterKey(b.Hash), blockFilterElements(b))
+}
+
+// 创世区块之前的 filter header 为全 0
+func filterHeader(filterHash, prevHeader []byte) []byte {
+	if prevHeader == nil {
+		prevHeader = make([]byte, sha256.Size)
+	}
+
+	hash := sha256.Sum256(append(append([]byte{}, filterHash...), prevHeader...))
+	return hash[:]
+}
+
+func filterHash(filter []byte) []byte {
+	hash := sha256.Sum256(filter)
+	return hash[:]
+}
+
+// 每个区块的 filter 和 filter header, 按区块 hash 保存, 切换分支之后原来的 filter 仍然有效, 不需要回滚
+type FilterIndex struct {
+	bc *BlockChain
+}
+
+func NewFilterIndex(bc *BlockChain) *FilterIndex {
+	return &FilterIndex{bc}
+}
+
+// 为主链上还没有 filter 的区块补上 filter
+func (index *FilterIndex) Init() {
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(blockFilterBucket))
+		return err
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	index.CatchUp()
+}
+
+// 从创世区块开始为缺少 filter 的区块构建 filter, 遇到没有数据的区块 (被裁剪了, 或者快照之前的区块还没有下载) 时停止,
+// 因为后面的 filter header 都依赖前一个
+func (index *FilterIndex) CatchUp() {
+	for height := int64(0); ; height++ {
+		hash := index.bc.GetBlockHash(height)
+		if hash == nil {
+			return
+		}
+		if index.Get(hash) != nil {
+			continue
+		}
+
+		block := index.bc.GetBlock(hash)
+		if block == nil {
+			return
+		}
+		index.ConnectBlock(block)
+	}
+}
+
+// 区块加入主链时调用, 前一个区块还没有 filter 时跳过, 等 CatchUp 补上
+func (index *FilterIndex) ConnectBlock(b *Block) {
+	var prevHeader []byte
+	if b.Height > 0 {
+		prev := index.Get(b.PrevBlockHash)
+		if prev == nil {
+			return
+		}
+		prevHeader = prev.Header
+	}
+
+	filter := NewBlockFilter(b).Serialize()
+	entry := &blockFilterEntry{filter, filterHeader(filterHash(filter), prevHeader)}
+
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		return tx.Bucket([]byte(blockFilterBucket)).Put(b.Hash, GobEncode(entry))
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 没有 filter 时返回 nil
+func (index *FilterIndex) Get(blockHash []byte) *blockFilterEntry {
+	var entry *blockFilterEntry
+
+	index.bc.db.View(func(tx StorageTx) error {
+		if value := tx.Bucket([]byte(blockFilterBucket)).Get(blockHash); value != nil {
+			entry = &blockFilterEntry{}
+			GobDecode(value, entry)
+		}
+		return nil
+	})
+
+	return entry
+}
+
+// 主链上从 startHeight 到 stopHash 的区块, 最多 max 个
+func (bc *BlockChain) cfRange(startHeight int64, stopHash []byte, max int64) ([][]byte, error) {
+	stop := bc.GetBlockHeader(stopHash)
+	if stop == nil || !bytes.Equal(bc.GetBlockHash(stop.Height), stopHash) {
+		return nil, fmt.Errorf("block %x is not on the main chain", stopHash)
+	}
+	if startHeight < 0 || startHeight > stop.Height || stop.Height-startHeight >= max {
+		return nil, fmt.Errorf("bad range %d to %d", startHeight, stop.Height)
+	}
+
+	var hashes [][]byte
+	for height := startHeight; height <= stop.Height; height++ {
+		hashes = append(hashes, bc.GetBlockHash(height))
+	}
+	return hashes, nil
+}
+
+// getcfilters 的回复
+func (bc *BlockChain) GetCFilters(startHeight int64, stopHash []byte) ([]cFilter, error) {
+	hashes, err := bc.cfRange(startHeight, stopHash, maxCFiltersPerMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	var filters []cFilter
+	for _, hash := range hashes {
+		entry := bc.filterIndex.Get(hash)
+		if entry == nil {
+			return nil, fmt.Errorf("no filter for block %x", hash)
+		}
+		filters = append(filters, cFilter{hash, entry.Filter})
+	}
+	return filters, nil
+}
+
+// getcfheaders 的回复, 只发每个 filter 的 hash, 对方用 PrevFilterHeader 依次算出 filter header
+func (bc *BlockChain) GetCFHeaders(startHeight int64, stopHash []byte) (*cfHeaders, error) {
+	hashes, err := bc.cfRange(startHeight, stopHash, maxCFHeadersPerMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := &cfHeaders{StopHash: stopHash, PrevFilterHeader: make([]byte, sha256.Size)}
+	if startHeight > 0 {
+		prev := bc.filterIndex.Get(bc.GetBlockHash(startHeight - 1))
+		if prev == nil {
+			return nil, fmt.Errorf("no filter for block at height %d", startHeight-1)
+		}
+		headers.PrevFilterHeader = prev.Header
+	}
+
+	for _, hash := range hashes {
+		entry := bc.filterIndex.Get(hash)
+		if entry == nil {
+			return nil, fmt.Errorf("no filter for block %x", hash)
+		}
+		headers.FilterHashes = append(headers.FilterHashes, filterHash(entry.Filter))
+	}
+	return headers, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import "log"
+
+// 数据库中保存的区块信息: 区块头 和 区块在区块文件中的位置
+type blockIndexEntry struct {
+	Header  BlockHeader
+	TxCount int
+	Pos     blockPos
+	UndoPos blockPos // 区块连接到主链时写入的回滚数据
+	HasUndo bool
+	Pruned  bool // 区块数据和回滚数据已经被裁剪, 只剩下区块头
+	Invalid bool // 区块中的交易不能连接到前一个区块, 或者前一个区块不合法, 不会再被连接到主链
+}
+
+func (entry *blockIndexEntry) Serialize() []byte {
+	return GobEncode(entry)
+}
+
+func deserializeBlockIndexEntry(b []byte) *blockIndexEntry {
+	entry := &blockIndexEntry{}
+	GobDecode(b, entry)
+	return entry
+}
+
+// 把区块追加到区块文件, 并在 blocksBucket 中记录区块头和位置
+func (bc *BlockChain) writeBlock(tx StorageTx, block *Block) error {
+	entry := &blockIndexEntry{Header: *block.Header(), TxCount: len(block.Transactions)}
+	return bc.writeBlockData(tx, block, entry)
+}
+
+// 把区块数据追加到区块文件, 更新 entry 中的位置后保存
+func (bc *BlockChain) writeBlockData(tx StorageTx, block *Block, entry *blockIndexEntry) error {
+	data := block.Serialize()
+	pos, err := bc.blockFiles.Append(data)
+	if err != nil {
+		return err
+	}
+
+	entry.Pos = pos
+	entry.Pruned = false
+	if err = tx.Bucket(blocksBucket).Put(block.Hash, entry.Serialize()); err != nil {
+		return err
+	}
+
+	return updateBlockFileInfo(tx, pos.File, func(info *blockFileInfo) {
+		info.Size += blockRecordHeaderLen + pos.Size
+		info.Hashes = append(info.Hashes, block.Hash)
+		if block.Height > info.MaxHeight {
+			info.MaxHeight = block.Height
+		}
+	})
+}
+
+// 标记区块不合法, 以后再收到这个区块或者它之后的区块时直接丢弃
+func (bc *BlockChain) markInvalid(hash []byte) {
+	err := bc.db.Update(func(tx StorageTx) error {
+		bucket := tx.Bucket(blocksBucket)
+		value := bucket.Get(hash)
+		if value == nil {
+			return nil
+		}
+
+		entry := deserializeBlockIndexEntry(value)
+		entry.Invalid = true
+		return bucket.Put(hash, entry.Serialize())
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 区块不存在时返回 nil
+func (bc *BlockChain) getBlockIndex(hash []byte) *blockIndexEntry {
+	var entry *blockIndexEntry
+
+	bc.db.View(func(tx StorageTx) error {
+		value := tx.Bucket(blocksBucket).Get(hash)
+		if value != nil {
+			entry = deserializeBlockIndexEntry(value)
+		}
+		return nil
+	})
+
+	return entry
+}
+
+// 只读取区块头, 不读区块文件, 区块不存在时返回 nil
+func (bc *BlockChain) GetBlockHeader(hash []byte) *BlockHeader {
+	entry := bc.getBlockIndex(hash)
+	if entry == nil {
+		return nil
+	}
+
+	return &entry.Header
+}
@@ -0,0 +1,69 @@
+package main
+
+import "log"
+
+// 区块的回滚数据: 区块中每笔交易花费掉的 output, 回滚区块时用来恢复 UTXO,
+// 这样回滚时不需要再去读之前的区块, 之前的区块被裁剪之后也能回滚
+type blockUndo struct {
+	SpentOutputs [][]TXOutput // 下标和区块中的交易对应, 每笔交易中的顺序和 Vin 一致, coinbase 为空
+	SpentHeights [][]int64    // 和 SpentOutputs 对应, 被花费的 output 所在区块的高度, 回滚时恢复到 UTXO 集中
+}
+
+func (undo *blockUndo) Serialize() []byte {
+	return GobEncode(undo)
+}
+
+func deserializeBlockUndo(b []byte) *blockUndo {
+	undo := &blockUndo{}
+	GobDecode(b, undo)
+	return undo
+}
+
+// 把回滚数据写到区块所在 blk 文件对应的 rev 文件中, 这样裁剪时可以一起删除
+func (bc *BlockChain) writeUndo(block *Block, undo *blockUndo) {
+	entry := bc.getBlockIndex(block.Hash)
+	if entry.HasUndo {
+		return // 重组失败后重新连接原来的区块, 回滚数据已经写过了
+	}
+
+	pos, err := bc.blockFiles.AppendUndo(entry.Pos.File, undo.Serialize())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	entry.UndoPos = pos
+	entry.HasUndo = true
+
+	err = bc.db.Update(func(tx StorageTx) error {
+		if err := tx.Bucket(blocksBucket).Put(block.Hash, entry.Serialize()); err != nil {
+			return err
+		}
+
+		return updateBlockFileInfo(tx, pos.File, func(info *blockFileInfo) {
+			info.Size += blockRecordHeaderLen + pos.Size
+		})
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 创世区块只有 coinbase 交易, 没有回滚数据
+func (bc *BlockChain) readUndo(block *Block) *blockUndo {
+	entry := bc.getBlockIndex(block.Hash)
+
+	if !entry.HasUndo {
+		if len(block.Transactions) == 1 && block.Transactions[0].IsCoinbase() {
+			return &blockUndo{make([][]TXOutput, 1), make([][]int64, 1)}
+		}
+		log.Panicf("ERROR: No undo data for block %x", block.Hash)
+	}
+
+	data, err := bc.blockFiles.ReadUndo(entry.UndoPos)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return deserializeBlockUndo(data)
+}
@@ -1,167 +1,518 @@
 package main
 
 import (
-	"github.com/boltdb/bolt"
+	"errors"
 	"log"
 	"encoding/hex"
 	"fmt"
 	"bytes"
-	"crypto/ecdsa"
-	"time"
 )
 
 // 常量只能是字符串、布尔和数字三种类型。
 const (
 	originDbFile    = "blockchain_%s.db"
-	blocksBucketStr = "asdf"
+	blocksBucketStr = "blocks"
+	metaBucketStr   = "meta"
 )
 
 var (
 	blocksBucket = []byte(blocksBucketStr)
-	tipKey       = []byte("l")
+	metaBucket   = []byte(metaBucketStr) // 链的状态和数据库版本
+	tipKey       = []byte("tip")
 	dbFile       string
+	reindexUTXO  bool // 启动时从创世区块重建 UTXO 集
 )
 
 type BlockChain struct {
 	//blocks []*Block
-	tip     []byte   // 最后一个区块的 hash
-	db      *bolt.DB // 存储 区块的数据库
-	utxoSet *UTXOSet
+	tip         []byte     // 最后一个区块的 hash
+	db          Storage    // 存储 区块头和各种索引的数据库
+	blockFiles  BlockFiles // 存储 完整的区块
+	utxoSet     *UTXOSet
+	txIndex     *TxIndex // 未启用交易索引时为 nil
+	heightIndex *HeightIndex
+	addrIndex   *AddrIndex
+	filterIndex *FilterIndex
 }
 
 func (bc *BlockChain) GetBestHeight() int64 {
-
-	var height int64
-	bc.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(blocksBucket)
-		blockBytes := bucket.Get(bc.tip)
-
-		block := DeserializeBlock(blockBytes)
-
-		height = block.Height
-		return nil
-	})
-
-	return height
+	return bc.GetBlockHeader(bc.tip).Height
 }
 
 func (bc *BlockChain) GetLastBlock() *Block {
 	return bc.GetBlock(bc.tip)
 }
 
+// 区块不存在或者已经被裁剪时返回 nil
 func (bc *BlockChain) GetBlock(hash []byte) *Block {
+	entry := bc.getBlockIndex(hash)
+	if entry == nil || entry.Pruned {
+		return nil
+	}
+
+	blockData, err := bc.blockFiles.Read(entry.Pos)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	var block *Block
-	bc.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(blocksBucket)
+	block, err := DeserializeBlock(blockData)
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
+}
 
-		blockData := bucket.Get(hash)
-		block = DeserializeBlock(blockData)
+func (bc *BlockChain) hasBlock(hash []byte) bool {
+	return bc.getBlockIndex(hash) != nil
+}
+
+// 返回主链上对应高度的区块 hash, 超出范围时返回 nil
+func (bc *BlockChain) GetBlockHash(height int64) []byte {
+	return bc.heightIndex.GetHash(height)
+}
+
+// 返回主链上对应高度的区块, 超出范围时返回 nil
+func (bc *BlockChain) GetBlockByHeight(height int64) *Block {
+	hash := bc.GetBlockHash(height)
+	if hash == nil {
 		return nil
-	})
+	}
 
-	return block
+	return bc.GetBlock(hash)
 }
 
-func (bc *BlockChain) GetBlocksHash(amount int64) [][]byte {
+// 从 tip 往前返回最多 amount 个区块的 hash, 只读区块头, 被裁剪的区块也会返回
+func (bc *BlockChain) GetBlocksHash(amount int64) ([][]byte, error) {
 
 	var hashes [][]byte
 	iterator := bc.Iterator()
 
 	for iterator.HasNext() && amount > 0 {
 		amount--
-		block := iterator.Next()
-		hashes = append(hashes, block.Hash)
+		header, err := iterator.NextHeader()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, header.Hash)
 	}
 
-	return hashes
+	return hashes, nil
 
 }
 
-func (bc *BlockChain) MiningBlock(txs []*Transaction) {
+// 轻节点同步区块头: 从 locator 中第一个在主链上的区块之后开始, 最多返回 max 个主链上的区块头
+// locator 中的区块都不在主链上时从创世区块开始
+func (bc *BlockChain) GetHeaders(locator [][]byte, max int) []BlockHeader {
+	start := int64(0)
+	for _, hash := range locator {
+		if header := bc.GetBlockHeader(hash); header != nil && bytes.Equal(bc.GetBlockHash(header.Height), hash) {
+			start = header.Height + 1
+			break
+		}
+	}
+
+	var headers []BlockHeader
+	for height := start; len(headers) < max; height++ {
+		hash := bc.GetBlockHash(height)
+		if hash == nil {
+			break
+		}
+		headers = append(headers, *bc.GetBlockHeader(hash))
+	}
 
-	var height int64
-	bc.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(blocksBucket)
+	return headers
+}
 
-		blockData := bucket.Get(bc.tip)
+func (bc *BlockChain) MiningBlock(txs []*Transaction) {
 
-		lastBlock := DeserializeBlock(blockData)
+	height := bc.GetBestHeight()
 
-		height = lastBlock.Height
+	newBlock := NewBlock(txs, bc.tip, height+1)
+	if err := bc.AddBlock(newBlock); err != nil {
+		log.Panic(err)
+	}
+}
 
+// 保存区块, 如果区块所在的分支比主链长就切换到这个分支
+// 区块不合法时返回错误, 主链保持不变
+func (bc *BlockChain) AddBlock(newBlock *Block) error {
+	if entry := bc.getBlockIndex(newBlock.Hash); entry != nil {
+		if entry.Invalid {
+			return fmt.Errorf("block %x is invalid", newBlock.Hash)
+		}
 		return nil
+	}
+
+	// 前一个区块还没有收到时, 等重组时再检查
+	if parent := bc.getBlockIndex(newBlock.PrevBlockHash); parent != nil {
+		if parent.Invalid {
+			return fmt.Errorf("block %x extends the invalid block %x", newBlock.Hash, newBlock.PrevBlockHash)
+		}
+		if newBlock.Height != parent.Header.Height+1 {
+			return fmt.Errorf("block %x has height %d, but its parent has height %d", newBlock.Hash, newBlock.Height, parent.Header.Height)
+		}
+	}
+
+	err := bc.db.Update(func(tx StorageTx) error {
+		return bc.writeBlock(tx, newBlock)
 	})
 
-	newBlock := NewBlock(txs, bc.tip, height+1)
-	bc.AddBlock(newBlock)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if bytes.Compare(newBlock.PrevBlockHash, bc.tip) == 0 {
+		if err := bc.connectBlock(newBlock); err != nil {
+			bc.markInvalid(newBlock.Hash)
+			return err
+		}
+	} else if newBlock.Height > bc.GetBestHeight() {
+		return bc.reorganize(newBlock)
+	}
+	return nil
+}
+
+// 检查区块中的交易能不能接到主链的末尾, 返回区块的回滚数据
+// 区块来自网络, 不合法时返回错误, 不能 panic
+func (bc *BlockChain) checkBlock(b *Block) (*blockUndo, error) {
+	undo, err := bc.utxoSet.SpentOutputs(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bc.checkBlockTxs(b, undo); err != nil {
+		return nil, err
+	}
+	return undo, nil
+}
+
+// 用区块花费的 output 和它们的高度检查区块中的交易: 金额, 时间锁和签名
+// 区块的前一个区块必须在主链上, 验证快照之前的历史区块时也用它
+func (bc *BlockChain) checkBlockTxs(b *Block, undo *blockUndo) error {
+	coinbases := 0
+	for _, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+	}
+	if coinbases != 1 {
+		return fmt.Errorf("block %x has %d coinbase transactions", b.Hash, coinbases)
+	}
+
+	var checks []inputCheck
+	for i, tx := range b.Transactions {
+		if err := checkDataOutputs(tx); err != nil {
+			return err
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		if err := checkTxValues(tx, undo.SpentOutputs[i]); err != nil {
+			return err
+		}
+		// 前一个区块的中位时间从主链上取
+		if err := bc.CheckTxLocks(tx, b.Height, undo.SpentHeights[i]); err != nil {
+			return err
+		}
+
+		txChecks, err := tx.inputChecks(prevTxsFromOutputs(tx, undo.SpentOutputs[i]))
+		if err != nil {
+			return err
+		}
+		checks = append(checks, txChecks...)
+	}
+
+	// 整个区块的签名一起并行验证, 已经验证过的签名在 sigCache 中
+	return runInputChecks(checks)
+}
+
+// 数据 output 最多 maxDataCarrierSize 字节, coinbase 也一样
+// 按整个 OP_RETURN 脚本的长度检查, 分成几次压入也不能超过
+func checkDataOutputs(tx *Transaction) error {
+	for _, out := range tx.Vout {
+		script := out.ScriptPubKey
+		if len(script) > 0 && script[0] == OP_RETURN && len(script) > maxNullDataScriptSize {
+			return fmt.Errorf("transaction %x carries a %d byte data output, at most %d bytes of data", tx.ID, len(script), maxDataCarrierSize)
+		}
+	}
+	return nil
+}
+
+// output 的金额不能为负数, 总和不能超过被花费的 output
+func checkTxValues(tx *Transaction, spent []TXOutput) error {
+	in, out := 0, 0
+	for _, prevOut := range spent {
+		in += prevOut.Value
+	}
+	for _, vout := range tx.Vout {
+		if vout.Value < 0 {
+			return fmt.Errorf("transaction %x has a negative output", tx.ID)
+		}
+		out += vout.Value
+	}
+	if out > in {
+		return fmt.Errorf("transaction %x spends %d but only has %d", tx.ID, out, in)
+	}
+	return nil
 }
 
-func (bc *BlockChain) AddBlock(newBlock *Block) {
-	bc.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(blocksBucket)
-		err := bucket.Put(newBlock.Hash, newBlock.Serialize())
-		err = bucket.Put(tipKey, newBlock.Hash)
+// 把区块接到主链的末尾, 区块中的交易不合法时返回错误, 不做任何修改
+func (bc *BlockChain) connectBlock(newBlock *Block) error {
+	undo, err := bc.checkBlock(newBlock)
+	if err != nil {
 		return err
+	}
+	bc.writeUndo(newBlock, undo)
+
+	err = bc.db.Update(func(tx StorageTx) error {
+		return tx.Bucket(metaBucket).Put(tipKey, newBlock.Hash)
 	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
 	bc.tip = newBlock.Hash
 	bc.utxoSet.Update(newBlock)
+	bc.heightIndex.ConnectBlock(newBlock)
+
+	if bc.txIndex != nil {
+		bc.txIndex.ConnectBlock(newBlock)
+	}
+	bc.addrIndex.ConnectBlock(newBlock, undo)
+	bc.filterIndex.ConnectBlock(newBlock)
+
+	bc.prune()
+	return nil
+}
+
+// 切换主链到 newTip 所在的分支
+//   1. 从 newTip 往前找到和主链的分叉点
+//   2. 把主链回滚到分叉点
+//   3. 依次连接分支上的区块, 每个区块都用分叉点之后的 UTXO 集检查
+//   4. 有区块不合法时, 把它和之后的区块标记为不合法, 重新连接原来的主链
+func (bc *BlockChain) reorganize(newTip *Block) error {
+	var branch []*Block
+	var fork []byte
+
+	block := newTip
+	for {
+		branch = append(branch, block)
+
+		parent := bc.getBlockIndex(block.PrevBlockHash)
+		if parent == nil {
+			// 分支还没有接到我们的链上, 等收到缺失的区块再切换
+			return nil
+		}
+		if parent.Invalid || block.Height != parent.Header.Height+1 {
+			for _, b := range branch {
+				bc.markInvalid(b.Hash)
+			}
+			return fmt.Errorf("block %x doesn't connect to a valid parent at height %d", block.Hash, block.Height-1)
+		}
+
+		if bytes.Compare(bc.GetBlockHash(parent.Header.Height), block.PrevBlockHash) == 0 {
+			fork = block.PrevBlockHash
+			break
+		}
+
+		block = bc.GetBlock(block.PrevBlockHash)
+		if block == nil {
+			return fmt.Errorf("block %x on the branch has been pruned", parent.Header.Hash)
+		}
+	}
+
+	fmt.Printf("Reorganize: fork at height %d, %d blocks to connect\n", branch[len(branch)-1].Height-1, len(branch))
+
+	var disconnected []*Block
+	for bytes.Compare(bc.tip, fork) != 0 {
+		disconnected = append(disconnected, bc.DisconnectTip())
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		err := bc.connectBlock(branch[i])
+		if err == nil {
+			continue
+		}
+
+		fmt.Printf("Reorganize: block %x is invalid, back to the old chain\n", branch[i].Hash)
+		for _, b := range branch[:i+1] {
+			bc.markInvalid(b.Hash)
+		}
+
+		for bytes.Compare(bc.tip, fork) != 0 {
+			bc.DisconnectTip()
+		}
+		for j := len(disconnected) - 1; j >= 0; j-- {
+			if err := bc.connectBlock(disconnected[j]); err != nil {
+				log.Panic(err)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// 把最后一个区块从主链上回滚, 返回被回滚的区块
+func (bc *BlockChain) DisconnectTip() *Block {
+	block := bc.GetLastBlock()
+
+	if block == nil {
+		log.Panic("ERROR: Can't disconnect a pruned block")
+	}
+	if len(block.PrevBlockHash) == 0 {
+		log.Panic("ERROR: Can't disconnect the genesis block")
+	}
+
+	undo := bc.readUndo(block)
+	bc.utxoSet.Rollback(block, undo)
+	bc.addrIndex.DisconnectBlock(block, undo)
+
+	if bc.txIndex != nil {
+		bc.txIndex.DisconnectBlock(block)
+	}
+	bc.heightIndex.DisconnectBlock(block)
+
+	err := bc.db.Update(func(tx StorageTx) error {
+		return tx.Bucket(metaBucket).Put(tipKey, block.PrevBlockHash)
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc.tip = block.PrevBlockHash
+	return block
+}
+
+// 创建完区块链之后初始化 UTXO 集和索引
+func (bc *BlockChain) initIndexes() {
+	bc.heightIndex = NewHeightIndex(bc)
+	if err := bc.heightIndex.Init(); err != nil {
+		log.Panic(err)
+	}
+
+	// UTXO 集按高度从创世区块开始更新, 需要先有高度索引
+	bc.utxoSet = NewUTXOSet(bc)
+	bc.utxoSet.Init(reindexUTXO)
+
+	bc.txIndex = initTxIndex(bc)
+
+	bc.addrIndex = NewAddrIndex(bc)
+	if err := bc.addrIndex.Init(); err != nil {
+		log.Panic(err)
+	}
+
+	bc.filterIndex = NewFilterIndex(bc)
+	bc.filterIndex.Init()
 }
 
 // address: 用于接受创世区块的奖励
 func NewBlockChain(address, nodeId string) *BlockChain {
+	return NewBlockChainWithStorage(openDbFile(nodeId), openBlockFiles(nodeId), address)
+}
 
-	var tip []byte
+func LoadBlockChain(nodeId string) *BlockChain {
+	return LoadBlockChainWithStorage(openDbFile(nodeId), openBlockFiles(nodeId))
+}
+
+// 打开节点对应的 bolt 数据库文件
+func openDbFile(nodeId string) Storage {
 	dbFile = fmt.Sprintf(originDbFile, nodeId)
-	db, err := bolt.Open(dbFile, 0666, nil)
-	err = db.Update(func(tx *bolt.Tx) error {
+	db, err := OpenBoltStorage(dbFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return db
+}
+
+// 打开节点对应的区块文件目录
+func openBlockFiles(nodeId string) BlockFiles {
+	files, err := OpenFlatBlockFiles(fmt.Sprintf(originBlocksDir, nodeId))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return files
+}
+
+// 使用指定的存储创建区块链, 存储中已经有区块链时直接加载
+// 比如 NewBlockChainWithStorage(NewMemStorage(), NewMemBlockFiles(), address) 可以得到一条不写磁盘的链
+func NewBlockChainWithStorage(db Storage, files BlockFiles, address string) *BlockChain {
+
+	upgradeSchema(db, files)
+
+	bc := &BlockChain{db: db, blockFiles: files}
+	var tip []byte
+	err := db.Update(func(tx StorageTx) error {
 		bucket := tx.Bucket([]byte(blocksBucket))
 
 		if bucket == nil {
 
-			bucket, err := tx.CreateBucket(blocksBucket)
+			_, err := tx.CreateBucket(blocksBucket)
+			if err != nil {
+				log.Panic(err)
+			}
+
+			meta, err := tx.CreateBucket(metaBucket)
 			if err != nil {
 				log.Panic(err)
 			}
 
-			coinBaseTX := NewCoinBaseTX(address, "Onwards and upwards")
+			coinBaseTX := NewCoinBaseTX(address, "Onwards and upwards", 0)
 			genesisBlock := newGenesisBlock(coinBaseTX)
-			err = bucket.Put(genesisBlock.Hash, genesisBlock.Serialize())
-			err = bucket.Put(tipKey, genesisBlock.Hash)
+			err = bc.writeBlock(tx, genesisBlock)
+			if err != nil {
+				return err
+			}
+			err = meta.Put(tipKey, genesisBlock.Hash)
+			if err != nil {
+				return err
+			}
 			tip = genesisBlock.Hash
+			return putSchemaVersion(tx, schemaVersion)
 
-		} else {
-			tip = bucket.Get(tipKey)
 		}
-		return err
+
+		tip = append([]byte{}, tx.Bucket(metaBucket).Get(tipKey)...)
+		return nil
 	})
 
 	if err != nil {
 		log.Panic(err)
 	}
 
-	bc := &BlockChain{tip, db, nil}
-
-	bc.utxoSet = NewUTXOSet(bc)
-	bc.utxoSet.Reindex()
+	bc.tip = tip
+	bc.initIndexes()
+	bc.startupCheck()
 
 	return bc
 }
 
-func LoadBlockChain(nodeId string) *BlockChain {
+func LoadBlockChainWithStorage(db Storage, files BlockFiles) *BlockChain {
+	upgradeSchema(db, files)
+
 	var tip []byte
 
-	dbFile = fmt.Sprintf(originDbFile, nodeId)
-	db, _ := bolt.Open(dbFile, 0666, nil)
-	db.View(func(tx *bolt.Tx) error {
+	err := db.View(func(tx StorageTx) error {
 		bucket := tx.Bucket([]byte(blocksBucket))
-		tip = bucket.Get(tipKey)
+		if bucket == nil {
+			return errors.New("No existing blockchain found, create one first")
+		}
+
+		tip = append([]byte{}, tx.Bucket(metaBucket).Get(tipKey)...)
 		return nil
 	})
 
-	bc := &BlockChain{tip, db, nil}
-	bc.utxoSet = NewUTXOSet(bc)
-	bc.utxoSet.Reindex()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := &BlockChain{tip: tip, db: db, blockFiles: files}
+	bc.initIndexes()
+	bc.startupCheck()
 
 	return bc
 }
@@ -169,7 +520,7 @@ func LoadBlockChain(nodeId string) *BlockChain {
 // 挖矿
 func (bc *BlockChain) Mining(txs []*Transaction, addr string) {
 
-	tx := NewCoinBaseTX(addr, "")
+	tx := NewCoinBaseTX(addr, "", bc.GetBestHeight()+1)
 	fmt.Printf("%s is mining...\n", addr)
 	txs = append(txs, tx)
 
@@ -185,7 +536,13 @@ func (bc *BlockChain) Mining(txs []*Transaction, addr string) {
 }
 
 func (bc *BlockChain) Iterator() *BlockChainIterator {
-	return &BlockChainIterator{bc.tip, bc.db}
+	return &BlockChainIterator{bc.tip, bc}
+}
+
+func (bc *BlockChain) Close() {
+	bc.utxoSet.Flush()
+	bc.db.Close()
+	bc.blockFiles.Close()
 }
 
 // 查看余额的时候调用
@@ -193,46 +550,13 @@ func (bc *BlockChain) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return bc.utxoSet.FindUTXO(pubKeyHash)
 }
 
-// find all utxo for build utxo_set when ever a blockchain is been created
-func (bc *BlockChain) FindAllUTXOs() map[string]TXOutputs {
-
-	spendTxOutputs := make(map[string]IntSet) // 已花费的output  key: 交易ID, value: 当前交易的所有花费了的output的 索引合集
-	utxos := make(map[string]TXOutputs)       // 未花费的output
-
-	it := bc.Iterator()
-
-	for it.HasNext() {
-		block := it.Next()
-
-		for _, tx := range block.Transactions {
-
-			// 统计当前交易中已花费的别的交易中的output
-			for _, in := range tx.Vin {
-				prevTxID := hex.EncodeToString(in.Txid)
-
-				if spendTxOutputs[prevTxID] == nil {
-					spendTxOutputs[prevTxID] = NewIntSet()
-				}
-
-				spendTxOutputs[prevTxID].Add(in.Vout)
-			}
-
-			// 统计当前交易中的所有未被花费的交易
-			curtTxID := hex.EncodeToString(tx.ID)
-			outs := NewTxOutputs()
-			for outIdx, out := range tx.Vout {
-				if spendTxOutputs[curtTxID].Contains(outIdx) == false { // 当前output未被花费
-					outs[outIdx] = out
-				}
-			}
-
-			if len(outs) != 0 {
-				utxos[curtTxID] = outs
-			}
-		}
+// 返回地址参与过的所有交易, 按区块高度从低到高排序
+// 从快照启动并且快照之前的区块还没有验证完时返回错误, 这时地址索引中没有那些区块
+func (bc *BlockChain) GetAddrHistory(addr string) ([]addrTx, error) {
+	if err := bc.checkHistoryIndexed(); err != nil {
+		return nil, err
 	}
-
-	return utxos
+	return bc.addrIndex.History(GetPubKeyHashFromAddr(addr)), nil
 }
 
 func (bc *BlockChain) GetBalance(addr string) int {
@@ -247,18 +571,40 @@ func (bc *BlockChain) GetBalance(addr string) int {
 }
 
 func (bc *BlockChain) NewUTXOTransaction(from *Wallet, to string, amount int) *Transaction {
+	return bc.newPaymentTransaction(from, NewTxOutput(amount, to))
+}
+
+// 转到 to 的 output 带时间锁, relative 为 false 时 lock 是区块高度或者 unix 时间, 否则是 Sequence 格式的相对时间锁
+// 到期之前 to 不能花费这个 output, 可以用于分期解锁或者托管
+func (bc *BlockChain) NewTimeLockedTransaction(from *Wallet, to string, amount int, lock int64, relative bool) *Transaction {
+	addrVersion, pubKeyHash := decodeAddress(to)
+	if !isP2PKHVersion(addrVersion) {
+		log.Panic("ERROR: Time locks only support wallet addresses")
+	}
+
+	return bc.newPaymentTransaction(from, TXOutput{amount, NewTimeLockScript(lock, relative, pubKeyHash)})
+}
+
+// 在链上放 data, 花费 from 的一个 UTXO 并全部找零, 只是为了让交易有 input
+func (bc *BlockChain) NewDataTransaction(from *Wallet, data []byte) *Transaction {
+	return bc.newPaymentTransaction(from, NewDataOutput(data))
+}
+
+func (bc *BlockChain) newPaymentTransaction(from *Wallet, payment TXOutput) *Transaction {
 
 	// 1. 找到from用户的amount数量的 utxo
 	// 2. 添加交易
 
-	if amount <= 0 {
+	amount := payment.Value
+	if amount < 0 || (amount == 0 && !IsUnspendable(payment.ScriptPubKey)) {
 		log.Panic("ERROR: Wrong amount")
 		return nil
 	}
 
+	// 至少要花费一个 UTXO, 数据 output 的金额为 0 也一样
 	acc, spendableOutputs := bc.FindSpendableOutputs(HashPubKey(from.PublicKey), amount)
 
-	if acc < amount {
+	if acc < amount || len(spendableOutputs) == 0 {
 		log.Panic("ERROR: Not enough funds")
 		return nil
 	}
@@ -270,7 +616,7 @@ func (bc *BlockChain) NewUTXOTransaction(from *Wallet, to string, amount int) *T
 		txID, _ := hex.DecodeString(txid)
 
 		for _, outIdx := range outIdxs {
-			inputs = append(inputs, TXInput{txID, outIdx, nil, from.PublicKey})
+			inputs = append(inputs, TXInput{txID, outIdx, nil, maxSequence})
 		}
 	}
 
@@ -279,45 +625,131 @@ func (bc *BlockChain) NewUTXOTransaction(from *Wallet, to string, amount int) *T
 		outputs = append(outputs, NewTxOutput(acc-amount, addr))
 	}
 
-	outputs = append(outputs, NewTxOutput(amount, to))
+	outputs = append(outputs, payment)
 
-	tx := Transaction{nil, inputs, outputs, time.Now().UnixNano()}
+	tx := Transaction{nil, txVersion, inputs, outputs, 0}
 
+	tx.setTimeLocks(bc.getPrevTxs(&tx)) // 时间锁是交易 ID 的一部分, 要在签名之前设置
 	bc.SignTx(&tx, from.PrivateKey) // 签名交易
 	tx.Hash()
 
 	return &tx
 }
 
+// 花费 P2SH 多重签名地址的 UTXO, 返回还没有签名的交易, 每个 input 的 ScriptSig 中只有空的签名位置和 redeem script
+// 之后交给各个签名人用 SignTx 依次签名, 有 M 个签名之后就可以发送
+func (bc *BlockChain) NewMultisigTransaction(redeemScript []byte, to string, amount int) *Transaction {
+	if amount <= 0 {
+		log.Panic("ERROR: Wrong amount")
+		return nil
+	}
+
+	m, pubKeys := ExtractMultisig(redeemScript)
+	if m == 0 {
+		log.Panic("ERROR: Not a multisig redeem script")
+		return nil
+	}
+
+	acc, spendableOutputs := bc.FindSpendableOutputs(HashPubKey(redeemScript), amount)
+
+	if acc < amount {
+		log.Panic("ERROR: Not enough funds")
+		return nil
+	}
+
+	var inputs []TXInput
+	var outputs []TXOutput
+
+	emptySigs := make([][]byte, len(pubKeys))
+	for txid, outIdxs := range spendableOutputs {
+		txID, _ := hex.DecodeString(txid)
+
+		for _, outIdx := range outIdxs {
+			inputs = append(inputs, TXInput{txID, outIdx, NewMultisigScriptSig(emptySigs, redeemScript), maxSequence})
+		}
+	}
+
+	if acc > amount {
+		addr := hex.EncodeToString(NewP2SHAddress(redeemScript))
+		outputs = append(outputs, NewTxOutput(acc-amount, addr))
+	}
+
+	outputs = append(outputs, NewTxOutput(amount, to))
+
+	tx := Transaction{nil, txVersion, inputs, outputs, 0}
+	tx.Hash()
+
+	return &tx
+}
+
 func (bc *BlockChain) getPrevTxs(tx *Transaction) map[string]*Transaction {
 	prevTxs := make(map[string]*Transaction)
 
 	for _, in := range tx.Vin {
 		txID := hex.EncodeToString(in.Txid)
-		prevTxs[txID] = bc.findTx(in.Txid)
+
+		prevTx := bc.findTx(in.Txid)
+		if prevTx == nil {
+			prevTx = bc.utxoSet.FindTx(in.Txid) // 交易所在的区块可能已经被裁剪了
+		}
+		prevTxs[txID] = prevTx
 	}
 
 	return prevTxs
 }
 
 func (bc *BlockChain) findTx(txId []byte) *Transaction {
+	tx, _ := bc.findTxWithBlock(txId)
+	return tx
+}
+
+// 返回交易和它所在的区块, 找不到时都为 nil
+func (bc *BlockChain) findTxWithBlock(txId []byte) (*Transaction, *Block) {
+
+	if bc.txIndex != nil {
+		loc := bc.txIndex.Find(txId)
+		if loc == nil {
+			return nil, nil
+		}
 
+		block := bc.GetBlock(loc.BlockHash)
+		if block == nil {
+			return nil, nil // 区块已经被裁剪
+		}
+		return block.Transactions[loc.Index], block
+	}
+
+	// 没有交易索引时只能遍历还有数据的区块, 遇到被裁剪的区块就停止
 	iterator := bc.Iterator()
 	for iterator.HasNext() {
-		block := iterator.Next()
+		block, err := iterator.Next()
+		if err != nil {
+			break
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(txId, tx.ID) == 0 {
-				return tx
+				return tx, block
 			}
 		}
 	}
 
-	return nil
+	return nil, nil
+}
+
+// 返回交易以及它的确认数, 交易不在链上时返回 nil, 0
+// 没找到并且快照之前的区块还没有验证完时返回错误, 交易可能在那些区块中
+func (bc *BlockChain) GetTransaction(txId []byte) (*Transaction, int64, error) {
+	tx, block := bc.findTxWithBlock(txId)
+
+	if tx == nil {
+		return nil, 0, bc.checkHistoryIndexed()
+	}
 
+	return tx, bc.GetBestHeight() - block.Height + 1, nil
 }
 
-func (bc *BlockChain) SignTx(tx *Transaction, key ecdsa.PrivateKey) {
+func (bc *BlockChain) SignTx(tx *Transaction, key PrivateKey) {
 
 	prevTxs := bc.getPrevTxs(tx)
 	tx.Sign(key, prevTxs)
@@ -328,12 +760,29 @@ func (bc *BlockChain) VerifyTx(tx *Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
-	prevTxs := bc.getPrevTxs(tx)
-	res := tx.Verify(prevTxs)
+
+	// 被花费的 output 从 UTXO 集中取, 交易索引中还有已经被花费的 output
+	// 交易会被放在下一个区块中
+	spent, coinHeights, err := bc.utxoSet.InputOutputs(tx)
+	if err == nil {
+		err = checkDataOutputs(tx)
+	}
+	if err == nil {
+		err = checkTxValues(tx, spent)
+	}
+	if err == nil {
+		err = bc.CheckTxLocks(tx, bc.GetBestHeight()+1, coinHeights)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	res := tx.Verify(prevTxsFromOutputs(tx, spent))
 	return res
 }
 
-//  返回  >= amount 数量的 UTXOs
+//  返回  >= amount 数量的 UTXOs, 跳过下一个区块中还不能花费的带时间锁的 output
 func (bc *BlockChain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	return bc.utxoSet.FindSpendableOutputs(pubKeyHash, amount)
+	return bc.utxoSet.FindSpendableOutputs(pubKeyHash, amount, bc.newTimeLockFilter())
 }
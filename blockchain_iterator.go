@@ -1,33 +1,74 @@
 package main
 
-import (
-	"github.com/boltdb/bolt"
-	"log"
-)
+import "fmt"
 
+// 从 tip 往前遍历主链, 通过区块头中的 PrevBlockHash 往前走
 type BlockChainIterator struct {
 	currentHash []byte
-	db          *bolt.DB
+	bc          *BlockChain
 }
 
-func (bci *BlockChainIterator) Next() *Block {
+// 只读区块索引中的区块头, 区块被裁剪之后也能遍历
+func (bci *BlockChainIterator) NextHeader() (*BlockHeader, error) {
 
-	var block *Block
-	err := bci.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(blocksBucket)
-		encodedBlock := bucket.Get(bci.currentHash)
-		block = DeserializeBlock(encodedBlock)
-		return nil
-	})
+	header := bci.bc.GetBlockHeader(bci.currentHash)
+	if header == nil {
+		return nil, fmt.Errorf("block %x not found", bci.currentHash)
+	}
+
+	bci.currentHash = header.PrevBlockHash
+	return header, nil
+}
 
-	if err != nil {
-		log.Panic(err)
+// 区块数据已经被裁剪时返回错误
+func (bci *BlockChainIterator) Next() (*Block, error) {
+
+	block := bci.bc.GetBlock(bci.currentHash)
+	if block == nil {
+		return nil, fmt.Errorf("block %x not found or pruned", bci.currentHash)
 	}
 
 	bci.currentHash = block.PrevBlockHash
-	return block
+	return block, nil
 }
 
 func (bci *BlockChainIterator) HasNext() bool {
 	return len(bci.currentHash) != 0
 }
+
+// 按高度遍历主链上 [from, to] 之间的区块, from > to 时从高往低遍历
+type BlockRangeIterator struct {
+	bc      *BlockChain
+	current int64
+	to      int64
+	step    int64
+}
+
+func (bc *BlockChain) RangeIterator(from, to int64) *BlockRangeIterator {
+	step := int64(1)
+	if from > to {
+		step = -1
+	}
+
+	return &BlockRangeIterator{bc, from, to, step}
+}
+
+// 区块数据已经被裁剪时返回错误, 下一次调用接着遍历下一个高度
+func (it *BlockRangeIterator) Next() (*Block, error) {
+	height := it.current
+	it.current += it.step
+
+	block := it.bc.GetBlockByHeight(height)
+	if block == nil {
+		return nil, fmt.Errorf("no block data at height %d", height)
+	}
+
+	return block, nil
+}
+
+func (it *BlockRangeIterator) HasNext() bool {
+	if it.step > 0 {
+		return it.current <= it.to
+	}
+	return it.current >= it.to
+}
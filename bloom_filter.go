@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// BIP37 的 bloom filter: 轻节点把自己关心的数据 (地址的 PubKeyHash, 公钥, 自己的 output) 加到 filter 中发给全节点,
+// 全节点只把匹配的交易发回来. 有一定的误判率, 全节点不能准确地知道哪些交易是轻节点的, 但是轻节点也不能完全隐藏自己
+const (
+	maxBloomFilterSize = 36000 // 字节
+	maxBloomHashFuncs  = 50
+	bloomSeedStep      = 0xfba4c795 // 第 i 个 hash 函数的 seed 是 i * bloomSeedStep + Tweak
+)
+
+type BloomFilter struct {
+	Bits      []byte
+	HashFuncs uint32
+	Tweak     uint32 // 随机数, 不同的轻节点相同的数据在 filter 中的位置不同
+}
+
+// 按预计的元素个数和误判率选择 filter 的大小和 hash 函数的个数, 不超过 BIP37 的上限
+func NewBloomFilter(elements int, fpRate float64, tweak uint32) *BloomFilter {
+	if elements < 1 {
+		elements = 1
+	}
+
+	size := int(-1 / (math.Ln2 * math.Ln2) * float64(elements) * math.Log(fpRate) / 8)
+	size = int(math.Max(1, math.Min(float64(size), maxBloomFilterSize)))
+
+	hashFuncs := uint32(float64(size*8) / float64(elements) * math.Ln2)
+	hashFuncs = uint32(math.Max(1, math.Min(float64(hashFuncs), maxBloomHashFuncs)))
+
+	return &BloomFilter{make([]byte, size), hashFuncs, tweak}
+}
+
+// 对方发来的 filter 可能太大, 或者 hash 函数太多, 检查的时候太慢
+func (f *BloomFilter) IsValid() bool {
+	return len(f.Bits) > 0 && len(f.Bits) <= maxBloomFilterSize && f.HashFuncs > 0 && f.HashFuncs <= maxBloomHashFuncs
+}
+
+func (f *BloomFilter) bitIndex(i uint32, data []byte) uint32 {
+	return murmur3(i*bloomSeedStep+f.Tweak, data) % uint32(len(f.Bits)*8)
+}
+
+func (f *BloomFilter) Add(data []byte) {
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		index := f.bitIndex(i, data)
+		f.Bits[index>>3] |= 1 << (index & 7)
+	}
+}
+
+func (f *BloomFilter) Contains(data []byte) bool {
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		index := f.bitIndex(i, data)
+		if f.Bits[index>>3]&(1<<(index&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// output 在 filter 中的 key
+func outpointKey(txID []byte, outIdx int) []byte {
+	return append(append([]byte{}, txID...), IntToHex(int64(outIdx))...)
+}
+
+// 交易是否和 filter 有关: 交易 ID, output 脚本中的数据, 花费的 output, input 脚本中的数据 (公钥) 在 filter 中
+// output 匹配时把它加到 filter 中, 这样以后花费它的交易也能匹配, 轻节点不需要重新发送 filter
+func (f *BloomFilter) MatchTx(tx *Transaction) bool {
+	matched := f.Contains(tx.ID)
+
+	for outIdx, out := range tx.Vout {
+		ops, _ := parseScript(out.ScriptPubKey)
+		for _, op := range ops {
+			if len(op.data) > 0 && f.Contains(op.data) {
+				matched = true
+				f.Add(outpointKey(tx.ID, outIdx))
+				break
+			}
+		}
+	}
+
+	if matched || tx.IsCoinbase() {
+		return matched
+	}
+
+	for _, in := range tx.Vin {
+		if f.Contains(outpointKey(in.Txid, in.Vout)) {
+			return true
+		}
+		for _, data := range scriptPushes(in.ScriptSig) {
+			if len(data) > 0 && f.Contains(data) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 32 位的 MurmurHash3, BIP37 使用的 hash 函数
+func murmur3(seed uint32, data []byte) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	h := seed
+	blocks := len(data) / 4
+	for i := 0; i < blocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+
+		h ^= k
+		h = h<<13 | h>>19
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[blocks*4:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
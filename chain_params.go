@@ -0,0 +1,33 @@
+package main
+
+// 网络相关的参数, 同一个网络中的节点必须使用相同的参数
+type ChainParams struct {
+	Name string
+
+	// 可信的 UTXO 快照, 新节点可以用 loadUTXOSnapshot 从这些快照启动, 不需要重放整条链
+	// 用 dumpUTXOSet 导出快照, 把它输出的高度, 区块 hash 和 commitment 加到这里
+	AssumeUTXO []AssumeUTXO
+}
+
+type AssumeUTXO struct {
+	Height     int64
+	BlockHash  string // hex
+	Commitment string // hex, 快照中 UTXO 集的 commitment
+}
+
+var mainChainParams = &ChainParams{
+	Name:       "main",
+	AssumeUTXO: []AssumeUTXO{},
+}
+
+var activeChainParams = mainChainParams
+
+// 返回对应区块的可信快照, 没有时返回 nil
+func (params *ChainParams) FindAssumeUTXO(height int64, blockHash string) *AssumeUTXO {
+	for i, snapshot := range params.AssumeUTXO {
+		if snapshot.Height == height && snapshot.BlockHash == blockHash {
+			return &params.AssumeUTXO[i]
+		}
+	}
+	return nil
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"flag"
 	"os"
 	"fmt"
 	"encoding/hex"
+	"strings"
+	"time"
 )
 
 type CLI struct {
@@ -24,16 +28,107 @@ func (cli *CLI) run() {
 	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)                         // 挖矿
 	createWalletCmd := flag.NewFlagSet("createWallet", flag.ExitOnError)         // 创建钱包
 	sendCmd := flag.NewFlagSet("sendNetworkPacket", flag.ExitOnError)                         // 转账
+	getTransactionCmd := flag.NewFlagSet("getTransaction", flag.ExitOnError)     // 查看交易
+	getBlockCmd := flag.NewFlagSet("getBlock", flag.ExitOnError)                 // 查看区块
+	listTransactionsCmd := flag.NewFlagSet("listTransactions", flag.ExitOnError) // 查看地址的交易记录
+	startNodeCmd := flag.NewFlagSet("startNode", flag.ExitOnError)               // 启动节点
+	verifyChainCmd := flag.NewFlagSet("verifyChain", flag.ExitOnError)           // 校验区块链
+	dumpUTXOSetCmd := flag.NewFlagSet("dumpUTXOSet", flag.ExitOnError)           // 导出 UTXO 快照
+	loadSnapshotCmd := flag.NewFlagSet("loadUTXOSnapshot", flag.ExitOnError)     // 从 UTXO 快照创建区块链
+	createMultisigCmd := flag.NewFlagSet("createMultisig", flag.ExitOnError)     // 创建多重签名地址
+	createMultisigTxCmd := flag.NewFlagSet("createMultisigTx", flag.ExitOnError) // 创建花费多重签名地址的交易
+	signTxCmd := flag.NewFlagSet("signTx", flag.ExitOnError)                     // 给交易签名
+	sendTxCmd := flag.NewFlagSet("sendTx", flag.ExitOnError)                     // 挖矿打包签好的交易, 或者发给正在运行的节点
+	initiateSwapCmd := flag.NewFlagSet("initiateSwap", flag.ExitOnError)         // 发起原子交换
+	participateSwapCmd := flag.NewFlagSet("participateSwap", flag.ExitOnError)   // 参与原子交换
+	redeemSwapCmd := flag.NewFlagSet("redeemSwap", flag.ExitOnError)             // 用 secret 取走合约中的币
+	refundSwapCmd := flag.NewFlagSet("refundSwap", flag.ExitOnError)             // 合约超时之后退款
+	auditSwapCmd := flag.NewFlagSet("auditSwap", flag.ExitOnError)               // 检查合约
+	notarizeCmd := flag.NewFlagSet("notarize", flag.ExitOnError)                 // 把文件的 hash 放到链上
+	verifyNotarizationCmd := flag.NewFlagSet("verifyNotarization", flag.ExitOnError) // 证明文件在某个区块之前就存在
+	getTxProofCmd := flag.NewFlagSet("getTxProof", flag.ExitOnError)                 // 生成交易在区块中的证明
+	verifyTxProofCmd := flag.NewFlagSet("verifyTxProof", flag.ExitOnError)           // 用区块头验证交易的证明
+	startLightNodeCmd := flag.NewFlagSet("startLightNode", flag.ExitOnError)         // 启动轻节点, 只同步区块头
+	getLightBalanceCmd := flag.NewFlagSet("getLightBalance", flag.ExitOnError)       // 查看轻节点算出的余额
 
 	//addBlockData := addBlockCmd.String("Data", "", "add the fucking Data to a new block")
 	createBlockChainAddr := addAddrCmdFlag(createBlockChainCmd)
 	printChainAddr := addAddrCmdFlag(printChainCmd)
+	printChainFrom := printChainCmd.Int64("from", -1, "start height, default is the tip")
+	printChainTo := printChainCmd.Int64("to", 0, "end height")
 	getBalanceAddr := addAddrCmdFlag(getBalanceCmd)
 	mineAddr := addAddrCmdFlag(mineCmd)
+	listTransactionsAddr := addAddrCmdFlag(listTransactionsCmd)
+	startNodeAddr := addAddrCmdFlag(startNodeCmd)
+	startNodePrune := startNodeCmd.Int64("prune", 0, "delete old blocks to keep block files under this size in MB, 0 disables pruning")
+	startNodeCheckBlocks := startNodeCmd.Int64("checkblocks", startupCheckDepth, "how many blocks to verify at startup, 0 verifies all blocks")
+	startNodeCheckLevel := startNodeCmd.Int("checklevel", startupCheckLevel, "how thorough the startup verification is (0-3), -1 disables it")
+	startNodeReindex := startNodeCmd.Bool("reindex", false, "rebuild the UTXO set from the genesis block")
+	startNodeDbCache := startNodeCmd.Int64("dbcache", utxoCacheSize/1024/1024, "UTXO cache size in MB")
+	startNodeTxIndex := startNodeCmd.Bool("txindex", false, "maintain an index of all transactions for getTransaction, the setting is kept until it is changed again")
+
+	createWalletScheme := createWalletCmd.String("scheme", defaultSigScheme.String(), "signature scheme of the new wallet: p256, secp256k1 or schnorr")
 
 	fromAddr := sendCmd.String("from", "", "")
 	toAddr := sendCmd.String("to", "", "")
 	sendAmount := sendCmd.Int("amount", 0, "")
+	sendLockTime := sendCmd.Int64("locktime", 0, "the receiver can spend it only after this block height, or unix time if >= 500000000")
+	sendAfterBlocks := sendCmd.Int64("after-blocks", 0, "the receiver can spend it only after this many blocks since it is confirmed")
+
+	getTransactionID := getTransactionCmd.String("txid", "", "")
+
+	getBlockHeight := getBlockCmd.Int64("height", -1, "")
+
+	verifyChainDepth := verifyChainCmd.Int64("depth", 6, "how many blocks to verify, 0 verifies all blocks")
+	verifyChainLevel := verifyChainCmd.Int("level", maxVerifyLevel, "0: proof of work and linkage, 1: merkle roots, 2: signatures, 3: UTXO set")
+
+	createMultisigM := createMultisigCmd.Int("m", 0, "how many signatures are required")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "comma separated wallet addresses or hex public keys")
+
+	createMultisigTxScript := createMultisigTxCmd.String("redeemscript", "", "hex redeem script printed by createMultisig")
+	createMultisigTxTo := createMultisigTxCmd.String("to", "", "")
+	createMultisigTxAmount := createMultisigTxCmd.Int("amount", 0, "")
+
+	signTxHex := signTxCmd.String("tx", "", "hex transaction")
+	signTxAddr := addAddrCmdFlag(signTxCmd)
+
+	sendTxHex := sendTxCmd.String("tx", "", "hex transaction")
+	sendTxMiner := sendTxCmd.String("miner", "", "address of the mining reward")
+	sendTxNode := sendTxCmd.String("node", "", "send the transaction to the memory pool of this node instead of mining it, e.g. localhost:3000")
+
+	initiateSwapFrom := initiateSwapCmd.String("from", "", "")
+	initiateSwapTo := initiateSwapCmd.String("to", "", "address of the participant on this chain")
+	initiateSwapAmount := initiateSwapCmd.Int("amount", 0, "")
+	initiateSwapTimeout := initiateSwapCmd.Duration("timeout", 48*time.Hour, "refund the contract after this long")
+
+	participateSwapFrom := participateSwapCmd.String("from", "", "")
+	participateSwapTo := participateSwapCmd.String("to", "", "address of the initiator on this chain")
+	participateSwapAmount := participateSwapCmd.Int("amount", 0, "")
+	participateSwapHash := participateSwapCmd.String("secrethash", "", "secret hash from the initiator's contract")
+	participateSwapTimeout := participateSwapCmd.Duration("timeout", 24*time.Hour, "refund the contract after this long, must be shorter than the initiator's")
+
+	redeemSwapAddr := addAddrCmdFlag(redeemSwapCmd)
+	redeemSwapContract := redeemSwapCmd.String("contract", "", "hex contract script")
+	redeemSwapSecret := redeemSwapCmd.String("secret", "", "hex secret")
+
+	refundSwapAddr := addAddrCmdFlag(refundSwapCmd)
+	refundSwapContract := refundSwapCmd.String("contract", "", "hex contract script")
+
+	auditSwapContract := auditSwapCmd.String("contract", "", "hex contract script")
+
+	notarizeFile := notarizeCmd.String("file", "", "")
+	notarizeAddr := addAddrCmdFlag(notarizeCmd)
+
+	verifyNotarizationFile := verifyNotarizationCmd.String("file", "", "")
+	verifyNotarizationTxID := verifyNotarizationCmd.String("txid", "", "transaction printed by notarize")
+
+	getTxProofID := getTxProofCmd.String("txid", "", "")
+	verifyTxProofData := verifyTxProofCmd.String("proof", "", "hex proof printed by getTxProof")
+
+	startLightNodeAddr := startLightNodeCmd.String("addr", "", "comma separated addresses to watch, added to the ones watched before")
+	startLightNodeCFilters := startLightNodeCmd.Bool("cfilters", false, "check compact block filters locally instead of sending a bloom filter to full nodes")
+
+	nodeId := os.Getenv("NODE_ID")
 
 	switch os.Args[1] {
 	case "addBlock":
@@ -57,6 +152,72 @@ func (cli *CLI) run() {
 	case "sendNetworkPacket":
 		sendCmd.Parse(os.Args[2:])
 
+	case "getTransaction":
+		getTransactionCmd.Parse(os.Args[2:])
+
+	case "getBlock":
+		getBlockCmd.Parse(os.Args[2:])
+
+	case "listTransactions":
+		listTransactionsCmd.Parse(os.Args[2:])
+
+	case "startNode":
+		startNodeCmd.Parse(os.Args[2:])
+
+	case "verifyChain":
+		verifyChainCmd.Parse(os.Args[2:])
+
+	case "dumpUTXOSet":
+		dumpUTXOSetCmd.Parse(os.Args[2:])
+
+	case "loadUTXOSnapshot":
+		loadSnapshotCmd.Parse(os.Args[2:])
+
+	case "createMultisig":
+		createMultisigCmd.Parse(os.Args[2:])
+
+	case "createMultisigTx":
+		createMultisigTxCmd.Parse(os.Args[2:])
+
+	case "signTx":
+		signTxCmd.Parse(os.Args[2:])
+
+	case "sendTx":
+		sendTxCmd.Parse(os.Args[2:])
+
+	case "initiateSwap":
+		initiateSwapCmd.Parse(os.Args[2:])
+
+	case "participateSwap":
+		participateSwapCmd.Parse(os.Args[2:])
+
+	case "redeemSwap":
+		redeemSwapCmd.Parse(os.Args[2:])
+
+	case "refundSwap":
+		refundSwapCmd.Parse(os.Args[2:])
+
+	case "auditSwap":
+		auditSwapCmd.Parse(os.Args[2:])
+
+	case "notarize":
+		notarizeCmd.Parse(os.Args[2:])
+
+	case "verifyNotarization":
+		verifyNotarizationCmd.Parse(os.Args[2:])
+
+	case "getTxProof":
+		getTxProofCmd.Parse(os.Args[2:])
+
+	case "verifyTxProof":
+		verifyTxProofCmd.Parse(os.Args[2:])
+
+	case "startLightNode":
+		startLightNodeCmd.Parse(os.Args[2:])
+
+	case "getLightBalance":
+		getLightBalanceCmd.Parse(os.Args[2:])
+
 	default:
 		fmt.Println("error")
 		os.Exit(1)
@@ -68,7 +229,7 @@ func (cli *CLI) run() {
 			createBlockChainCmd.Usage()
 			os.Exit(1)
 		}
-		cli.createBlockChain(*createBlockChainAddr)
+		cli.createBlockChain(*createBlockChainAddr, nodeId)
 
 	case printChainCmd.Parsed():
 		if len(*printChainAddr) == 0 {
@@ -76,30 +237,210 @@ func (cli *CLI) run() {
 			os.Exit(1)
 		}
 
-		cli.printChain(*printChainAddr)
+		cli.printChain(*printChainAddr, nodeId, *printChainFrom, *printChainTo)
 
 	case getBalanceCmd.Parsed():
-		cli.getBalance(*getBalanceAddr)
+		cli.getBalance(*getBalanceAddr, nodeId)
 
 	case createWalletCmd.Parsed():
-		cli.createWallet()
+		scheme, err := ParseSigScheme(*createWalletScheme)
+		if err != nil {
+			fmt.Println(err)
+			createWalletCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createWallet(scheme)
 
 	case mineCmd.Parsed():
-		cli.mine(*mineAddr)
+		cli.mine(*mineAddr, nodeId)
 
 	case sendCmd.Parsed():
-		cli.send(*fromAddr, *toAddr, *sendAmount)
+		if *sendLockTime < 0 || *sendAfterBlocks < 0 || *sendAfterBlocks > sequenceLockMask ||
+			(*sendLockTime > 0 && *sendAfterBlocks > 0) {
+			sendCmd.Usage()
+			os.Exit(1)
+		}
+		cli.send(*fromAddr, *toAddr, *sendAmount, *sendLockTime, *sendAfterBlocks, nodeId)
+
+	case getTransactionCmd.Parsed():
+		if len(*getTransactionID) == 0 {
+			getTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getTransaction(*getTransactionID, nodeId)
+
+	case getBlockCmd.Parsed():
+		if *getBlockHeight < 0 {
+			getBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getBlock(*getBlockHeight, nodeId)
+
+	case listTransactionsCmd.Parsed():
+		if len(*listTransactionsAddr) == 0 {
+			listTransactionsCmd.Usage()
+			os.Exit(1)
+		}
+		cli.listTransactions(*listTransactionsAddr, nodeId)
+
+	case startNodeCmd.Parsed():
+		if len(*startNodeAddr) == 0 || *startNodePrune < 0 || *startNodeDbCache < 0 {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		startupCheckDepth = *startNodeCheckBlocks
+		startupCheckLevel = *startNodeCheckLevel
+		reindexUTXO = *startNodeReindex
+		utxoCacheSize = *startNodeDbCache * 1024 * 1024
+		startNodeCmd.Visit(func(f *flag.Flag) {
+			if f.Name == "txindex" {
+				txIndexFlag = startNodeTxIndex
+			}
+		})
+		cli.startNode(*startNodeAddr, nodeId, *startNodePrune)
+
+	case verifyChainCmd.Parsed():
+		if *verifyChainDepth < 0 || *verifyChainLevel < 0 || *verifyChainLevel > maxVerifyLevel {
+			verifyChainCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyChain(nodeId, *verifyChainDepth, *verifyChainLevel)
+
+	case dumpUTXOSetCmd.Parsed():
+		if dumpUTXOSetCmd.NArg() != 1 {
+			fmt.Println("Usage: dumpUTXOSet <file>")
+			os.Exit(1)
+		}
+		cli.dumpUTXOSet(dumpUTXOSetCmd.Arg(0), nodeId)
+
+	case loadSnapshotCmd.Parsed():
+		if loadSnapshotCmd.NArg() != 1 {
+			fmt.Println("Usage: loadUTXOSnapshot <file>")
+			os.Exit(1)
+		}
+		cli.loadUTXOSnapshot(loadSnapshotCmd.Arg(0), nodeId)
+
+	case createMultisigCmd.Parsed():
+		if *createMultisigM <= 0 || len(*createMultisigKeys) == 0 {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*createMultisigM, strings.Split(*createMultisigKeys, ","))
+
+	case createMultisigTxCmd.Parsed():
+		if len(*createMultisigTxScript) == 0 || len(*createMultisigTxTo) == 0 || *createMultisigTxAmount <= 0 {
+			createMultisigTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisigTx(*createMultisigTxScript, *createMultisigTxTo, *createMultisigTxAmount, nodeId)
+
+	case signTxCmd.Parsed():
+		if len(*signTxHex) == 0 || len(*signTxAddr) == 0 {
+			signTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signTx(*signTxHex, *signTxAddr, nodeId)
+
+	case sendTxCmd.Parsed():
+		if len(*sendTxHex) == 0 || (len(*sendTxMiner) == 0 && len(*sendTxNode) == 0) {
+			sendTxCmd.Usage()
+			os.Exit(1)
+		}
+		if len(*sendTxNode) > 0 {
+			cli.relayTx(*sendTxHex, *sendTxNode)
+		} else {
+			cli.sendTx(*sendTxHex, *sendTxMiner, nodeId)
+		}
+
+	case initiateSwapCmd.Parsed():
+		if len(*initiateSwapFrom) == 0 || len(*initiateSwapTo) == 0 || *initiateSwapAmount <= 0 || *initiateSwapTimeout <= 0 {
+			initiateSwapCmd.Usage()
+			os.Exit(1)
+		}
+		secret, secretHash := NewSwapSecret()
+		fmt.Printf("Secret:      %x\n", secret)
+		fmt.Printf("Secret hash: %x\n", secretHash)
+		cli.createSwapContract(*initiateSwapFrom, *initiateSwapTo, *initiateSwapAmount, secretHash, *initiateSwapTimeout, nodeId)
+
+	case participateSwapCmd.Parsed():
+		secretHash, err := hex.DecodeString(*participateSwapHash)
+		if len(*participateSwapFrom) == 0 || len(*participateSwapTo) == 0 || *participateSwapAmount <= 0 ||
+			*participateSwapTimeout <= 0 || err != nil || len(secretHash) != sha256.Size {
+			participateSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createSwapContract(*participateSwapFrom, *participateSwapTo, *participateSwapAmount, secretHash, *participateSwapTimeout, nodeId)
+
+	case redeemSwapCmd.Parsed():
+		secret, err := hex.DecodeString(*redeemSwapSecret)
+		if len(*redeemSwapAddr) == 0 || len(*redeemSwapContract) == 0 || err != nil || len(secret) != secretSize {
+			redeemSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendSwapContract(*redeemSwapAddr, *redeemSwapContract, secret, nodeId)
+
+	case refundSwapCmd.Parsed():
+		if len(*refundSwapAddr) == 0 || len(*refundSwapContract) == 0 {
+			refundSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spendSwapContract(*refundSwapAddr, *refundSwapContract, nil, nodeId)
+
+	case auditSwapCmd.Parsed():
+		if len(*auditSwapContract) == 0 {
+			auditSwapCmd.Usage()
+			os.Exit(1)
+		}
+		cli.auditSwap(*auditSwapContract, nodeId)
+
+	case notarizeCmd.Parsed():
+		if len(*notarizeFile) == 0 || len(*notarizeAddr) == 0 {
+			notarizeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.notarize(*notarizeFile, *notarizeAddr, nodeId)
+
+	case verifyNotarizationCmd.Parsed():
+		if len(*verifyNotarizationFile) == 0 || len(*verifyNotarizationTxID) == 0 {
+			verifyNotarizationCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyNotarization(*verifyNotarizationFile, *verifyNotarizationTxID, nodeId)
+
+	case getTxProofCmd.Parsed():
+		if len(*getTxProofID) == 0 {
+			getTxProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getTxProof(*getTxProofID, nodeId)
+
+	case verifyTxProofCmd.Parsed():
+		if len(*verifyTxProofData) == 0 {
+			verifyTxProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyTxProof(*verifyTxProofData, nodeId)
+
+	case startLightNodeCmd.Parsed():
+		var addresses []string
+		if len(*startLightNodeAddr) > 0 {
+			addresses = strings.Split(*startLightNodeAddr, ",")
+		}
+		cli.startLightNode(addresses, *startLightNodeCFilters, nodeId)
+
+	case getLightBalanceCmd.Parsed():
+		cli.getLightBalance(nodeId)
 	}
 }
 
-func (cli *CLI) mine(addr string) {
-	bc := NewBlockChain(addr)
-	defer bc.db.Close()
+func (cli *CLI) mine(addr, nodeId string) {
+	bc := NewBlockChain(addr, nodeId)
+	defer bc.Close()
 	bc.Mining(nil, addr)
 }
 
-func (cli *CLI) createWallet() {
-	wallet := NewWallet()
+func (cli *CLI) createWallet(scheme SigScheme) {
+	wallet := NewWalletWithScheme(scheme)
 	address := wallet.GetAddress()
 
 	addrStr := hex.EncodeToString(address)
@@ -107,40 +448,504 @@ func (cli *CLI) createWallet() {
 	fmt.Printf("your address is %s\n", addrStr)
 }
 
-func (cli *CLI) createBlockChain(addr string) {
-	bc := NewBlockChain(addr)
-	defer bc.db.Close()
+func (cli *CLI) createBlockChain(addr, nodeId string) {
+	bc := NewBlockChain(addr, nodeId)
+	defer bc.Close()
 }
 
-func (cli *CLI) printChain(addr string) {
+// from 和 to 为 -1 时表示 tip
+func (cli *CLI) printChain(addr, nodeId string, from, to int64) {
+
+	bc := NewBlockChain(addr, nodeId)
+	defer bc.Close()
 
-	bc := NewBlockChain(addr)
-	defer bc.db.Close()
+	bestHeight := bc.GetBestHeight()
+	if from < 0 || from > bestHeight {
+		from = bestHeight
+	}
+	if to < 0 || to > bestHeight {
+		to = bestHeight
+	}
 
-	iterator := bc.Iterator()
+	iterator := bc.RangeIterator(from, to)
 	for iterator.HasNext() {
-		block := iterator.Next()
+		block, err := iterator.Next()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
 		fmt.Println(block)
 	}
 }
 
-func (cli *CLI) getBalance(addr string) {
-	bc := NewBlockChain(addr)
-	defer bc.db.Close()
+func (cli *CLI) getBalance(addr, nodeId string) {
+	bc := NewBlockChain(addr, nodeId)
+	defer bc.Close()
 
 	balance := bc.GetBalance(addr)
 
 	fmt.Printf("Balance of '%s': %d\n", addr, balance)
 }
 
-func (cli *CLI) send(from, to string, amount int) {
-	bc := NewBlockChain(from)
-	defer bc.db.Close()
-	wallet, _ := ReadWalletFromFile(from)
-	tx := bc.NewUTXOTransaction(wallet, to, amount)
+// lockTime 和 afterBlocks 大于 0 时, 转给 to 的 output 带时间锁
+func (cli *CLI) send(from, to string, amount int, lockTime, afterBlocks int64, nodeId string) {
+	wallet, err := ReadWalletFromFile(from)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	bc := NewBlockChain(from, nodeId)
+	defer bc.Close()
+
+	var tx *Transaction
+	switch {
+	case lockTime > 0:
+		tx = bc.NewTimeLockedTransaction(wallet, to, amount, lockTime, false)
+	case afterBlocks > 0:
+		tx = bc.NewTimeLockedTransaction(wallet, to, amount, int64(SequenceForBlocks(afterBlocks)), true)
+	default:
+		tx = bc.NewUTXOTransaction(wallet, to, amount)
+	}
 
 	fmt.Println(tx.IsCoinbase())
 
 	bc.Mining([]*Transaction{tx}, from)
 	fmt.Println("Success!")
 }
+
+func (cli *CLI) getTransaction(txid, nodeId string) {
+	txID, err := hex.DecodeString(txid)
+	if err != nil {
+		fmt.Printf("Invalid txid '%s'\n", txid)
+		os.Exit(1)
+	}
+
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	tx, confirmations, err := bc.GetTransaction(txID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if tx == nil {
+		fmt.Printf("Transaction %s not found\n", txid)
+		return
+	}
+
+	fmt.Println(tx)
+	fmt.Printf("Confirmations: %d\n", confirmations)
+}
+
+func (cli *CLI) getBlock(height int64, nodeId string) {
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	block := bc.GetBlockByHeight(height)
+	if block == nil {
+		fmt.Printf("No block at height %d, best height is %d\n", height, bc.GetBestHeight())
+		return
+	}
+
+	fmt.Println(block)
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+}
+
+// 列出地址参与过的所有交易, 以及每笔交易中该地址的收入和支出
+func (cli *CLI) listTransactions(addr, nodeId string) {
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	pubKeyHash := GetPubKeyHashFromAddr(addr)
+
+	history, err := bc.GetAddrHistory(addr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, entry := range history {
+		block := bc.GetBlockByHeight(entry.Height)
+		if block == nil {
+			fmt.Printf("height %d  tx %x  (block pruned)\n", entry.Height, entry.TxID)
+			continue
+		}
+
+		// 被花费的 output 从区块的回滚数据中取, 不需要再去查之前的交易
+		undo := bc.readUndo(block)
+
+		for i, tx := range block.Transactions {
+			if bytes.Compare(tx.ID, entry.TxID) != 0 {
+				continue
+			}
+
+			received := 0
+			for _, out := range tx.Vout {
+				if out.IsLockedWith(pubKeyHash) {
+					received += out.Value
+				}
+			}
+
+			sent := 0
+			for _, out := range undo.SpentOutputs[i] {
+				if out.IsLockedWith(pubKeyHash) {
+					sent += out.Value
+				}
+			}
+
+			fmt.Printf("height %d  tx %x  received %d  sent %d\n", entry.Height, entry.TxID, received, sent)
+		}
+	}
+}
+
+func (cli *CLI) startNode(addr, nodeId string, pruneMB int64) {
+	if pruneMB > 0 {
+		pruneTarget = pruneMB * 1024 * 1024
+		fmt.Printf("Pruning enabled, keeping block files under %d MB\n", pruneMB)
+	}
+
+	fmt.Printf("Starting node %s\n", nodeId)
+	StartServer(nodeId, addr)
+}
+
+func (cli *CLI) verifyChain(nodeId string, depth int64, level int) {
+	startupCheckLevel = -1 // 由这里报告错误, 不在加载时 panic
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	fmt.Printf("Verifying the last %d blocks at level %d\n", depth, level)
+
+	if err := bc.VerifyChain(depth, level); err != nil {
+		fmt.Printf("Verification failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("No problems found")
+}
+
+func (cli *CLI) dumpUTXOSet(path, nodeId string) {
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	info, err := bc.DumpUTXOSet(path)
+	if err != nil {
+		fmt.Printf("Failed to dump the UTXO set: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Dumped %d UTXOs at height %d to %s\n", info.Coins, info.Height, path)
+	fmt.Println("Add this to ChainParams.AssumeUTXO to allow loading the snapshot:")
+	fmt.Printf("  {Height: %d, BlockHash: \"%x\", Commitment: \"%x\"}\n", info.Height, info.BlockHash, info.Commitment)
+}
+
+func (cli *CLI) loadUTXOSnapshot(path, nodeId string) {
+	bc, err := LoadUTXOSnapshot(openDbFile(nodeId), openBlockFiles(nodeId), path)
+	if err != nil {
+		fmt.Printf("Failed to load the UTXO snapshot: %s\n", err)
+		os.Exit(1)
+	}
+	defer bc.Close()
+
+	fmt.Printf("Loaded the UTXO snapshot at height %d, older blocks will be downloaded and validated after startNode\n", bc.GetBestHeight())
+}
+
+// 每个 key 可以是本地钱包的地址 (使用钱包的公钥), 也可以是 16 进制的公钥, 公钥的顺序就是签名的顺序
+func (cli *CLI) createMultisig(m int, keys []string) {
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if wallet, err := ReadWalletFromFile(key); err == nil {
+			pubKeys = append(pubKeys, wallet.PublicKey)
+			continue
+		}
+
+		pubKey, err := hex.DecodeString(key)
+		if err != nil || len(pubKey) == 0 {
+			fmt.Printf("'%s' is neither a wallet address nor a public key\n", key)
+			os.Exit(1)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	if m > len(pubKeys) || len(pubKeys) > maxMultisigKeys {
+		fmt.Printf("Invalid multisig %d of %d\n", m, len(pubKeys))
+		os.Exit(1)
+	}
+
+	redeemScript := NewMultisigScript(m, pubKeys)
+	if err := checkRedeemScriptSize(redeemScript); err != nil {
+		fmt.Printf("Too many keys: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Address:       %x\n", NewP2SHAddress(redeemScript))
+	fmt.Printf("Redeem script: %x\n", redeemScript)
+	fmt.Printf("               %s\n", DisasmScript(redeemScript))
+}
+
+func (cli *CLI) createMultisigTx(redeemScriptHex, to string, amount int, nodeId string) {
+	redeemScript, err := hex.DecodeString(redeemScriptHex)
+	if err != nil {
+		fmt.Println("Invalid redeem script")
+		os.Exit(1)
+	}
+
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	tx := bc.NewMultisigTransaction(redeemScript, to, amount)
+	fmt.Println(hex.EncodeToString(tx.Serialize()))
+}
+
+// 用 addr 的钱包给交易签名, 打印签名之后的交易, 交给下一个签名人或者用 sendTx 发送
+func (cli *CLI) signTx(txHex, addr, nodeId string) {
+	tx := decodeTxHex(txHex)
+
+	wallet, err := ReadWalletFromFile(addr)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	bc.SignTx(tx, wallet.PrivateKey)
+
+	prevTxs := bc.getPrevTxs(tx)
+	for inIdx, in := range tx.Vin {
+		prevOut := prevTxs[hex.EncodeToString(in.Txid)].Vout[in.Vout]
+		if signed, required := tx.MultisigStatus(inIdx, &prevOut); required > 0 {
+			fmt.Printf("Input %d: %d of %d signatures\n", inIdx, signed, required)
+		}
+	}
+
+	fmt.Println(hex.EncodeToString(tx.Serialize()))
+}
+
+func (cli *CLI) sendTx(txHex, miner, nodeId string) {
+	tx := decodeTxHex(txHex)
+
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	bc.Mining([]*Transaction{tx}, miner)
+	fmt.Println("Success!")
+}
+
+// 节点验证之后放进交易池, 再转发给其他节点
+func (cli *CLI) relayTx(txHex, node string) {
+	tx := decodeTxHex(txHex)
+
+	if err := sendNetworkPacket(buildNetworkPacket(node, "tx", tx.Serialize())); err != nil {
+		os.Exit(1)
+	}
+	fmt.Printf("Transaction %x sent to %s\n", tx.ID, node)
+}
+
+func decodeTxHex(txHex string) *Transaction {
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		fmt.Println("Invalid transaction hex")
+		os.Exit(1)
+	}
+	tx, err := DeserializeTransaction(data)
+	if err != nil {
+		fmt.Println("Invalid transaction:", err)
+		os.Exit(1)
+	}
+	return tx
+}
+
+// 发起方和参与方都用这个创建合约, 区别只是 secret 是自己生成的还是从对方的合约中得到的
+// 合约的内容要发给对方, 对方用 auditSwap 检查之后再继续
+func (cli *CLI) createSwapContract(from, to string, amount int, secretHash []byte, timeout time.Duration, nodeId string) {
+	wallet, err := ReadWalletFromFile(from)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	bc := NewBlockChain(from, nodeId)
+	defer bc.Close()
+
+	lockTime := time.Now().Add(timeout).Unix()
+	tx, htlc := bc.NewHTLCTransaction(wallet, to, amount, secretHash, lockTime)
+	bc.Mining([]*Transaction{tx}, from)
+
+	fmt.Printf("Contract:         %x\n", htlc.Script())
+	fmt.Printf("Contract address: %x\n", htlc.Address())
+	fmt.Printf("Contract tx:      %x\n", tx.ID)
+	fmt.Printf("Refundable after: %s\n", time.Unix(lockTime, 0))
+}
+
+// secret 为 nil 时退款
+func (cli *CLI) spendSwapContract(addr, contractHex string, secret []byte, nodeId string) {
+	contract, err := hex.DecodeString(contractHex)
+	if err != nil {
+		fmt.Println("Invalid contract")
+		os.Exit(1)
+	}
+
+	wallet, err := ReadWalletFromFile(addr)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	bc := NewBlockChain(addr, nodeId)
+	defer bc.Close()
+
+	tx := bc.NewHTLCSpendTransaction(wallet, contract, secret)
+	bc.Mining([]*Transaction{tx}, addr)
+
+	fmt.Printf("Spent the contract in tx %x\n", tx.ID)
+}
+
+// 打印合约的内容和合约中的币, 合约已经被接收方花费时打印 secret
+func (cli *CLI) auditSwap(contractHex, nodeId string) {
+	contract, err := hex.DecodeString(contractHex)
+	htlc := ExtractHTLC(contract)
+	if err != nil || htlc == nil {
+		fmt.Println("Not a swap contract")
+		os.Exit(1)
+	}
+
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	fmt.Println(DisasmScript(contract))
+	fmt.Printf("Contract address:  %x\n", htlc.Address())
+	// 公钥 hash 中看不出签名方案, 所以不能还原出地址
+	fmt.Printf("Recipient hash:    %x\n", htlc.RecipientHash)
+	fmt.Printf("Refund hash:       %x\n", htlc.RefundHash)
+	fmt.Printf("Secret hash:       %x\n", htlc.SecretHash)
+	fmt.Printf("Refundable after:  %s\n", time.Unix(htlc.LockTime, 0))
+	fmt.Printf("Expired:           %v\n", bc.MedianTimePast(bc.GetBestHeight()) > htlc.LockTime)
+	fmt.Printf("Locked amount:     %d\n", bc.GetBalance(hex.EncodeToString(htlc.Address())))
+
+	if secret := bc.FindHTLCSecret(contract); secret != nil {
+		fmt.Printf("Secret:            %x\n", secret)
+	}
+}
+
+func (cli *CLI) notarize(path, addr, nodeId string) {
+	fileHash, err := HashFile(path)
+	if err != nil {
+		fmt.Printf("Can't read %s: %s\n", path, err)
+		os.Exit(1)
+	}
+
+	wallet, err := ReadWalletFromFile(addr)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	bc := NewBlockChain(addr, nodeId)
+	defer bc.Close()
+
+	tx := bc.NewNotarizationTransaction(wallet, fileHash)
+	bc.Mining([]*Transaction{tx}, addr)
+
+	fmt.Printf("File hash: %x\n", fileHash)
+	fmt.Printf("Txid:      %x\n", tx.ID)
+}
+
+func (cli *CLI) verifyNotarization(path, txid, nodeId string) {
+	fileHash, err := HashFile(path)
+	if err != nil {
+		fmt.Printf("Can't read %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	txID, err := hex.DecodeString(txid)
+	if err != nil {
+		fmt.Printf("Invalid txid '%s'\n", txid)
+		os.Exit(1)
+	}
+
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	proof, err := bc.GetTxProof(txID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tx, _ := bc.findTxWithBlock(txID)
+	header, err := bc.VerifyNotarization(tx, fileHash, proof)
+	if err != nil {
+		fmt.Printf("Invalid notarization: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("File %x is committed by tx %x\n", fileHash, txID)
+	fmt.Printf("Block:         %x (height %d, %d confirmations)\n", header.Hash, header.Height, bc.GetBestHeight()-header.Height+1)
+	fmt.Printf("Merkle root:   %x\n", header.TxsHash)
+	for _, step := range proof.Proof {
+		side := "right"
+		if step.Left {
+			side = "left"
+		}
+		fmt.Printf("  %-5s %x\n", side, step.Hash)
+	}
+	fmt.Printf("Existed before %s\n", time.Unix(header.Timestamp, 0))
+}
+
+func (cli *CLI) getTxProof(txid, nodeId string) {
+	txID, err := hex.DecodeString(txid)
+	if err != nil {
+		fmt.Printf("Invalid txid '%s'\n", txid)
+		os.Exit(1)
+	}
+
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	proof, err := bc.GetTxProof(txID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println(hex.EncodeToString(proof.Serialize()))
+}
+
+func (cli *CLI) verifyTxProof(proofHex, nodeId string) {
+	data, err := hex.DecodeString(proofHex)
+	if err != nil {
+		fmt.Println("Invalid proof hex")
+		os.Exit(1)
+	}
+	proof, err := DeserializeTxProof(data)
+	if err != nil {
+		fmt.Printf("Invalid proof: %s\n", err)
+		os.Exit(1)
+	}
+
+	bc := LoadBlockChain(nodeId)
+	defer bc.Close()
+
+	header, err := bc.VerifyTxProof(proof)
+	if err != nil {
+		fmt.Printf("Invalid proof: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Transaction %x is in block %x\n", proof.TxID, header.Hash)
+	fmt.Printf("Height %d, %d confirmations, block time %s\n", header.Height, bc.GetBestHeight()-header.Height+1, time.Unix(header.Timestamp, 0))
+}
+
+func (cli *CLI) startLightNode(addresses []string, useCFilters bool, nodeId string) {
+	fmt.Printf("Starting light node %s\n", nodeId)
+	StartLightNode(nodeId, addresses, useCFilters)
+}
+
+// 只用轻节点保存的区块头和交易算余额, 不需要完整的区块链
+func (cli *CLI) getLightBalance(nodeId string) {
+	lc := OpenLightChain(nodeId, nil)
+	defer lc.Close()
+
+	fmt.Printf("Synced to height %d\n", lc.BestHeight())
+	for _, addr := range lc.Addresses() {
+		fmt.Printf("Balance of '%s': %d\n", addr, lc.Balances()[addr])
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// 紧凑区块 (BIP152): 新区块只发区块头, 每笔交易 6 字节的短 ID, 以及对方肯定没有的 coinbase
+// 对方用交易池中的交易还原区块, 只需要用 getblocktxn 请求缺少的交易
+// 短 ID 用 wtxid 计算, 签名不同的交易不会被当成同一笔; 每次发送使用随机的 nonce, 别人不能故意构造冲突的交易
+
+const shortIDMask = 1<<48 - 1
+
+type compactBlock struct {
+	Header    BlockHeader
+	Nonce     uint64
+	ShortIDs  []uint64      // 没有预先填充的交易的短 ID, 按在区块中的顺序
+	Prefilled []prefilledTx // 按 Index 排序
+}
+
+type prefilledTx struct {
+	Index int    // 交易在区块中的下标
+	Tx    []byte // 序列化后的交易
+}
+
+// 请求紧凑区块中缺少的交易
+type getBlockTxn struct {
+	BlockHash []byte
+	Indexes   []int // 交易在区块中的下标, 从小到大
+}
+
+// getblocktxn 的回复
+type blockTxn struct {
+	BlockHash []byte
+	Txs       [][]byte // 和请求的 Indexes 一一对应
+}
+
+func randomNonce() uint64 {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		log.Panic(err)
+	}
+	return binary.LittleEndian.Uint64(nonce[:])
+}
+
+func shortIDKey(blockHash []byte, nonce uint64) [16]byte {
+	var key [16]byte
+	var nonceBytes [8]byte
+	binary.LittleEndian.PutUint64(nonceBytes[:], nonce)
+
+	hash := sha256.Sum256(append(append([]byte{}, blockHash...), nonceBytes[:]...))
+	copy(key[:], hash[:])
+	return key
+}
+
+func shortTxID(key [16]byte, tx *Transaction) uint64 {
+	return sipHash24(key, tx.WitnessHash()) & shortIDMask
+}
+
+// coinbase 总是预先填充
+func NewCompactBlock(b *Block, nonce uint64) *compactBlock {
+	cb := &compactBlock{Header: *b.Header(), Nonce: nonce}
+	key := shortIDKey(b.Hash, nonce)
+
+	for i, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			cb.Prefilled = append(cb.Prefilled, prefilledTx{i, tx.Serialize()})
+		} else {
+			cb.ShortIDs = append(cb.ShortIDs, shortTxID(key, tx))
+		}
+	}
+	return cb
+}
+
+// 正在还原的区块
+type partialBlock struct {
+	header  BlockHeader
+	txs     []*Transaction // 缺少的交易为 nil
+	missing []int          // 缺少的交易的下标
+}
+
+// 用预先填充的交易和交易池还原区块, 交易池中有多笔交易的短 ID 相同时当作缺少
+func newPartialBlock(cb *compactBlock, mempool []*Transaction) (*partialBlock, error) {
+	count := len(cb.ShortIDs) + len(cb.Prefilled)
+	if count == 0 || count > maxSerializedItems {
+		return nil, fmt.Errorf("bad transaction count %d", count)
+	}
+
+	pb := &partialBlock{header: cb.Header, txs: make([]*Transaction, count)}
+	filled := make([]bool, count)
+
+	last := -1
+	for _, prefilled := range cb.Prefilled {
+		if prefilled.Index <= last || prefilled.Index >= count {
+			return nil, fmt.Errorf("bad prefilled transaction index %d", prefilled.Index)
+		}
+		last = prefilled.Index
+
+		tx := &Transaction{}
+		if err := deserializeVersioned(prefilled.Tx, tx.decode); err != nil {
+			return nil, err
+		}
+		pb.txs[prefilled.Index] = tx
+		filled[prefilled.Index] = true
+	}
+
+	// 短 ID => 在区块中的下标
+	positions := make(map[uint64]int, len(cb.ShortIDs))
+	next := 0
+	for _, id := range cb.ShortIDs {
+		for filled[next] {
+			next++
+		}
+		if _, ok := positions[id]; ok {
+			return nil, errors.New("duplicate short transaction ids")
+		}
+		positions[id] = next
+		next++
+	}
+
+	key := shortIDKey(cb.Header.Hash, cb.Nonce)
+	collided := make(map[uint64]bool)
+	for _, tx := range mempool {
+		id := shortTxID(key, tx)
+		index, ok := positions[id]
+		if !ok || collided[id] {
+			continue
+		}
+		if pb.txs[index] != nil {
+			pb.txs[index] = nil
+			collided[id] = true
+			continue
+		}
+		pb.txs[index] = tx
+	}
+
+	for i, tx := range pb.txs {
+		if tx == nil {
+			pb.missing = append(pb.missing, i)
+		}
+	}
+	return pb, nil
+}
+
+// 填上 getblocktxn 请求回来的交易
+func (pb *partialBlock) fill(txn *blockTxn) error {
+	if len(txn.Txs) != len(pb.missing) {
+		return fmt.Errorf("expected %d transactions, got %d", len(pb.missing), len(txn.Txs))
+	}
+
+	for i, data := range txn.Txs {
+		tx := &Transaction{}
+		if err := deserializeVersioned(data, tx.decode); err != nil {
+			return err
+		}
+		pb.txs[pb.missing[i]] = tx
+	}
+	pb.missing = nil
+	return nil
+}
+
+// 所有交易都齐了之后得到区块, 短 ID 冲突时交易会不对, 这时返回错误, 需要请求完整的区块
+func (pb *partialBlock) block() (*Block, error) {
+	if len(pb.missing) > 0 {
+		return nil, fmt.Errorf("%d transactions are missing", len(pb.missing))
+	}
+
+	h := pb.header
+	block := &Block{h.Timestamp, pb.txs, h.PrevBlockHash, h.Hash, h.Nonce, h.Height}
+
+	tree := block.MerkleTree()
+	if !bytes.Equal(tree.Root.Data, h.TxsHash) || tree.Mutated || !block.CheckWitnessCommitment() {
+		return nil, fmt.Errorf("the transactions don't match block %x", h.Hash)
+	}
+	return block, nil
+}
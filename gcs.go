@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// Golomb-coded set (BIP158): 把每个元素 hash 到 [0, N*M) 中, 排序之后只保存相邻元素的差, 差用 Golomb-Rice 编码 (商用一元编码, 余数用 P 位)
+// 比 bloom filter 小, 误判率约为 1/M, 只能一次性构建, 不能再添加元素
+const (
+	gcsP = 19
+	gcsM = 784931
+)
+
+type GCSFilter struct {
+	N    uint64 // 元素个数
+	Data []byte // Golomb-Rice 编码后的数据
+}
+
+// key 是 SipHash 的 key, 不同区块的 filter 用不同的 key, 同样的数据在不同的 filter 中位置不同
+func NewGCSFilter(key [16]byte, items [][]byte) *GCSFilter {
+	// 重复的元素只保留一个
+	unique := make(map[string]bool)
+	for _, item := range items {
+		unique[string(item)] = true
+	}
+
+	n := uint64(len(unique))
+	values := make([]uint64, 0, n)
+	for item := range unique {
+		values = append(values, gcsHash(key, []byte(item), n))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	w := &bitWriter{}
+	last := uint64(0)
+	for _, v := range values {
+		delta := v - last
+		last = v
+
+		for q := delta >> gcsP; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta&(1<<gcsP-1), gcsP)
+	}
+
+	return &GCSFilter{n, w.data}
+}
+
+// 格式: uvarint N | bytes Data
+func (f *GCSFilter) Serialize() []byte {
+	e := &encoder{}
+	e.writeUvarint(f.N)
+	e.writeBytes(f.Data)
+	return e.Bytes()
+}
+
+func DeserializeGCSFilter(data []byte) (*GCSFilter, error) {
+	d := &decoder{data: data}
+	f := &GCSFilter{d.readUvarint(), d.readBytes()}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	// 每个元素至少占 P+1 位
+	if f.N > uint64(len(f.Data))*8/(gcsP+1) {
+		return nil, errors.New("gcs: too many elements for the data")
+	}
+	return f, nil
+}
+
+// 把元素均匀地映射到 [0, n*M)
+func gcsHash(key [16]byte, item []byte, n uint64) uint64 {
+	hi, _ := bits.Mul64(sipHash24(key, item), n*gcsM)
+	return hi
+}
+
+// items 中是否有元素在集合中, 有误判, 没有漏判
+func (f *GCSFilter) MatchAny(key [16]byte, items [][]byte) bool {
+	if f.N == 0 || len(items) == 0 {
+		return false
+	}
+
+	targets := make([]uint64, len(items))
+	for i, item := range items {
+		targets[i] = gcsHash(key, item, f.N)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+
+	r := &bitReader{data: f.Data}
+	value := uint64(0)
+	for i := uint64(0); i < f.N; i++ {
+		q := uint64(0)
+		for {
+			bit, ok := r.readBit()
+			if !ok {
+				return false
+			}
+			if bit == 0 {
+				break
+			}
+			q++
+		}
+		rem, ok := r.readBits(gcsP)
+		if !ok {
+			return false
+		}
+		value += q<<gcsP | rem
+
+		// 两个有序的列表归并比较
+		for len(targets) > 0 && targets[0] < value {
+			targets = targets[1:]
+		}
+		if len(targets) == 0 {
+			return false
+		}
+		if targets[0] == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *GCSFilter) Match(key [16]byte, item []byte) bool {
+	return f.MatchAny(key, [][]byte{item})
+}
+
+// 按位写, 高位在前
+type bitWriter struct {
+	data  []byte
+	nbits uint
+}
+
+func (w *bitWriter) writeBit(bit byte) {
+	if w.nbits%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	if bit != 0 {
+		w.data[len(w.data)-1] |= 1 << (7 - w.nbits%8)
+	}
+	w.nbits++
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for i := n; i > 0; i-- {
+		w.writeBit(byte(v >> (i - 1) & 1))
+	}
+}
+
+type bitReader struct {
+	data []byte
+	pos  uint
+}
+
+func (r *bitReader) readBit() (byte, bool) {
+	if r.pos >= uint(len(r.data))*8 {
+		return 0, false
+	}
+	bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return bit, true
+}
+
+func (r *bitReader) readBits(n uint) (uint64, bool) {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		v = v<<1 | uint64(bit)
+	}
+	return v, true
+}
+
+// SipHash-2-4
+func sipHash24(key [16]byte, data []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	blocks := len(data) / 8
+	for i := 0; i < blocks; i++ {
+		m := binary.LittleEndian.Uint64(data[i*8:])
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	var last [8]byte
+	copy(last[:], data[blocks*8:])
+	last[7] = byte(len(data))
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
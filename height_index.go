@@ -0,0 +1,93 @@
+package main
+
+import "log"
+
+const heightIndexBucket = "heightIndex"
+
+// 主链上 区块高度 => 区块 hash, key 使用大端序的高度, 这样 cursor 遍历时就是按高度排序的
+type HeightIndex struct {
+	bc *BlockChain
+}
+
+func NewHeightIndex(bc *BlockChain) *HeightIndex {
+	return &HeightIndex{bc}
+}
+
+// 索引不存在时从 tip 往前构建
+func (index *HeightIndex) Init() error {
+	var exists bool
+	index.bc.db.View(func(tx StorageTx) error {
+		exists = tx.Bucket([]byte(heightIndexBucket)) != nil
+		return nil
+	})
+
+	if !exists {
+		return index.Reindex()
+	}
+	return nil
+}
+
+// 只需要区块头, 被裁剪的链也能重建
+func (index *HeightIndex) Reindex() error {
+	bucketName := []byte(heightIndexBucket)
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		tx.DeleteBucket(bucketName)
+		_, err := tx.CreateBucket(bucketName)
+		return err
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	it := index.bc.Iterator()
+	for it.HasNext() {
+		header, err := it.NextHeader()
+		if err != nil {
+			return err
+		}
+		index.put(header.Height, header.Hash)
+	}
+	return nil
+}
+
+func (index *HeightIndex) ConnectBlock(b *Block) {
+	index.put(b.Height, b.Hash)
+}
+
+func (index *HeightIndex) put(height int64, hash []byte) {
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		bucket := tx.Bucket([]byte(heightIndexBucket))
+		return bucket.Put(IntToHex(height), hash)
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (index *HeightIndex) DisconnectBlock(b *Block) {
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		bucket := tx.Bucket([]byte(heightIndexBucket))
+		return bucket.Delete(IntToHex(b.Height))
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 返回主链上对应高度的区块 hash, 超出范围时返回 nil
+func (index *HeightIndex) GetHash(height int64) []byte {
+	var hash []byte
+
+	index.bc.db.View(func(tx StorageTx) error {
+		value := tx.Bucket([]byte(heightIndexBucket)).Get(IntToHex(height))
+		if value != nil {
+			hash = append([]byte{}, value...) // 返回的 value 只在事务内有效
+		}
+		return nil
+	})
+
+	return hash
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// 轻节点使用 compact filter (见 block_filter.go) 代替 bloom filter: 不把关注的地址发给全节点,
+// 而是下载每个区块的 filter 在本地检查, 匹配时下载整个区块
+const (
+	lightCFHeadersBucket = "lightCFHeaders" // 区块 hash => filter header
+	lightCFiltersBucket  = "lightCFilters"  // 区块 hash => filter, 收到新的 output 之后重新检查后面的区块时要用
+)
+
+func (lc *LightChain) initCFilterBuckets(tx StorageTx) error {
+	for _, name := range []string{lightCFHeadersBucket, lightCFiltersBucket} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 主链上从第一个满足 missing 的区块开始, 连续满足 missing 的最多 max 个区块, 返回起始高度和最后一个区块的 hash
+func (lc *LightChain) findRange(max int64, missing func(tx StorageTx, hash []byte) bool) (int64, []byte) {
+	start, stop := int64(-1), []byte(nil)
+
+	lc.db.View(func(tx StorageTx) error {
+		cursor := tx.Bucket([]byte(lightHeightsBucket)).Cursor()
+		for key, hash := cursor.First(); key != nil; key, hash = cursor.Next() {
+			if !missing(tx, hash) {
+				if start >= 0 {
+					return nil
+				}
+				continue
+			}
+
+			if start < 0 {
+				start = HexToInt(key)
+			}
+			stop = append([]byte{}, hash...)
+			if HexToInt(key)-start+1 >= max {
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return start, stop
+}
+
+// 需要请求 cfheaders 的区块范围, 没有时 stop 为 nil
+func (lc *LightChain) MissingFilterHeaders() (int64, []byte) {
+	return lc.findRange(maxCFHeadersPerMsg, func(tx StorageTx, hash []byte) bool {
+		return tx.Bucket([]byte(lightCFHeadersBucket)).Get(hash) == nil
+	})
+}
+
+// 已经有 filter header, 但是还没有 filter 的区块范围, 没有时 stop 为 nil
+func (lc *LightChain) MissingFilters() (int64, []byte) {
+	return lc.findRange(maxCFiltersPerMsg, func(tx StorageTx, hash []byte) bool {
+		return tx.Bucket([]byte(lightCFHeadersBucket)).Get(hash) != nil &&
+			tx.Bucket([]byte(lightCFiltersBucket)).Get(hash) == nil &&
+			tx.Bucket([]byte(lightFilteredBucket)).Get(hash) == nil
+	})
+}
+
+// filter 匹配了, 但是还没有收到区块的 hash
+func (lc *LightChain) BlocksToFetch() [][]byte {
+	var hashes [][]byte
+
+	lc.db.View(func(tx StorageTx) error {
+		filters := tx.Bucket([]byte(lightCFiltersBucket))
+		filtered := tx.Bucket([]byte(lightFilteredBucket))
+		cursor := tx.Bucket([]byte(lightHeightsBucket)).Cursor()
+		for key, hash := cursor.First(); key != nil; key, hash = cursor.Next() {
+			if filters.Get(hash) != nil && filtered.Get(hash) == nil {
+				hashes = append(hashes, append([]byte{}, hash...))
+			}
+		}
+		return nil
+	})
+
+	return hashes
+}
+
+// 前一个区块的 filter header, header 是创世区块时为全 0, 没有时返回 nil
+func getPrevFilterHeader(tx StorageTx, header *BlockHeader) []byte {
+	if header.Height == 0 {
+		return make([]byte, sha256.Size)
+	}
+	return tx.Bucket([]byte(lightCFHeadersBucket)).Get(header.PrevBlockHash)
+}
+
+// 用 cfheaders 算出每个区块的 filter header 并保存, 必须接在已有的 filter header 后面
+// 已有的 filter header 不一致说明有全节点在说谎, 返回错误
+func (lc *LightChain) AddFilterHeaders(msg *cfHeaders) error {
+	stop := lc.GetHeader(msg.StopHash)
+	if stop == nil {
+		return fmt.Errorf("unknown block %x", msg.StopHash)
+	}
+	start := stop.Height - int64(len(msg.FilterHashes)) + 1
+	if len(msg.FilterHashes) == 0 || start < 0 {
+		return errors.New("bad number of filter hashes")
+	}
+
+	return lc.db.Update(func(tx StorageTx) error {
+		heights := tx.Bucket([]byte(lightHeightsBucket))
+		cfHeaders := tx.Bucket([]byte(lightCFHeadersBucket))
+		if !bytes.Equal(heights.Get(IntToHex(stop.Height)), msg.StopHash) {
+			return fmt.Errorf("block %x is not on the main chain", msg.StopHash)
+		}
+
+		first := getLightHeader(tx, heights.Get(IntToHex(start)))
+		if prev := getPrevFilterHeader(tx, first); !bytes.Equal(prev, msg.PrevFilterHeader) {
+			return fmt.Errorf("the previous filter header %x doesn't match %x", msg.PrevFilterHeader, prev)
+		}
+
+		header := msg.PrevFilterHeader
+		for i, hash := range msg.FilterHashes {
+			blockHash := heights.Get(IntToHex(start + int64(i)))
+			header = filterHeader(hash, header)
+
+			if existing := cfHeaders.Get(blockHash); existing != nil && !bytes.Equal(existing, header) {
+				return fmt.Errorf("conflicting filter header for block %x", blockHash)
+			}
+			if err := cfHeaders.Put(blockHash, header); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 关注的数据: 地址的 PubKeyHash 和还没有花费的 output
+func (lc *LightChain) watchedElements() [][]byte {
+	var elements [][]byte
+	for _, addr := range lc.addresses {
+		_, hash := decodeAddress(addr)
+		elements = append(elements, hash)
+	}
+	for _, utxo := range lc.UnspentOutputs() {
+		elements = append(elements, outpointKey(utxo.TxID, utxo.OutIdx))
+	}
+	return elements
+}
+
+// 检查 filter 和 filter header 一致之后保存, 返回是否需要下载区块
+// 不匹配时区块直接标记为已经过滤
+func (lc *LightChain) AddBlockFilter(f *cFilter) (bool, error) {
+	// 和 AddBlock 互斥, 否则可能用 AddBlock 之前的 output 检查, 又没有被 AddBlock 重新检查
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	header := lc.GetHeader(f.BlockHash)
+	if header == nil {
+		return false, fmt.Errorf("unknown block %x", f.BlockHash)
+	}
+
+	filter, err := DeserializeGCSFilter(f.Filter)
+	if err != nil {
+		return false, err
+	}
+	matched := filter.MatchAny(blockFilterKey(f.BlockHash), lc.watchedElements())
+
+	err = lc.db.Update(func(tx StorageTx) error {
+		expected := tx.Bucket([]byte(lightCFHeadersBucket)).Get(f.BlockHash)
+		prev := getPrevFilterHeader(tx, header)
+		if expected == nil || prev == nil || !bytes.Equal(filterHeader(filterHash(f.Filter), prev), expected) {
+			return fmt.Errorf("the filter of block %x doesn't match its filter header", f.BlockHash)
+		}
+
+		if err := tx.Bucket([]byte(lightCFiltersBucket)).Put(f.BlockHash, f.Filter); err != nil {
+			return err
+		}
+		if matched {
+			return nil
+		}
+		return tx.Bucket([]byte(lightFilteredBucket)).Put(f.BlockHash, []byte{})
+	})
+
+	return matched, err
+}
+
+// 保存区块中和关注的地址有关的交易, 返回交易的数量, 以及因为有了新的 output 需要重新下载的区块
+// 区块是按 filter 匹配下载的, 后面的区块可能在这个区块之前已经检查过了, 当时还不知道这个区块中的 output
+func (lc *LightChain) AddBlock(block *Block) (int, [][]byte, error) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	header := lc.GetHeader(block.Hash)
+	if header == nil {
+		return 0, nil, fmt.Errorf("unknown block %x", block.Hash)
+	}
+	if tree := block.MerkleTree(); !bytes.Equal(tree.Root.Data, header.TxsHash) || tree.Mutated {
+		return 0, nil, fmt.Errorf("block %x doesn't match its header", block.Hash)
+	}
+
+	watched := make(map[string]bool)
+	for _, element := range lc.watchedElements() {
+		watched[string(element)] = true
+	}
+
+	var relevant []*Transaction
+	var newOutpoints [][]byte
+	for _, tx := range block.Transactions {
+		isRelevant := false
+		for _, in := range tx.Vin {
+			isRelevant = isRelevant || (!tx.IsCoinbase() && watched[string(outpointKey(in.Txid, in.Vout))])
+		}
+		for outIdx, out := range tx.Vout {
+			if hash := out.AddressHash(); hash != nil && watched[string(hash)] {
+				isRelevant = true
+				key := outpointKey(tx.ID, outIdx)
+				watched[string(key)] = true
+				newOutpoints = append(newOutpoints, key)
+			}
+		}
+
+		if isRelevant {
+			relevant = append(relevant, tx)
+		}
+	}
+
+	var refetch [][]byte
+	err := lc.db.Update(func(tx StorageTx) error {
+		txs := tx.Bucket([]byte(lightTxsBucket))
+		for _, t := range relevant {
+			if err := txs.Put(t.ID, GobEncode(&lightTx{t.Serialize(), block.Hash})); err != nil {
+				return err
+			}
+		}
+
+		filtered := tx.Bucket([]byte(lightFilteredBucket))
+		if err := filtered.Put(block.Hash, []byte{}); err != nil {
+			return err
+		}
+		if len(newOutpoints) == 0 {
+			return nil
+		}
+
+		// 后面已经检查过的区块中可能有花费这些 output 的交易
+		filters := tx.Bucket([]byte(lightCFiltersBucket))
+		cursor := tx.Bucket([]byte(lightHeightsBucket)).Cursor()
+		for key, hash := cursor.Seek(IntToHex(header.Height + 1)); key != nil; key, hash = cursor.Next() {
+			data := filters.Get(hash)
+			if data == nil || filtered.Get(hash) == nil {
+				continue
+			}
+
+			filter, err := DeserializeGCSFilter(data)
+			if err != nil {
+				log.Panic(err)
+			}
+			if filter.MatchAny(blockFilterKey(hash), newOutpoints) {
+				refetch = append(refetch, append([]byte{}, hash...))
+				if err := filtered.Delete(hash); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return len(relevant), refetch, nil
+}
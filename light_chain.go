@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// 轻节点 (SPV): 只下载区块头, 校验工作量证明和前后区块的连接, 不下载完整的区块
+// 轻节点把关注的地址放在 bloom filter 中发给全节点, 全节点只发来匹配的交易和它们在区块中的 Merkle 证明,
+// 轻节点用自己保存的区块头验证证明, 自己算出地址的余额
+// 证明只能说明交易确实在区块中, 不能说明全节点没有漏发交易, 所以轻节点最好连接多个全节点
+
+const (
+	originLightDbFile = "light_%s.db"
+
+	lightHeadersBucket  = "lightHeaders"  // 区块 hash => 区块头, 包括不在主链上的
+	lightHeightsBucket  = "lightHeights"  // 主链上 高度 => 区块 hash
+	lightTxsBucket      = "lightTxs"      // 交易 ID => lightTx
+	lightFilteredBucket = "lightFiltered" // 已经收到过 merkleBlock 的区块 hash => nil
+
+	maxHeadersPerMsg       = 2000
+	bloomFalsePositiveRate = 0.0001
+)
+
+var (
+	errOrphanHeader = errors.New("the header doesn't connect to any known header")
+	watchKey        = []byte("watch") // metaBucket 中关注的地址
+)
+
+type LightChain struct {
+	db        Storage
+	tip       []byte   // 最长的区块头链的最后一个 hash, 还没有区块头时为 nil
+	addresses []string // 关注的地址
+	lock      sync.Mutex
+}
+
+// 和关注的地址有关的交易以及它所在的区块
+type lightTx struct {
+	Transaction []byte
+	BlockHash   []byte
+}
+
+// 关注的地址的一个 output
+type lightUTXO struct {
+	TxID   []byte
+	OutIdx int
+	Output TXOutput
+	Height int64
+}
+
+func OpenLightChain(nodeId string, addresses []string) *LightChain {
+	db, err := OpenBoltStorage(fmt.Sprintf(originLightDbFile, nodeId))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return NewLightChainWithStorage(db, addresses)
+}
+
+// addresses 和之前保存的地址合并, 有新的地址时需要重新过滤所有区块
+func NewLightChainWithStorage(db Storage, addresses []string) *LightChain {
+	lc := &LightChain{db: db}
+
+	err := db.Update(func(tx StorageTx) error {
+		for _, name := range []string{lightHeadersBucket, lightHeightsBucket, lightTxsBucket, lightFilteredBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		if err := lc.initCFilterBuckets(tx); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		lc.tip = append([]byte{}, meta.Get(tipKey)...)
+		if len(lc.tip) == 0 {
+			lc.tip = nil
+		}
+		if data := meta.Get(watchKey); data != nil {
+			GobDecode(data, &lc.addresses)
+		}
+
+		added := false
+		for _, addr := range addresses {
+			decodeAddress(addr) // 检查地址是否有效
+			if !containsString(lc.addresses, addr) {
+				lc.addresses = append(lc.addresses, addr)
+				added = true
+			}
+		}
+		if !added {
+			return nil
+		}
+
+		// 保存的 compact filter 也要重新下载, 用新的地址检查
+		for _, name := range []string{lightFilteredBucket, lightCFiltersBucket} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return meta.Put(watchKey, GobEncode(lc.addresses))
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return lc
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (lc *LightChain) Close() {
+	lc.db.Close()
+}
+
+func (lc *LightChain) Addresses() []string {
+	return lc.addresses
+}
+
+func getLightHeader(tx StorageTx, hash []byte) *BlockHeader {
+	data := tx.Bucket([]byte(lightHeadersBucket)).Get(hash)
+	if data == nil {
+		return nil
+	}
+
+	header := &BlockHeader{}
+	GobDecode(data, header)
+	return header
+}
+
+// 区块头不存在时返回 nil
+func (lc *LightChain) GetHeader(hash []byte) *BlockHeader {
+	var header *BlockHeader
+	lc.db.View(func(tx StorageTx) error {
+		header = getLightHeader(tx, hash)
+		return nil
+	})
+	return header
+}
+
+// 还没有区块头时返回 -1
+func (lc *LightChain) BestHeight() int64 {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	if lc.tip == nil {
+		return -1
+	}
+	return lc.GetHeader(lc.tip).Height
+}
+
+// 主链上的区块 hash, 最近的 10 个区块之后间隔加倍, 最后是创世区块
+// 全节点从中找到第一个在它的主链上的区块, 从那里开始发送区块头, 这样分叉之后也能找到共同的祖先
+func (lc *LightChain) BlockLocator() [][]byte {
+	var locator [][]byte
+
+	lc.db.View(func(tx StorageTx) error {
+		heights := tx.Bucket([]byte(lightHeightsBucket))
+		key, _ := heights.Cursor().Last()
+		if key == nil {
+			return nil
+		}
+
+		step := int64(1)
+		for height := HexToInt(key); ; height -= step {
+			if height <= 0 {
+				locator = append(locator, append([]byte{}, heights.Get(IntToHex(0))...))
+				return nil
+			}
+
+			locator = append(locator, append([]byte{}, heights.Get(IntToHex(height))...))
+			if len(locator) >= 10 {
+				step *= 2
+			}
+		}
+	})
+
+	return locator
+}
+
+// 校验并保存区块头, 返回新加到主链上的区块 hash (切换分支时包括新分支上的所有区块), 按高度排序
+// 区块头必须按顺序发来, 前一个区块头不存在时返回 errOrphanHeader
+func (lc *LightChain) AddHeaders(headers []BlockHeader) ([][]byte, error) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	var connected [][]byte
+
+	for i := range headers {
+		header := &headers[i]
+		if lc.GetHeader(header.Hash) != nil {
+			continue
+		}
+
+		if !ValidateHeader(header) {
+			return connected, fmt.Errorf("header %x has an invalid proof of work", header.Hash)
+		}
+
+		err := lc.db.Update(func(tx StorageTx) error {
+			if header.Height == 0 {
+				if lc.tip != nil || len(header.PrevBlockHash) != 0 {
+					return fmt.Errorf("unexpected genesis header %x", header.Hash)
+				}
+			} else if prev := getLightHeader(tx, header.PrevBlockHash); prev == nil || prev.Height+1 != header.Height {
+				return errOrphanHeader
+			}
+
+			if err := tx.Bucket([]byte(lightHeadersBucket)).Put(header.Hash, GobEncode(header)); err != nil {
+				return err
+			}
+			if lc.tip != nil && getLightHeader(tx, lc.tip).Height >= header.Height {
+				return nil
+			}
+
+			// 新的最长链, 从新的 tip 往前更新高度索引, 直到和原来的主链重合
+			heights := tx.Bucket([]byte(lightHeightsBucket))
+			var branch [][]byte
+			for h := header; !bytes.Equal(heights.Get(IntToHex(h.Height)), h.Hash); {
+				branch = append([][]byte{h.Hash}, branch...)
+				if err := heights.Put(IntToHex(h.Height), h.Hash); err != nil {
+					return err
+				}
+				if h.Height == 0 {
+					break
+				}
+				h = getLightHeader(tx, h.PrevBlockHash)
+			}
+
+			connected = append(connected, branch...)
+			lc.tip = header.Hash
+			return tx.Bucket(metaBucket).Put(tipKey, header.Hash)
+		})
+
+		if err != nil {
+			return connected, err
+		}
+	}
+
+	return connected, nil
+}
+
+// 主链上还没有收到过 merkleBlock 的区块, 按高度排序
+func (lc *LightChain) UnfilteredBlocks() [][]byte {
+	var hashes [][]byte
+
+	lc.db.View(func(tx StorageTx) error {
+		filtered := tx.Bucket([]byte(lightFilteredBucket))
+		cursor := tx.Bucket([]byte(lightHeightsBucket)).Cursor()
+		for key, hash := cursor.First(); key != nil; key, hash = cursor.Next() {
+			if filtered.Get(hash) == nil {
+				hashes = append(hashes, append([]byte{}, hash...))
+			}
+		}
+		return nil
+	})
+
+	return hashes
+}
+
+// 用区块头验证 merkleBlock 中每笔交易的证明, 保存交易, 返回交易的数量
+// 有误判的交易也会保存下来, 计算余额时只看和关注的地址有关的 output
+func (lc *LightChain) AddMerkleBlock(mb *merkleBlock) (int, error) {
+	header := lc.GetHeader(mb.BlockHash)
+	if header == nil {
+		return 0, fmt.Errorf("unknown block %x", mb.BlockHash)
+	}
+	if len(mb.Txs) != len(mb.Proofs) {
+		return 0, fmt.Errorf("block %x has %d transactions but %d proofs", mb.BlockHash, len(mb.Txs), len(mb.Proofs))
+	}
+
+	var txIDs [][]byte
+	for i := range mb.Txs {
+		tx, err := DeserializeTransaction(mb.Txs[i])
+		if err != nil {
+			return 0, err
+		}
+
+		proof, err := DeserializeTxProof(mb.Proofs[i])
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(proof.TxID, tx.ID) || !bytes.Equal(proof.BlockHash, mb.BlockHash) {
+			return 0, fmt.Errorf("the proof of transaction %x is for another transaction", tx.ID)
+		}
+		if !VerifyMerkleProof(header.TxsHash, tx.ID, proof.Proof) {
+			return 0, fmt.Errorf("transaction %x is not in block %x", tx.ID, mb.BlockHash)
+		}
+		txIDs = append(txIDs, tx.ID)
+	}
+
+	err := lc.db.Update(func(tx StorageTx) error {
+		txs := tx.Bucket([]byte(lightTxsBucket))
+		for i, data := range mb.Txs {
+			if err := txs.Put(txIDs[i], GobEncode(&lightTx{data, mb.BlockHash})); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(lightFilteredBucket)).Put(mb.BlockHash, []byte{})
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return len(mb.Txs), nil
+}
+
+// 主链上关注的地址还没有花费的 output, 交易所在的区块不在主链上时不算
+func (lc *LightChain) UnspentOutputs() []lightUTXO {
+	watched := make(map[string]bool)
+	for _, addr := range lc.addresses {
+		_, hash := decodeAddress(addr)
+		watched[hex.EncodeToString(hash)] = true
+	}
+
+	utxos := make(map[string]lightUTXO)
+	spent := make(map[string]bool)
+
+	lc.db.View(func(tx StorageTx) error {
+		heights := tx.Bucket([]byte(lightHeightsBucket))
+		cursor := tx.Bucket([]byte(lightTxsBucket)).Cursor()
+
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			entry := &lightTx{}
+			GobDecode(value, entry)
+
+			header := getLightHeader(tx, entry.BlockHash)
+			if header == nil || !bytes.Equal(heights.Get(IntToHex(header.Height)), entry.BlockHash) {
+				continue
+			}
+
+			t, err := DeserializeTransaction(entry.Transaction)
+			if err != nil {
+				log.Panic(err)
+			}
+			for outIdx, out := range t.Vout {
+				if watched[hex.EncodeToString(out.AddressHash())] {
+					utxos[string(outpointKey(t.ID, outIdx))] = lightUTXO{t.ID, outIdx, out, header.Height}
+				}
+			}
+			if !t.IsCoinbase() {
+				for _, in := range t.Vin {
+					spent[string(outpointKey(in.Txid, in.Vout))] = true
+				}
+			}
+		}
+		return nil
+	})
+
+	var result []lightUTXO
+	for key, utxo := range utxos {
+		if !spent[key] {
+			result = append(result, utxo)
+		}
+	}
+	return result
+}
+
+// 每个关注的地址的余额
+func (lc *LightChain) Balances() map[string]int {
+	balances := make(map[string]int)
+	for _, addr := range lc.addresses {
+		balances[addr] = 0
+	}
+
+	for _, utxo := range lc.UnspentOutputs() {
+		hash := utxo.Output.AddressHash()
+		for _, addr := range lc.addresses {
+			if _, addrHash := decodeAddress(addr); bytes.Equal(addrHash, hash) {
+				balances[addr] += utxo.Output.Value
+			}
+		}
+	}
+	return balances
+}
+
+// 发给全节点的 filter, 包括关注的地址和它们还没有花费的 output, 花费这些 output 的交易也会匹配
+func (lc *LightChain) NewBloomFilter() *BloomFilter {
+	utxos := lc.UnspentOutputs()
+
+	var tweak [4]byte
+	if _, err := rand.Read(tweak[:]); err != nil {
+		log.Panic(err)
+	}
+
+	filter := NewBloomFilter(len(lc.addresses)+len(utxos), bloomFalsePositiveRate, binary.LittleEndian.Uint32(tweak[:]))
+	for _, addr := range lc.addresses {
+		_, hash := decodeAddress(addr)
+		filter.Add(hash)
+	}
+	for _, utxo := range utxos {
+		filter.Add(outpointKey(utxo.TxID, utxo.OutIdx))
+	}
+	return filter
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// 轻节点定期向全节点同步区块头, 全节点收到新区块时也会把区块头发过来
+const lightSyncInterval = 30 * time.Second
+
+var (
+	lightChain       *LightChain // 轻节点的区块头和交易
+	lightUseCFilters bool        // 使用 compact filter 代替 bloom filter, 不向全节点透露关注的地址
+)
+
+// 启动轻节点, 关注 addresses 中的地址, 只和全节点通信
+func StartLightNode(nodeId string, addresses []string, useCFilters bool) {
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeId)
+	lightUseCFilters = useCFilters
+	lightChain = OpenLightChain(nodeId, addresses)
+	go closeLightOnSignal()
+
+	listener, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	go func() {
+		for {
+			sendLightSync()
+			time.Sleep(lightSyncInterval)
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Panic(err)
+		}
+		go handleLightConn(conn)
+	}
+}
+
+func closeLightOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	lightChain.Close()
+	os.Exit(0)
+}
+
+// 轻节点只处理全节点的回复
+func handleLightConn(conn net.Conn) {
+	reqData, err := ioutil.ReadAll(conn)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	packet := &packet{}
+	if err := TryGobDecode(reqData, packet); err != nil {
+		fmt.Printf("Malformed packet from %s: %s, dropped\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	switch packet.Command {
+	case "headers":
+		handleReceivedHeaders(packet)
+	case "merkleBlock":
+		handleReceivedMerkleBlock(packet)
+	case "cfheaders":
+		handleReceivedCFHeaders(packet)
+	case "cfilters":
+		handleReceivedCFilters(packet)
+	case "block":
+		handleReceivedLightBlock(packet)
+	case "notFound":
+		data := &getData{}
+		GobDecode(packet.Data, data)
+		fmt.Printf("%s doesn't have %s %x, will retry later\n", packet.SourAddress, data.Type, data.Item)
+	default:
+		fmt.Println("Unknown Command")
+	}
+}
+
+// 重新发送 filter (全节点重启之后 filter 就没了), 请求新的区块头, 以及还没有收到的区块中匹配的交易
+func sendLightSync() {
+	destAddr := GetRandomNodeAddr()
+	if destAddr == "" {
+		fmt.Println("No available node")
+		knownNodes.Add(centralNode)
+		return
+	}
+
+	if lightUseCFilters {
+		sendGetHeaders(destAddr)
+		sendCFilterSync(destAddr)
+		sendGetLightBlocks(destAddr, lightChain.BlocksToFetch())
+		return
+	}
+
+	if sendNetworkPacket(buildNetworkPacket(destAddr, "filterLoad", lightChain.NewBloomFilter())) != nil {
+		return
+	}
+	sendGetHeaders(destAddr)
+	sendGetFilteredBlocks(destAddr, lightChain.UnfilteredBlocks())
+}
+
+// 先请求缺少的 filter header, 都有了之后再请求 filter
+func sendCFilterSync(destAddr string) {
+	if start, stop := lightChain.MissingFilterHeaders(); stop != nil {
+		sendNetworkPacket(buildNetworkPacket(destAddr, "getcfheaders", &getCFilters{start, stop}))
+		return
+	}
+	if start, stop := lightChain.MissingFilters(); stop != nil {
+		sendNetworkPacket(buildNetworkPacket(destAddr, "getcfilters", &getCFilters{start, stop}))
+	}
+}
+
+func sendGetLightBlocks(destAddr string, hashes [][]byte) {
+	for _, hash := range hashes {
+		if sendNetworkPacket(buildNetworkPacket(destAddr, "getData", &getData{"block", hash})) != nil {
+			return
+		}
+	}
+}
+
+func sendGetHeaders(destAddr string) {
+	sendNetworkPacket(buildNetworkPacket(destAddr, "getHeaders", &getHeaders{lightChain.BlockLocator()}))
+}
+
+func sendGetFilteredBlocks(destAddr string, hashes [][]byte) {
+	for _, hash := range hashes {
+		if sendNetworkPacket(buildNetworkPacket(destAddr, "getData", &getData{"filteredBlock", hash})) != nil {
+			return
+		}
+	}
+}
+
+func handleReceivedHeaders(packet *packet) {
+	var headers []BlockHeader
+	GobDecode(packet.Data, &headers)
+
+	connected, err := lightChain.AddHeaders(headers)
+	if len(connected) > 0 {
+		fmt.Printf("Synced headers to height %d\n", lightChain.BestHeight())
+	}
+	if lightUseCFilters {
+		if len(connected) > 0 {
+			sendCFilterSync(packet.SourAddress)
+		}
+	} else {
+		sendGetFilteredBlocks(packet.SourAddress, connected)
+	}
+
+	switch {
+	case err == errOrphanHeader:
+		// 中间缺了一些区块头, 比如对方广播的新区块比我们知道的高很多
+		sendGetHeaders(packet.SourAddress)
+	case err != nil:
+		fmt.Printf("Invalid headers from %s: %s\n", packet.SourAddress, err)
+	case len(headers) == maxHeadersPerMsg:
+		sendGetHeaders(packet.SourAddress)
+	}
+}
+
+func handleReceivedMerkleBlock(packet *packet) {
+	mb := &merkleBlock{}
+	GobDecode(packet.Data, mb)
+
+	count, err := lightChain.AddMerkleBlock(mb)
+	if err != nil {
+		fmt.Printf("Invalid merkle block from %s: %s\n", packet.SourAddress, err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	fmt.Printf("Received %d transactions in block %x\n", count, mb.BlockHash)
+	printLightBalances()
+}
+
+func printLightBalances() {
+	for addr, balance := range lightChain.Balances() {
+		fmt.Printf("Balance of '%s': %d\n", addr, balance)
+	}
+}
+
+func handleReceivedCFHeaders(packet *packet) {
+	headers := &cfHeaders{}
+	GobDecode(packet.Data, headers)
+
+	if err := lightChain.AddFilterHeaders(headers); err != nil {
+		fmt.Printf("Invalid filter headers from %s: %s\n", packet.SourAddress, err)
+		return
+	}
+	sendCFilterSync(packet.SourAddress)
+}
+
+func handleReceivedCFilters(packet *packet) {
+	var filters []cFilter
+	GobDecode(packet.Data, &filters)
+
+	var matched [][]byte
+	for i := range filters {
+		match, err := lightChain.AddBlockFilter(&filters[i])
+		if err != nil {
+			fmt.Printf("Invalid filter from %s: %s\n", packet.SourAddress, err)
+			return
+		}
+		if match {
+			matched = append(matched, filters[i].BlockHash)
+		}
+	}
+
+	sendGetLightBlocks(packet.SourAddress, matched)
+	sendCFilterSync(packet.SourAddress)
+}
+
+// filter 匹配时下载的整个区块
+func handleReceivedLightBlock(packet *packet) {
+	var blockData []byte
+	if err := TryGobDecode(packet.Data, &blockData); err != nil {
+		fmt.Printf("Malformed block from %s: %s, dropped\n", packet.SourAddress, err)
+		return
+	}
+	block, err := DeserializeBlock(blockData)
+	if err != nil {
+		fmt.Printf("Malformed block from %s: %s, dropped\n", packet.SourAddress, err)
+		return
+	}
+
+	count, refetch, err := lightChain.AddBlock(block)
+	if err != nil {
+		fmt.Printf("Invalid block from %s: %s\n", packet.SourAddress, err)
+		return
+	}
+	sendGetLightBlocks(packet.SourAddress, refetch)
+
+	if count > 0 {
+		fmt.Printf("Received %d transactions in block %x\n", count, block.Hash)
+		printLightBalances()
+	}
+}
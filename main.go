@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"encoding/hex"
+	"errors"
+	"crypto/sha256"
+	"math/big"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 func main() {
@@ -37,3 +46,397 @@ func testPubKeyHash() {
 func testPhi() {
 	fmt.Println(625 % 8)
 }
+
+// 序列化格式的固定测试向量, 修改格式之后这里的结果必须跟着改, 其他实现也可以用来对照
+func testSerialization() {
+	input := TXInput{[]byte{0x01, 0x02, 0x03}, 1, NewP2PKHScriptSig([]byte{0xaa, 0xbb}, []byte{0xcc}), maxSequence - 1}
+	output := TXOutput{10, NewP2PKHScript(bytes.Repeat([]byte{0xde}, pubKeyHashLen))}
+	coinbase := &Transaction{nil, 1, []TXInput{{[]byte{}, -1, nil, maxSequence}}, []TXOutput{output}, 2}
+	tx := &Transaction{nil, 1, []TXInput{input}, []TXOutput{output, {-3, nil}}, 500000}
+	block := &Block{1500000000, []*Transaction{coinbase, tx}, []byte{0x00, 0xff}, []byte{0xab, 0xcd}, 300, 2}
+	tx.Hash()
+	block.addWitnessCommitment() // 同时会计算 coinbase 的 ID
+
+	vectors := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"TXInput", input.Serialize(),
+			"050301020302feffffff0f0502aabb01cc"},
+		{"TXOutput", output.Serialize(),
+			"05141976a914dededededededededededededededededededede88ac"},
+		{"Transaction", tx.Serialize(),
+			"0502010301020302feffffff0f02141976a914dededededededededededededededededededede88ac0500c0843d0502aabb01cc"},
+		{"Transaction ID", tx.ID,
+			"843c7bdc3f1470e1335fbaf3a4453b15a360feaefc794bd2165c90553b3386b6"},
+		{"Transaction wtxid", tx.WitnessHash(),
+			"92f514f9a4d4ab1df268009ede220c1c591a4b41ddbb37ea457706e99df29a90"},
+		{"Coinbase ID", coinbase.ID,
+			"3df9976037322e7e3f9858cee625fe075531301369641ae398d27b7d9d553aaf"},
+		{"Witness commitment", block.WitnessCommitment(),
+			"10142f0a470dbe65e5f5970df4dd47ba8ff5eb788248415de333a4646bcbd998"},
+		{"Merkle root", block.TransactionsHash(),
+			"59b077019853e70f017e96b275fb37071eba903f38b5e45d401abfb510dc8e33"},
+		{"Block", block.Serialize(),
+			"0580bcc1960b0200ff02abcdd804040202010001ffffffff0f02141976a914dededededededededededededededededededede88ac00266a24aa21a9ed10142f0a470dbe65e5f5970df4dd47ba8ff5eb788248415de333a4646bcbd998040002010301020302feffffff0f02141976a914dededededededededededededededededededede88ac0500c0843d0502aabb01cc"},
+	}
+
+	for _, v := range vectors {
+		result := hex.EncodeToString(v.data)
+		if result != v.expected {
+			fmt.Printf("%s: FAIL\n  expected %s\n  got      %s\n", v.name, v.expected, result)
+			continue
+		}
+		fmt.Printf("%s: OK\n", v.name)
+	}
+
+	// 反序列化之后再序列化必须得到同样的字节, 修改签名不能改变交易 ID
+	signed, err := DeserializeTransaction(tx.Serialize())
+	if err != nil {
+		log.Panic(err)
+	}
+	signed.Vin[0].ScriptSig = []byte{OP_0}
+	signed.Hash()
+	if !bytes.Equal(signed.ID, tx.ID) || bytes.Equal(signed.WitnessHash(), tx.WitnessHash()) {
+		fmt.Println("witness: FAIL")
+	} else {
+		fmt.Println("witness: OK")
+	}
+
+	decodedBlock, err := DeserializeBlock(block.Serialize())
+	if err != nil {
+		log.Panic(err)
+	}
+	decodedTx, err := DeserializeTransaction(tx.Serialize())
+	if err != nil {
+		log.Panic(err)
+	}
+	if !bytes.Equal(decodedBlock.Serialize(), block.Serialize()) || !bytes.Equal(decodedTx.Serialize(), tx.Serialize()) {
+		fmt.Println("round trip: FAIL")
+	} else {
+		fmt.Println("round trip: OK")
+	}
+
+	// 截断的数据返回错误, 不能 panic
+	if _, err := DeserializeBlock(block.Serialize()[:20]); err == nil {
+		fmt.Println("truncated: FAIL")
+	} else if _, err := DeserializeTransaction(tx.Serialize()[:20]); err == nil {
+		fmt.Println("truncated: FAIL")
+	} else {
+		fmt.Println("truncated: OK")
+	}
+}
+
+// BIP340 的测试向量, 前 4 个用私钥和 aux 签名之后必须得到同样的签名, 后面的只验证
+func testSchnorrVectors() {
+	vectors := []struct {
+		privKey, pubKey, aux, msg, sig string
+		valid                          bool
+	}{
+		{"0000000000000000000000000000000000000000000000000000000000000003",
+			"f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca821525f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0", true},
+		{"b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef",
+			"dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"243f6a8885a308d313198a2e03707344a4093822299f31d0082efa98ec4e6c89",
+			"6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8dcf8c78de33418906d11ac976abccb20b091292bff4ea897efcb639ea871cfa95f6de339e4b0a", true},
+		{"c90fdaa22168c234c4c6628b80dc1cd129024e088a67cc74020bbea63b14e5c9",
+			"dd308afec5777e13121fa72b9cc1b7cc0139715309b086c960e18fd969774eb8",
+			"c87aa53824b4d7ae2eb035a2b5bbbccc080e76cdc6d1692c4b0b62d798e6d906",
+			"7e2d58d8b3bcdf1abadec7829054f90dda9805aab56c77333024b9d0a508b75c",
+			"5831aaeed7b44bb74e5eab94ba9d4294c49bcf2a60728d8b4c200f50dd313c1bab745879a5ad954a72c45a91c3a51d3c7adea98d82f8481e0e1e03674a6f3fb7", true},
+		{"0b432b2677937381aef05bb02a66ecd012773062cf3fa2549e44f58ed2401710",
+			"25d1dff95105f5253c4022f628a996ad3a0d95fbf21d468a1b33f8c160d8f517",
+			"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+			"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+			"7eb0509757e246f19449885651611cb965ecc1a187dd51b64fda1edc9637d5ec97582b9cb13db3933705b32ba982af5af25fd78881ebb32771fc5922efc66ea3", true},
+		{"", "d69c3509bb99e412e68b0fe8544e72837dfa30746d8be2aa65975f29d22dc7b9", "",
+			"4df3c3f68fcc83b27e9d42c90431a72499f17875c81a599b566c9889b9696703",
+			"00000000000000000000003b78ce563f89a0ed9414f5aa28ad0d96d6795f9c6376afb1548af603b3eb45c9f8207dee1060cb71c04e80f593060b07d28308d7f4", true},
+		// 公钥不在曲线上
+		{"", "eefdea4cdb677750a420fee807eacf21eb9898ae79b9768766e4faa04a2d4a34", "",
+			"243f6a8885a308d313198a2e03707344a4093822299f31d0082efa98ec4e6c89",
+			"6cff5c3ba86c69ea4b7376f31a9bcb4f74c1976089b2d9963da2e5543e17776969e89b4c5564d00349106b8497785dd7d1d713a8ae82b32fa79d5f7fc407d39b", false},
+		// R 的 y 是奇数
+		{"", "dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659", "",
+			"243f6a8885a308d313198a2e03707344a4093822299f31d0082efa98ec4e6c89",
+			"fff97bd5755eeea420453a14355235d382f6472f8568a18b2f057a14602975563cc27944640ac607cd107ae10923d9ef7a73c643e166be5ebeafa34b1ac553e2", false},
+	}
+
+	for i, v := range vectors {
+		privKey, _ := hex.DecodeString(v.privKey)
+		pubKey, _ := hex.DecodeString(v.pubKey)
+		aux, _ := hex.DecodeString(v.aux)
+		msg, _ := hex.DecodeString(v.msg)
+		sig, _ := hex.DecodeString(v.sig)
+
+		ok := schnorrVerify(pubKey, msg, sig) == v.valid
+		if len(privKey) > 0 {
+			ok = ok && bytes.Equal(schnorrPubKey(privKey), pubKey) && bytes.Equal(schnorrSign(privKey, msg, aux), sig)
+		}
+
+		if !ok {
+			fmt.Printf("BIP340 vector %d: FAIL\n", i)
+			continue
+		}
+		fmt.Printf("BIP340 vector %d: OK\n", i)
+	}
+}
+
+// secp256k1 ECDSA: 私钥 3 的公钥是 3G, 签名用 k = 2, r 是 2G 的 x 坐标, s = (hash + 3r) / 2
+func testSecp256k1Vectors() {
+	hash := sha256.Sum256([]byte("simpleChain"))
+	privKey := bytes32(big.NewInt(3))
+	pubKey := "02f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"
+	sig := "3045022100c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5022022aa31dc8e85b32c03df4f6f86f6ce4f9d1273e20151cb180a6f16f87cb3440e"
+	highS := "3046022100c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5022100dd55ce23717a4cd3fc20b090790931af1d9c6904adf6d523b56347945382fd33"
+
+	scheme := secp256k1ECDSA{}
+	key, _ := hex.DecodeString(pubKey)
+	sigBytes, _ := hex.DecodeString(sig)
+	highSBytes, _ := hex.DecodeString(highS)
+
+	vectors := []struct {
+		name string
+		ok   bool
+	}{
+		{"public key", hex.EncodeToString(scheme.PublicKey(privKey)) == pubKey},
+		{"2G", hex.EncodeToString(compressPoint(scalarBaseMult(big.NewInt(2)))) == "02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5"},
+		{"(n-1)G", hex.EncodeToString(compressPoint(scalarBaseMult(new(big.Int).Sub(secp256k1N, big.NewInt(1))))) == "0379be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+		{"nG", scalarBaseMult(secp256k1N).isInfinity()},
+		{"signature", scheme.Verify(key, sigBytes, hash[:])},
+		{"high s", !scheme.Verify(key, highSBytes, hash[:])},
+		{"wrong hash", !scheme.Verify(key, sigBytes, make([]byte, 32))},
+		{"sign and verify", scheme.Verify(key, scheme.Sign(privKey, hash[:]), hash[:])},
+	}
+
+	for _, v := range vectors {
+		if !v.ok {
+			fmt.Printf("secp256k1 %s: FAIL\n", v.name)
+			continue
+		}
+		fmt.Printf("secp256k1 %s: OK\n", v.name)
+	}
+}
+
+// 交易通过 acceptToMemPool 进入交易池, 紧凑区块只用交易池中的交易就能还原, 不需要 getblocktxn
+func testCompactBlock() {
+	miner := hex.EncodeToString(NewWallet().GetAddress())
+	bc = NewBlockChainWithStorage(NewMemStorage(), NewMemBlockFiles(), miner)
+	defer bc.Close()
+
+	// 每个钱包有一个 coinbase, 交易之间不会花费同一个 output
+	var wallets []*Wallet
+	for i := 0; i < 3; i++ {
+		wallets = append(wallets, NewWallet())
+		bc.Mining(nil, hex.EncodeToString(wallets[i].GetAddress()))
+	}
+
+	var txs []*Transaction
+	for _, w := range wallets {
+		tx := bc.NewUTXOTransaction(w, miner, 3)
+		if err := acceptToMemPool(tx); err != nil {
+			fmt.Printf("accept: FAIL\n  %s\n", err)
+			return
+		}
+		txs = append(txs, tx)
+	}
+
+	conflict := bc.NewUTXOTransaction(wallets[0], miner, 4)
+	if acceptToMemPool(conflict) == nil {
+		fmt.Println("conflict: FAIL")
+	} else {
+		fmt.Println("conflict: OK")
+	}
+
+	height := bc.GetBestHeight() + 1
+	block := NewBlock(append([]*Transaction{NewCoinBaseTX(miner, "", height)}, txs...), bc.tip, height)
+
+	pb, err := newPartialBlock(NewCompactBlock(block, randomNonce()), memPoolTxs())
+	if err != nil {
+		fmt.Printf("compact block: FAIL\n  %s\n", err)
+		return
+	}
+	rebuilt, err := pb.block() // 缺少交易时返回错误
+	if err != nil || !bytes.Equal(rebuilt.Serialize(), block.Serialize()) {
+		fmt.Printf("compact block: FAIL\n  %v\n", err)
+		return
+	}
+	fmt.Println("compact block: OK")
+
+	if err := bc.AddBlock(rebuilt); err != nil {
+		fmt.Printf("connect: FAIL\n  %s\n", err)
+		return
+	}
+	removeFromMemPool(rebuilt)
+	if len(memPoolTxs()) != 0 {
+		fmt.Println("memory pool: FAIL")
+	} else {
+		fmt.Println("memory pool: OK")
+	}
+}
+
+// 内存存储和 bolt 存储上跑同样的 连接/重组/裁剪 流程, 结果应该一样
+func testStorageBackends() {
+	defer func(size, keep, target int64) {
+		maxBlockFileSize, minBlocksToKeep, pruneTarget = size, keep, target
+	}(maxBlockFileSize, minBlocksToKeep, pruneTarget)
+	maxBlockFileSize, minBlocksToKeep, pruneTarget = 1024, 2, 1
+
+	wallet := NewWallet()
+	addr := hex.EncodeToString(wallet.GetAddress())
+	addr2 := hex.EncodeToString(NewWallet().GetAddress())
+
+	run := func(db Storage, files BlockFiles) string {
+		chain := NewBlockChainWithStorage(db, files, addr)
+		defer chain.Close()
+
+		for i := 0; i < 2; i++ {
+			chain.Mining(nil, addr)
+		}
+		fork := chain.GetBlockHash(2)
+		chain.Mining([]*Transaction{chain.NewUTXOTransaction(wallet, addr2, 3)}, addr)
+		chain.Mining(nil, addr)
+
+		// 从高度 2 分叉, 第三个区块让分支比主链长
+		for height := int64(3); height <= 5; height++ {
+			block := NewBlock([]*Transaction{NewCoinBaseTX(addr2, "", height)}, fork, height)
+			if err := chain.AddBlock(block); err != nil {
+				return err.Error()
+			}
+			fork = block.Hash
+		}
+
+		chain.Mining([]*Transaction{chain.NewUTXOTransaction(wallet, addr2, 4)}, addr)
+		chain.Mining(nil, addr)
+
+		return fmt.Sprintf("height %d, balances %d %d, pruned %d, verify %v",
+			chain.GetBestHeight(), chain.GetBalance(addr), chain.GetBalance(addr2),
+			chain.PruneHeight(), chain.VerifyChain(0, maxVerifyLevel))
+	}
+
+	mem := run(NewMemStorage(), NewMemBlockFiles())
+
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := OpenBoltStorage(filepath.Join(dir, "chain.db"))
+	if err != nil {
+		log.Panic(err)
+	}
+	files, err := OpenFlatBlockFiles(filepath.Join(dir, "blocks"))
+	if err != nil {
+		log.Panic(err)
+	}
+	bolt := run(db, files)
+
+	if mem != bolt || !strings.HasSuffix(mem, "verify <nil>") || strings.Contains(mem, "pruned -1") {
+		fmt.Printf("storage backends: FAIL\n  mem  %s\n  bolt %s\n", mem, bolt)
+		return
+	}
+	fmt.Printf("storage backends: OK\n  %s\n", mem)
+}
+
+// P2SH 的 redeem script 最多 maxScriptElementSize 字节: 15 个 Schnorr 公钥的 15-of-15 刚好能花费, 16 个公钥时不能创建地址
+func testMultisigLimit() {
+	miner := NewWallet()
+	minerAddr := hex.EncodeToString(miner.GetAddress())
+	chain := NewBlockChainWithStorage(NewMemStorage(), NewMemBlockFiles(), minerAddr)
+	defer chain.Close()
+
+	var wallets []*Wallet
+	var pubKeys [][]byte
+	for i := 0; i < 16; i++ {
+		wallets = append(wallets, NewWalletWithScheme(SigSchemeSchnorr))
+		pubKeys = append(pubKeys, wallets[i].PublicKey)
+	}
+
+	if checkRedeemScriptSize(NewMultisigScript(16, pubKeys)) == nil {
+		fmt.Println("multisig 16 keys: FAIL")
+	} else {
+		fmt.Println("multisig 16 keys: OK")
+	}
+
+	redeemScript := NewMultisigScript(15, pubKeys[:15])
+	p2shAddr := hex.EncodeToString(NewP2SHAddress(redeemScript))
+	chain.Mining([]*Transaction{chain.NewUTXOTransaction(miner, p2shAddr, 6)}, minerAddr)
+
+	tx := chain.NewMultisigTransaction(redeemScript, minerAddr, 6)
+	for _, w := range wallets[:15] {
+		chain.SignTx(tx, w.PrivateKey)
+	}
+
+	if len(redeemScript) != 513 || !chain.VerifyTx(tx) {
+		fmt.Printf("multisig 15 keys: FAIL\n  %d bytes\n", len(redeemScript))
+		return
+	}
+	chain.Mining([]*Transaction{tx}, minerAddr)
+	if chain.GetBalance(p2shAddr) != 0 {
+		fmt.Println("multisig 15 keys: FAIL")
+		return
+	}
+	fmt.Println("multisig 15 keys: OK")
+}
+
+// 用临时的迁移代替 migrations, 检查 upgradeSchema 执行迁移之后更新版本号, 迁移失败时不修改数据库
+func testSchemaMigration() {
+	defer func(saved []migration) { migrations = saved }(migrations)
+
+	marker := []byte("migrated")
+	applied := 0
+	migrations = []migration{{schemaVersion, "test", func(tx StorageTx, files BlockFiles, progress *progressReporter) error {
+		applied++
+		return tx.Bucket(metaBucket).Put(marker, []byte{1})
+	}}}
+
+	db, files := NewMemStorage(), NewMemBlockFiles()
+	db.Update(func(tx StorageTx) error {
+		return putSchemaVersion(tx, schemaVersion-1)
+	})
+
+	// 第二次打开时已经是新版本, 不能再执行迁移
+	upgradeSchema(db, files)
+	upgradeSchema(db, files)
+
+	var version int
+	var value []byte
+	db.View(func(tx StorageTx) error {
+		version = getSchemaVersion(tx)
+		value = tx.Bucket(metaBucket).Get(marker)
+		return nil
+	})
+	if applied != 1 || version != schemaVersion || value == nil {
+		fmt.Printf("schema migration: FAIL\n  applied %d times, version %d\n", applied, version)
+		return
+	}
+
+	// 失败的迁移整个事务回滚, 版本号不变
+	migrations = []migration{{schemaVersion, "test", func(tx StorageTx, files BlockFiles, progress *progressReporter) error {
+		tx.Bucket(metaBucket).Put(marker, []byte{2})
+		return errors.New("failed")
+	}}}
+	db = NewMemStorage()
+	db.Update(func(tx StorageTx) error {
+		return putSchemaVersion(tx, schemaVersion-1)
+	})
+	func() {
+		defer func() { recover() }()
+		upgradeSchema(db, files)
+	}()
+	db.View(func(tx StorageTx) error {
+		version = getSchemaVersion(tx)
+		value = tx.Bucket(metaBucket).Get(marker)
+		return nil
+	})
+	if version != schemaVersion-1 || value != nil {
+		fmt.Printf("schema migration rollback: FAIL\n  version %d\n", version)
+		return
+	}
+	fmt.Println("schema migration: OK")
+}
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 )
 
+// 叶子节点和中间节点的 hash 加上不同的前缀, 这样 64 字节的叶子不能冒充中间节点, 中间节点也不能冒充叶子
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
 type MerkleTree struct {
 	Root *MerkleNode
+
+	// 有两个相同的子节点 (补齐用的最后一个叶子除外), 说明叶子有重复
+	// 在最后重复一些叶子可以得到同样的 root (CVE-2012-2459), 这样的区块是无效的
+	Mutated bool
+
+	leaves []*MerkleNode // 不包括补齐的叶子
 }
 
 type MerkleNode struct {
@@ -20,10 +33,10 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 
 	var sum256 [32]byte
 	if left == nil && right == nil {
-		sum256 = sha256.Sum256(data)
+		sum256 = sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
 
 	} else {
-		prevHash := append(left.Data, right.Data...)
+		prevHash := append(append([]byte{merkleNodePrefix}, left.Data...), right.Data...)
 		sum256 = sha256.Sum256(prevHash)
 	}
 	node.Data = sum256[:]
@@ -33,23 +46,25 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 
 func NewMerkleTree(data [][]byte) *MerkleTree {
 
-	l := len(data)
-	if l%2 != 0 {
-		data = append(data, data[l-1])
-	}
-
 	var bottomNodes []*MerkleNode
 
 	for _, b := range data {
 		bottomNodes = append(bottomNodes, NewMerkleNode(nil, nil, b))
 	}
 
-	root := buildMerkleTreeHelper(bottomNodes)
-	return &MerkleTree{root}
+	tree := &MerkleTree{leaves: bottomNodes}
+
+	// 奇数个叶子时重复最后一个, 补齐的叶子和原来的是同一个节点, 检查 Mutated 时可以区分
+	if l := len(bottomNodes); l%2 != 0 {
+		bottomNodes = append(bottomNodes, bottomNodes[l-1])
+	}
+
+	tree.Root = buildMerkleTreeHelper(bottomNodes, &tree.Mutated)
+	return tree
 
 }
 
-func buildMerkleTreeHelper(nodes []*MerkleNode) *MerkleNode {
+func buildMerkleTreeHelper(nodes []*MerkleNode, mutated *bool) *MerkleNode {
 
 	if len(nodes) == 1 {
 		return nodes[0]
@@ -57,10 +72,75 @@ func buildMerkleTreeHelper(nodes []*MerkleNode) *MerkleNode {
 
 	l := len(nodes)
 
-	leftRoot := buildMerkleTreeHelper(nodes[:l/2])
-	rightRoot := buildMerkleTreeHelper(nodes[l/2:])
+	leftRoot := buildMerkleTreeHelper(nodes[:l/2], mutated)
+	rightRoot := buildMerkleTreeHelper(nodes[l/2:], mutated)
+
+	if leftRoot != rightRoot && bytes.Equal(leftRoot.Data, rightRoot.Data) {
+		*mutated = true
+	}
 
 	root := NewMerkleNode(leftRoot, rightRoot, nil)
 
 	return root
 }
+
+// Merkle 路径上的一步, Left 表示兄弟节点在左边
+type MerkleProofStep struct {
+	Hash []byte
+	Left bool
+}
+
+// 叶子节点到根节点的路径上所有的兄弟节点, 从叶子开始
+type MerkleProof []MerkleProofStep
+
+// 第 index 个叶子节点到根节点的路径, 不需要整个区块就能证明叶子在树中
+// index 超出范围时返回 nil, 补齐用的叶子没有路径
+func (tree *MerkleTree) Proof(index int) MerkleProof {
+	if index < 0 || index >= len(tree.leaves) {
+		return nil
+	}
+
+	var proof MerkleProof
+	target := tree.leaves[index]
+	count := 0
+
+	var walk func(node *MerkleNode) bool
+	walk = func(node *MerkleNode) bool {
+		if node.Left == nil && node.Right == nil {
+			count++
+			return node == target && count-1 == index
+		}
+
+		if walk(node.Left) {
+			proof = append(proof, MerkleProofStep{node.Right.Data, false})
+			return true
+		}
+		if walk(node.Right) {
+			proof = append(proof, MerkleProofStep{node.Left.Data, true})
+			return true
+		}
+		return false
+	}
+
+	walk(tree.Root)
+	return proof
+}
+
+// 从叶子的数据沿路径算出根节点, 和 root 一致时证明 leaf 在树中
+func VerifyMerkleProof(root, leaf []byte, proof MerkleProof) bool {
+	hash := NewMerkleNode(nil, nil, leaf).Data
+	for _, step := range proof {
+		if len(step.Hash) != sha256.Size {
+			return false
+		}
+
+		sibling := &MerkleNode{Data: step.Hash}
+		current := &MerkleNode{Data: hash}
+		if step.Left {
+			hash = NewMerkleNode(sibling, current, nil).Data
+		} else {
+			hash = NewMerkleNode(current, sibling, nil).Data
+		}
+	}
+	return bytes.Equal(hash, root)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 公证: 把文件的 SHA-256 放在交易的数据 output 中, 交易所在区块的时间戳证明文件在那个时间之前就已经存在
+// 证明只需要区块头和交易到 Merkle root 的路径 (见 tx_proof.go), 不需要整个区块
+
+func HashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+func (bc *BlockChain) NewNotarizationTransaction(from *Wallet, fileHash []byte) *Transaction {
+	return bc.NewDataTransaction(from, fileHash)
+}
+
+// 检查交易的数据 output 中有 fileHash, 并且交易在主链上, 成功时返回交易所在的区块头
+func (bc *BlockChain) VerifyNotarization(tx *Transaction, fileHash []byte, proof *TxProof) (*BlockHeader, error) {
+	if !bytes.Equal(tx.ID, proof.TxID) {
+		return nil, errors.New("the proof is for another transaction")
+	}
+
+	found := false
+	for _, out := range tx.Vout {
+		found = found || bytes.Equal(ExtractNullData(out.ScriptPubKey), fileHash)
+	}
+	if !found {
+		return nil, fmt.Errorf("transaction %x doesn't commit to %x", tx.ID, fileHash)
+	}
+
+	return bc.VerifyTxProof(proof)
+}
@@ -25,11 +25,15 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 
 // 生成用于挖矿的数据
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	return powData(pow.block.PrevBlockHash, pow.block.TransactionsHash(), pow.block.Timestamp, nonce)
+}
+
+func powData(prevBlockHash, txsHash []byte, timestamp int64, nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.TransactionsHash(),
-			IntToHex(pow.block.Timestamp),
+			prevBlockHash,
+			txsHash,
+			IntToHex(timestamp),
 			IntToHex(int64(targetBits)),
 			IntToHex(int64(nonce)),
 		}, []byte{})
@@ -71,3 +75,16 @@ func (pow *ProofOfWork) Validate() bool {
 	hashInt.SetBytes(hash[:])
 	return hashInt.Cmp(pow.target) == -1
 }
+
+// 只用区块头校验工作量证明, 区块头中的 hash 必须就是算出来的 hash
+func ValidateHeader(header *BlockHeader) bool {
+	var hashInt big.Int
+	hash := sha256.Sum256(powData(header.PrevBlockHash, header.TxsHash, header.Timestamp, header.Nonce))
+
+	if !bytes.Equal(hash[:], header.Hash) {
+		return false
+	}
+
+	hashInt.SetBytes(hash[:])
+	return hashInt.Cmp(NewProofOfWork(nil).target) == -1
+}
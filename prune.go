@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+const blockFileInfoBucket = "blockFileInfo"
+
+// 最近的这些区块不会被裁剪, 保证分叉时可以回滚, testStorageBackends 中会改小
+var minBlocksToKeep int64 = 288
+
+var (
+	pruneTarget    int64                   // 区块文件和回滚文件总大小的上限(字节), 0 表示不裁剪
+	pruneHeightKey = []byte("pruneHeight") // 在 metaBucket 中
+)
+
+// 每个 blk 文件(以及对应的 rev 文件)的统计信息, key 是文件编号
+type blockFileInfo struct {
+	Size      int64    // blk 和 rev 文件的总大小
+	MaxHeight int64    // 文件中最高的区块
+	Hashes    [][]byte // 文件中的所有区块, 裁剪时用来标记区块
+}
+
+func updateBlockFileInfo(tx StorageTx, file int, update func(info *blockFileInfo)) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(blockFileInfoBucket))
+	if err != nil {
+		return err
+	}
+
+	key := IntToHex(int64(file))
+	info := &blockFileInfo{}
+	if value := bucket.Get(key); value != nil {
+		GobDecode(value, info)
+	}
+
+	update(info)
+	return bucket.Put(key, GobEncode(info))
+}
+
+// 返回被裁剪的最高区块高度, 没有裁剪过时返回 -1
+func (bc *BlockChain) PruneHeight() int64 {
+	height := int64(-1)
+
+	bc.db.View(func(tx StorageTx) error {
+		if value := tx.Bucket(metaBucket).Get(pruneHeightKey); value != nil {
+			GobDecode(value, &height)
+		}
+		return nil
+	})
+
+	return height
+}
+
+func (bc *BlockChain) IsPruned() bool {
+	return bc.PruneHeight() >= 0
+}
+
+// 区块数据是否还在, 区块被裁剪之后只剩下区块头
+func (bc *BlockChain) HaveBlockData(hash []byte) bool {
+	entry := bc.getBlockIndex(hash)
+	return entry != nil && !entry.Pruned
+}
+
+// 区块文件总大小超过 pruneTarget 时, 从最旧的文件开始删除, 直到低于 pruneTarget
+// 正在写的文件 和 包含最近 minBlocksToKeep 个区块的文件不会被删除
+func (bc *BlockChain) prune() {
+	// 从快照启动时, 快照之前的区块验证完之前不裁剪
+	if pruneTarget <= 0 || bc.SnapshotBase() != nil {
+		return
+	}
+
+	var files []int
+	infos := make(map[int]*blockFileInfo)
+	var total int64
+
+	bc.db.View(func(tx StorageTx) error {
+		bucket := tx.Bucket([]byte(blockFileInfoBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			info := &blockFileInfo{}
+			GobDecode(value, info)
+
+			file := int(HexToInt(key))
+			files = append(files, file)
+			infos[file] = info
+			total += info.Size
+		}
+		return nil
+	})
+
+	if len(files) == 0 {
+		return
+	}
+
+	lastFile := files[len(files)-1]
+	keepHeight := bc.GetBestHeight() - minBlocksToKeep
+
+	for _, file := range files {
+		if total <= pruneTarget || file == lastFile {
+			break
+		}
+
+		info := infos[file]
+		if info.MaxHeight > keepHeight {
+			continue
+		}
+
+		bc.utxoSet.Flush() // 缓存写回之前区块不能删, 否则中断之后无法从数据库中的 UTXO 集追上 tip
+		bc.pruneFile(file, info)
+		total -= info.Size
+		fmt.Printf("Pruned block file %d, up to height %d\n", file, info.MaxHeight)
+	}
+}
+
+// 先把文件中的区块标记为已裁剪, 再删除文件
+func (bc *BlockChain) pruneFile(file int, info *blockFileInfo) {
+	err := bc.db.Update(func(tx StorageTx) error {
+		blocks := tx.Bucket(blocksBucket)
+
+		for _, hash := range info.Hashes {
+			entry := deserializeBlockIndexEntry(blocks.Get(hash))
+			entry.Pruned = true
+			entry.HasUndo = false
+
+			if err := blocks.Put(hash, entry.Serialize()); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(metaBucket)
+		pruneHeight := int64(-1)
+		if value := meta.Get(pruneHeightKey); value != nil {
+			GobDecode(value, &pruneHeight)
+		}
+		if info.MaxHeight > pruneHeight {
+			if err := meta.Put(pruneHeightKey, GobEncode(info.MaxHeight)); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte(blockFileInfoBucket)).Delete(IntToHex(int64(file)))
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if err = bc.blockFiles.Remove(file); err != nil {
+		log.Panic(err)
+	}
+}
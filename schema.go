@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// 数据库结构的版本, 每次修改 bucket 结构或者序列化格式都要加一, 并在 migrations 中添加对应的迁移
+//
+//	0: 区块用 gob 整个存在 "asdf" bucket 中, tip 的 key 为 "l"
+//	1: 区块写到区块文件中, "asdf" bucket 中只保存区块头和位置, 增加回滚数据
+//	2: "asdf" 改名为 "blocks", tip 等链的状态移到 "meta" bucket 中, 并记录版本号
+//	3: 记录 UTXO 集对应的区块, 启动时不再重建 UTXO 集
+//	4: 区块和交易改用 serialization.go 中的格式, 所有交易 ID 和区块 hash 都变了, 无法迁移
+//	5: 交易格式增加 Version 和 LockTime, 交易 ID 又变了, 无法迁移
+//	6: 交易 ID 不再包含签名, 区块中增加 witness commitment, 无法迁移
+//	7: output 和 input 改用脚本, 无法迁移
+//	8: input 增加 Sequence, 无法迁移
+//	9: Merkle 树的叶子和中间节点加上前缀, 区块 hash 都变了, 无法迁移
+//	10: UTXO 集和回滚数据中记录 output 所在区块的高度, 裁剪过的链 (包括从快照启动的链) 无法迁移
+const schemaVersion = 10
+
+// 能升级到当前版本的最旧的版本, 更旧的数据库只能删掉重新同步
+const oldestUpgradableVersion = 9
+
+var schemaVersionKey = []byte("version")
+
+// 版本 0 和 1 中保存区块的 bucket, 用来识别旧版本的数据库
+var v0BlocksBucket = []byte("asdf")
+
+type migration struct {
+	version     int // 迁移之后的版本
+	description string
+	migrate     func(tx StorageTx, files BlockFiles, progress *progressReporter) error
+}
+
+// 升级到版本 1 到 3 的迁移已经删除, 版本 4 到 9 本来就无法迁移, 所以版本 9 之前的数据库都不能升级
+// testSchemaMigration 检查 upgradeSchema 会执行迁移并更新版本号
+var migrations = []migration{
+	{10, "record the height of every coin in the UTXO set and undo data", migrateToV10},
+}
+
+// 返回数据库的版本, 空数据库返回 -1
+// 版本 2 之前没有记录版本号, 根据 bucket 判断
+func getSchemaVersion(tx StorageTx) int {
+	if meta := tx.Bucket(metaBucket); meta != nil {
+		if value := meta.Get(schemaVersionKey); value != nil {
+			return int(HexToInt(value))
+		}
+	}
+
+	if tx.Bucket(v0BlocksBucket) == nil {
+		return -1
+	}
+	if tx.Bucket([]byte(blockFileInfoBucket)) != nil {
+		return 1
+	}
+	return 0
+}
+
+func putSchemaVersion(tx StorageTx, version int) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	return meta.Put(schemaVersionKey, IntToHex(int64(version)))
+}
+
+// 打开数据库时调用, 把旧版本的数据库升级到当前版本, 每个迁移在一个事务中完成, 失败时不会修改数据库
+// 数据库版本比当前程序新时拒绝打开
+func upgradeSchema(db Storage, files BlockFiles) {
+	var version int
+	db.View(func(tx StorageTx) error {
+		version = getSchemaVersion(tx)
+		return nil
+	})
+
+	if version < 0 {
+		return
+	}
+
+	if version > schemaVersion {
+		log.Panicf("ERROR: Database schema version %d is newer than the supported version %d, please upgrade simpleChain", version, schemaVersion)
+	}
+
+	if version < oldestUpgradableVersion {
+		log.Panicf("ERROR: Database schema version %d uses an old encoding for blocks and transactions and cannot be upgraded, please delete the database and block files and resync", version)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		fmt.Printf("Upgrading database from version %d to %d: %s\n", version, m.version, m.description)
+
+		err := db.Update(func(tx StorageTx) error {
+			if err := m.migrate(tx, files, &progressReporter{}); err != nil {
+				return err
+			}
+			return putSchemaVersion(tx, m.version)
+		})
+
+		if err != nil {
+			log.Panicf("ERROR: Database migration to version %d failed: %s", m.version, err)
+		}
+
+		version = m.version
+	}
+}
+
+// 复制 bucket 中的所有 key, 修改 bucket 时不能同时用 cursor 遍历
+func bucketKeys(bucket StorageBucket) [][]byte {
+	var keys [][]byte
+
+	cursor := bucket.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, key...))
+	}
+
+	return keys
+}
+
+// 从创世区块开始读主链上的区块, 得到每笔交易所在的高度, 重写主链区块的回滚数据和 UTXO 集
+// 分支上的区块不再有回滚数据, 重新连接时会重新生成
+func migrateToV10(tx StorageTx, files BlockFiles, progress *progressReporter) error {
+	if tx.Bucket(metaBucket).Get(pruneHeightKey) != nil {
+		return errors.New("blocks below the prune height are gone, delete the database and block files and resync")
+	}
+
+	blocks := tx.Bucket(blocksBucket)
+	heightIndex := tx.Bucket([]byte(heightIndexBucket))
+	var chain [][]byte
+	for _, key := range bucketKeys(heightIndex) {
+		chain = append(chain, append([]byte{}, heightIndex.Get(key)...))
+	}
+
+	progress.Start("rewrite undo data", len(chain))
+	heights := make(map[string]int64) // string(txid) => 主链上所在的高度
+	onChain := make(map[string]bool)
+	for _, hash := range chain {
+		entry := deserializeBlockIndexEntry(blocks.Get(hash))
+		data, err := files.Read(entry.Pos)
+		if err != nil {
+			return err
+		}
+		block, err := DeserializeBlock(data)
+		if err != nil {
+			return err
+		}
+
+		var undo *blockUndo
+		if entry.HasUndo {
+			undoData, err := files.ReadUndo(entry.UndoPos)
+			if err != nil {
+				return err
+			}
+			undo = deserializeBlockUndo(undoData)
+			undo.SpentHeights = make([][]int64, len(block.Transactions))
+		}
+
+		for i, transaction := range block.Transactions {
+			if undo != nil && !transaction.IsCoinbase() {
+				for _, in := range transaction.Vin {
+					height, ok := heights[string(in.Txid)]
+					if !ok {
+						return fmt.Errorf("block %x spends tx %x which is not on the main chain", hash, in.Txid)
+					}
+					undo.SpentHeights[i] = append(undo.SpentHeights[i], height)
+				}
+			}
+			heights[string(transaction.ID)] = block.Height
+		}
+
+		if undo != nil {
+			pos, err := files.AppendUndo(entry.Pos.File, undo.Serialize())
+			if err != nil {
+				return err
+			}
+			entry.UndoPos = pos
+			if err = blocks.Put(hash, entry.Serialize()); err != nil {
+				return err
+			}
+
+			err = updateBlockFileInfo(tx, pos.File, func(info *blockFileInfo) {
+				info.Size += blockRecordHeaderLen + pos.Size
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		onChain[string(hash)] = true
+		progress.Step()
+	}
+
+	for _, hash := range bucketKeys(blocks) {
+		if onChain[string(hash)] {
+			continue
+		}
+
+		entry := deserializeBlockIndexEntry(blocks.Get(hash))
+		if entry.HasUndo {
+			entry.HasUndo = false
+			if err := blocks.Put(hash, entry.Serialize()); err != nil {
+				return err
+			}
+		}
+	}
+
+	utxos := tx.Bucket([]byte(utxoSetBucket))
+	if utxos == nil {
+		return nil // UTXO 集还没有建好, 启动时会重建
+	}
+
+	keys := bucketKeys(utxos)
+	progress.Start("rewrite the UTXO set", len(keys))
+	for _, txID := range keys {
+		height, ok := heights[string(txID)]
+		if !ok {
+			return fmt.Errorf("tx %x in the UTXO set is not on the main chain", txID)
+		}
+
+		entry := &utxoEntry{height, DeserializeOutputs(utxos.Get(txID))}
+		if err := utxos.Put(txID, entry.Serialize()); err != nil {
+			return err
+		}
+		progress.Step()
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"log"
+	"math/big"
+)
+
+// BIP340 Schnorr 签名: 公钥只有 32 字节的 x 坐标 (对应 y 为偶数的点), 签名是 32 字节的 R.x 和 32 字节的 s
+// 签名是线性的, 多个签名可以一起验证, 比一个一个验证快
+
+const schnorrSigLen = 64
+
+// tagged hash, 不同用途的 hash 不会相同
+func taggedHash(tag string, data ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func bytes32(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, 32))
+}
+
+// 32 字节的 x-only 公钥, 私钥不在 [1, n-1] 中时返回 nil
+func schnorrPubKey(privKey []byte) []byte {
+	d := new(big.Int).SetBytes(privKey)
+	if d.Sign() == 0 || d.Cmp(secp256k1N) >= 0 {
+		return nil
+	}
+	return bytes32(scalarBaseMult(d).x)
+}
+
+// aux 是随机数, 即使随机数有问题, nonce 也由私钥和消息决定, 不会泄露私钥
+func schnorrSign(privKey, msg, aux []byte) []byte {
+	d := new(big.Int).SetBytes(privKey)
+	if d.Sign() == 0 || d.Cmp(secp256k1N) >= 0 {
+		log.Panic("ERROR: Invalid schnorr private key")
+	}
+
+	p := scalarBaseMult(d)
+	if !p.hasEvenY() {
+		d.Sub(secp256k1N, d)
+	}
+	pubKey := bytes32(p.x)
+
+	t := bytes32(d)
+	for i, b := range taggedHash("BIP0340/aux", aux) {
+		t[i] ^= b
+	}
+
+	k := new(big.Int).SetBytes(taggedHash("BIP0340/nonce", t, pubKey, msg))
+	k.Mod(k, secp256k1N)
+	if k.Sign() == 0 {
+		log.Panic("ERROR: Schnorr nonce is zero")
+	}
+
+	r := scalarBaseMult(k)
+	if !r.hasEvenY() {
+		k.Sub(secp256k1N, k)
+	}
+
+	e := schnorrChallenge(bytes32(r.x), pubKey, msg)
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, secp256k1N)
+
+	return append(bytes32(r.x), bytes32(s)...)
+}
+
+func schnorrChallenge(r, pubKey, msg []byte) *big.Int {
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", r, pubKey, msg))
+	return e.Mod(e, secp256k1N)
+}
+
+// 签名中的 r 和 s, 以及公钥对应的点, 格式不对时返回 nil
+func parseSchnorr(pubKey, sig []byte) (*curvePoint, *big.Int, *big.Int) {
+	if len(pubKey) != 32 || len(sig) != schnorrSigLen {
+		return nil, nil, nil
+	}
+
+	p := liftX(new(big.Int).SetBytes(pubKey))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if p == nil || r.Cmp(secp256k1P) >= 0 || s.Cmp(secp256k1N) >= 0 {
+		return nil, nil, nil
+	}
+	return p, r, s
+}
+
+// R = s*G - e*P, R 的 y 必须是偶数并且 x 等于 r
+func schnorrVerify(pubKey, msg, sig []byte) bool {
+	p, r, s := parseSchnorr(pubKey, sig)
+	if p == nil {
+		return false
+	}
+
+	e := schnorrChallenge(sig[:32], pubKey, msg)
+	negE := new(big.Int).Sub(secp256k1N, e)
+	R := multiScalarMult([]*curvePoint{secp256k1G, p}, []*big.Int{s, negE})
+
+	return !R.isInfinity() && R.hasEvenY() && R.x.Cmp(r) == 0
+}
+
+// 批量验证的一个签名
+type schnorrBatchItem struct {
+	pubKey, msg, sig []byte
+}
+
+// 用随机系数 a_i 检查 (sum a_i*s_i)*G = sum a_i*R_i + sum a_i*e_i*P_i, 全部有效时返回 true
+// 返回 false 时至少有一个签名无效, 需要一个一个验证才知道是哪个
+func schnorrBatchVerify(items []schnorrBatchItem) bool {
+	points := []*curvePoint{secp256k1G}
+	scalars := []*big.Int{new(big.Int)}
+
+	for i, item := range items {
+		p, r, s := parseSchnorr(item.pubKey, item.sig)
+		if p == nil {
+			return false
+		}
+		R := liftX(r)
+		if R == nil {
+			return false
+		}
+
+		// 第一个系数为 1, 其他的随机, 签名者事先不知道系数, 不能构造互相抵消的无效签名
+		a := big.NewInt(1)
+		if i > 0 {
+			var err error
+			if a, err = rand.Int(rand.Reader, new(big.Int).Sub(secp256k1N, big.NewInt(1))); err != nil {
+				log.Panic(err)
+			}
+			a.Add(a, big.NewInt(1))
+		}
+
+		as := new(big.Int).Mul(a, s)
+		scalars[0].Add(scalars[0], as)
+
+		ae := new(big.Int).Mul(a, schnorrChallenge(item.sig[:32], item.pubKey, item.msg))
+		ae.Mod(ae, secp256k1N)
+
+		points = append(points, R, p)
+		scalars = append(scalars, new(big.Int).Sub(secp256k1N, a), new(big.Int).Sub(secp256k1N, ae))
+	}
+	scalars[0].Mod(scalars[0], secp256k1N)
+
+	return multiScalarMult(points, scalars).isInfinity()
+}
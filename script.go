@@ -0,0 +1,800 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 类似比特币脚本的栈式脚本语言, output 的 ScriptPubKey 规定花费的条件, input 的 ScriptSig 提供满足条件的数据
+// 校验时先执行 ScriptSig, 再用得到的栈执行 ScriptPubKey, 执行成功并且栈顶为 true 才能花费
+// 操作码的编号和比特币一致, 标准的脚本模板见 script_template.go
+
+const (
+	OP_0                   = 0x00 // 压入空数组, 也就是 false
+	OP_PUSHDATA1           = 0x4c // 后面 1 字节是长度
+	OP_PUSHDATA2           = 0x4d // 后面 2 字节 (小端序) 是长度
+	OP_1NEGATE             = 0x4f
+	OP_1                   = 0x51 // OP_1 到 OP_16 压入 1 到 16
+	OP_16                  = 0x60
+	OP_NOP                 = 0x61
+	OP_IF                  = 0x63
+	OP_NOTIF               = 0x64
+	OP_ELSE                = 0x67
+	OP_ENDIF               = 0x68
+	OP_VERIFY              = 0x69
+	OP_RETURN              = 0x6a
+	OP_2DROP               = 0x6d
+	OP_2DUP                = 0x6e
+	OP_DROP                = 0x75
+	OP_DUP                 = 0x76
+	OP_OVER                = 0x78
+	OP_SWAP                = 0x7c
+	OP_SIZE                = 0x82
+	OP_EQUAL               = 0x87
+	OP_EQUALVERIFY         = 0x88
+	OP_1ADD                = 0x8b
+	OP_1SUB                = 0x8c
+	OP_NOT                 = 0x91
+	OP_0NOTEQUAL           = 0x92
+	OP_ADD                 = 0x93
+	OP_SUB                 = 0x94
+	OP_BOOLAND             = 0x9a
+	OP_BOOLOR              = 0x9b
+	OP_NUMEQUAL            = 0x9c
+	OP_NUMEQUALVERIFY      = 0x9d
+	OP_LESSTHAN            = 0x9f
+	OP_GREATERTHAN         = 0xa0
+	OP_LESSTHANOREQUAL     = 0xa1
+	OP_GREATERTHANOREQUAL  = 0xa2
+	OP_MIN                 = 0xa3
+	OP_MAX                 = 0xa4
+	OP_WITHIN              = 0xa5
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9 // RIPEMD160(SHA256(x)), 和 HashPubKey 一样
+	OP_HASH256             = 0xaa // SHA256(SHA256(x))
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+const (
+	maxScriptSize        = 10000 // 超过这个长度的 ScriptPubKey 不能被花费
+	maxScriptElementSize = 520   // 栈中单个元素的最大长度
+	maxStackSize         = 1000
+	maxScriptOps         = 201 // 每个脚本中除了压入数据之外的操作码数量
+	maxScriptNumLen      = 4   // 参与运算的数字最多 4 字节
+	maxMultisigKeys      = 20
+	lockTimeThreshold    = 500000000 // LockTime 小于这个值时是区块高度, 否则是 unix 时间
+)
+
+var opcodeNames = map[byte]string{
+	OP_0: "OP_0", OP_PUSHDATA1: "OP_PUSHDATA1", OP_PUSHDATA2: "OP_PUSHDATA2", OP_1NEGATE: "OP_1NEGATE",
+	OP_NOP: "OP_NOP", OP_IF: "OP_IF", OP_NOTIF: "OP_NOTIF", OP_ELSE: "OP_ELSE", OP_ENDIF: "OP_ENDIF",
+	OP_VERIFY: "OP_VERIFY", OP_RETURN: "OP_RETURN", OP_2DROP: "OP_2DROP", OP_2DUP: "OP_2DUP",
+	OP_DROP: "OP_DROP", OP_DUP: "OP_DUP", OP_OVER: "OP_OVER", OP_SWAP: "OP_SWAP", OP_SIZE: "OP_SIZE",
+	OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY", OP_1ADD: "OP_1ADD", OP_1SUB: "OP_1SUB",
+	OP_NOT: "OP_NOT", OP_0NOTEQUAL: "OP_0NOTEQUAL", OP_ADD: "OP_ADD", OP_SUB: "OP_SUB",
+	OP_BOOLAND: "OP_BOOLAND", OP_BOOLOR: "OP_BOOLOR", OP_NUMEQUAL: "OP_NUMEQUAL",
+	OP_NUMEQUALVERIFY: "OP_NUMEQUALVERIFY", OP_LESSTHAN: "OP_LESSTHAN", OP_GREATERTHAN: "OP_GREATERTHAN",
+	OP_LESSTHANOREQUAL: "OP_LESSTHANOREQUAL", OP_GREATERTHANOREQUAL: "OP_GREATERTHANOREQUAL",
+	OP_MIN: "OP_MIN", OP_MAX: "OP_MAX", OP_WITHIN: "OP_WITHIN", OP_SHA256: "OP_SHA256",
+	OP_HASH160: "OP_HASH160", OP_HASH256: "OP_HASH256", OP_CHECKSIG: "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY", OP_CHECKMULTISIG: "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY", OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// 脚本中的一条指令, 压入数据的指令 data 不为 nil
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+func (op *scriptOp) isPush() bool {
+	return op.opcode <= OP_16 && op.opcode != 0x50
+}
+
+// 把脚本解析成指令, 压入的数据不完整时返回错误
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+
+	for pc := 0; pc < len(script); {
+		opcode := script[pc]
+		pc++
+
+		size := -1
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			size = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if pc+1 > len(script) {
+				return nil, errors.New("script: truncated OP_PUSHDATA1")
+			}
+			size = int(script[pc])
+			pc++
+		case opcode == OP_PUSHDATA2:
+			if pc+2 > len(script) {
+				return nil, errors.New("script: truncated OP_PUSHDATA2")
+			}
+			size = int(script[pc]) | int(script[pc+1])<<8
+			pc += 2
+		}
+
+		if size < 0 {
+			ops = append(ops, scriptOp{opcode, nil})
+			continue
+		}
+
+		if pc+size > len(script) {
+			return nil, fmt.Errorf("script: push of %d bytes past the end of the script", size)
+		}
+		ops = append(ops, scriptOp{opcode, script[pc : pc+size]})
+		pc += size
+	}
+
+	return ops, nil
+}
+
+// 反汇编, 用于打印交易
+func DisasmScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid script %x]", script)
+	}
+
+	var parts []string
+	for _, op := range ops {
+		switch {
+		case op.data != nil:
+			parts = append(parts, fmt.Sprintf("%x", op.data))
+		case op.opcode >= OP_1 && op.opcode <= OP_16:
+			parts = append(parts, fmt.Sprintf("OP_%d", op.opcode-OP_1+1))
+		case opcodeNames[op.opcode] != "":
+			parts = append(parts, opcodeNames[op.opcode])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN_%#x", op.opcode))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// 构造脚本, 压入数据时自动选择最短的操作码
+type scriptBuilder struct {
+	script []byte
+}
+
+func newScriptBuilder() *scriptBuilder {
+	return &scriptBuilder{}
+}
+
+func (b *scriptBuilder) AddOp(opcode byte) *scriptBuilder {
+	b.script = append(b.script, opcode)
+	return b
+}
+
+func (b *scriptBuilder) AddData(data []byte) *scriptBuilder {
+	switch n := len(data); {
+	case n == 0:
+		b.script = append(b.script, OP_0)
+	case n < OP_PUSHDATA1:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(n))
+	default:
+		b.script = append(b.script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	}
+
+	b.script = append(b.script, data...)
+	return b
+}
+
+func (b *scriptBuilder) AddInt(n int64) *scriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(OP_1 + n - 1))
+	}
+	return b.AddData(encodeScriptNum(n))
+}
+
+func (b *scriptBuilder) Script() []byte {
+	return b.script
+}
+
+// 脚本中的数字: 小端序, 最高字节的最高位是符号位, 0 编码为空数组
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+
+	negative := n < 0
+	abs := n
+	if negative {
+		abs = -n
+	}
+
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+
+	// 最高位已经被占用时多加一个字节放符号位
+	if result[len(result)-1]&0x80 != 0 {
+		if negative {
+			result = append(result, 0x80)
+		} else {
+			result = append(result, 0x00)
+		}
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+// 只接受最短的编码, 防止同一个数字有多种写法
+func decodeScriptNum(data []byte, maxLen int) (int64, error) {
+	if len(data) > maxLen {
+		return 0, fmt.Errorf("script: number of %d bytes is too long", len(data))
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	last := data[len(data)-1]
+	if last&0x7f == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) {
+		return 0, errors.New("script: non-minimal number encoding")
+	}
+
+	var result int64
+	for i, b := range data {
+		result |= int64(b) << uint(8*i)
+	}
+
+	if last&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -result, nil
+	}
+	return result, nil
+}
+
+// 空数组和各种形式的 0 (包括负 0) 为 false, 其他都是 true
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+func boolBytes(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+type scriptStack struct {
+	items [][]byte
+}
+
+func (s *scriptStack) push(data []byte) {
+	s.items = append(s.items, data)
+}
+
+func (s *scriptStack) pop() ([]byte, error) {
+	if len(s.items) == 0 {
+		return nil, errors.New("script: stack underflow")
+	}
+
+	top := s.items[len(s.items)-1]
+	s.items = s.items[:len(s.items)-1]
+	return top, nil
+}
+
+// 从栈顶往下数第 i 个元素, 0 为栈顶
+func (s *scriptStack) peek(i int) ([]byte, error) {
+	if i >= len(s.items) {
+		return nil, errors.New("script: stack underflow")
+	}
+	return s.items[len(s.items)-1-i], nil
+}
+
+func (s *scriptStack) popNum() (int64, error) {
+	data, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data, maxScriptNumLen)
+}
+
+func (s *scriptStack) popBool() (bool, error) {
+	data, err := s.pop()
+	return castToBool(data), err
+}
+
+// 执行脚本时需要的交易信息
+type scriptContext struct {
+	tx      *Transaction
+	inIdx   int
+	sigHash []byte // 签名的数据, 也就是交易 ID
+}
+
+// 先执行 ScriptSig 再执行 ScriptPubKey, 成功时返回 nil
+// ScriptPubKey 是 P2SH 时, 还要用 ScriptSig 执行之后的栈执行 ScriptSig 最后压入的 redeem script
+func VerifyScript(scriptSig, scriptPubKey []byte, ctx *scriptContext) error {
+	sigOps, err := parseScript(scriptSig)
+	if err != nil {
+		return err
+	}
+	for _, op := range sigOps {
+		if !op.isPush() {
+			return errors.New("script: ScriptSig may only push data")
+		}
+	}
+
+	stack := &scriptStack{}
+	if err := executeScript(scriptSig, stack, ctx); err != nil {
+		return err
+	}
+	p2shStack := &scriptStack{append([][]byte{}, stack.items...)}
+
+	if err := executeScript(scriptPubKey, stack, ctx); err != nil {
+		return err
+	}
+	if err := verifyTop(stack, "ScriptPubKey"); err != nil {
+		return err
+	}
+
+	if ExtractScriptHash(scriptPubKey) == nil {
+		return nil
+	}
+
+	redeemScript, err := p2shStack.pop()
+	if err != nil {
+		return err
+	}
+	if err := executeScript(redeemScript, p2shStack, ctx); err != nil {
+		return err
+	}
+	return verifyTop(p2shStack, "redeem script")
+}
+
+func executeScript(script []byte, stack *scriptStack, ctx *scriptContext) error {
+	if len(script) > maxScriptSize {
+		return fmt.Errorf("script: script of %d bytes is too long", len(script))
+	}
+
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	var conds []bool // 每层 IF 当前分支是否执行
+	opCount := 0
+
+	for _, op := range ops {
+		executing := true
+		for _, cond := range conds {
+			executing = executing && cond
+		}
+
+		if op.data != nil && len(op.data) > maxScriptElementSize {
+			return fmt.Errorf("script: push of %d bytes is too large", len(op.data))
+		}
+		if op.opcode > OP_16 {
+			if opCount++; opCount > maxScriptOps {
+				return errors.New("script: too many operations")
+			}
+		}
+
+		// 不执行的分支中只需要处理条件语句
+		if !executing && (op.opcode < OP_IF || op.opcode > OP_ENDIF) {
+			continue
+		}
+
+		if err := executeOp(&op, stack, &conds, executing, ctx); err != nil {
+			return err
+		}
+
+		if len(stack.items) > maxStackSize {
+			return errors.New("script: stack too large")
+		}
+	}
+
+	if len(conds) != 0 {
+		return errors.New("script: unbalanced conditional")
+	}
+	return nil
+}
+
+func executeOp(op *scriptOp, stack *scriptStack, conds *[]bool, executing bool, ctx *scriptContext) error {
+	switch {
+	case op.data != nil:
+		stack.push(op.data)
+		return nil
+	case op.opcode == OP_0:
+		stack.push([]byte{})
+		return nil
+	case op.opcode == OP_1NEGATE:
+		stack.push(encodeScriptNum(-1))
+		return nil
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		stack.push(encodeScriptNum(int64(op.opcode - OP_1 + 1)))
+		return nil
+	}
+
+	switch op.opcode {
+	case OP_NOP:
+
+	case OP_IF, OP_NOTIF:
+		cond := false
+		if executing {
+			value, err := stack.popBool()
+			if err != nil {
+				return err
+			}
+			cond = value == (op.opcode == OP_IF)
+		}
+		*conds = append(*conds, cond)
+
+	case OP_ELSE:
+		if len(*conds) == 0 {
+			return errors.New("script: OP_ELSE without OP_IF")
+		}
+		(*conds)[len(*conds)-1] = !(*conds)[len(*conds)-1]
+
+	case OP_ENDIF:
+		if len(*conds) == 0 {
+			return errors.New("script: OP_ENDIF without OP_IF")
+		}
+		*conds = (*conds)[:len(*conds)-1]
+
+	case OP_VERIFY:
+		return verifyTop(stack, "OP_VERIFY")
+
+	case OP_RETURN:
+		return errors.New("script: OP_RETURN")
+
+	case OP_2DROP:
+		if _, err := stack.pop(); err != nil {
+			return err
+		}
+		_, err := stack.pop()
+		return err
+
+	case OP_2DUP:
+		a, err := stack.peek(1)
+		if err != nil {
+			return err
+		}
+		b, _ := stack.peek(0)
+		stack.push(a)
+		stack.push(b)
+
+	case OP_DROP:
+		_, err := stack.pop()
+		return err
+
+	case OP_DUP, OP_OVER:
+		depth := 0
+		if op.opcode == OP_OVER {
+			depth = 1
+		}
+		data, err := stack.peek(depth)
+		if err != nil {
+			return err
+		}
+		stack.push(data)
+
+	case OP_SWAP:
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		stack.push(a)
+		stack.push(b)
+
+	case OP_SIZE:
+		data, err := stack.peek(0)
+		if err != nil {
+			return err
+		}
+		stack.push(encodeScriptNum(int64(len(data))))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		stack.push(boolBytes(bytes.Equal(a, b)))
+		if op.opcode == OP_EQUALVERIFY {
+			return verifyTop(stack, "OP_EQUALVERIFY")
+		}
+
+	case OP_1ADD, OP_1SUB, OP_NOT, OP_0NOTEQUAL:
+		n, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		switch op.opcode {
+		case OP_1ADD:
+			n++
+		case OP_1SUB:
+			n--
+		case OP_NOT:
+			n = boolNum(n == 0)
+		case OP_0NOTEQUAL:
+			n = boolNum(n != 0)
+		}
+		stack.push(encodeScriptNum(n))
+
+	case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_NUMEQUALVERIFY, OP_LESSTHAN, OP_GREATERTHAN,
+		OP_LESSTHANOREQUAL, OP_GREATERTHANOREQUAL, OP_MIN, OP_MAX:
+		b, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		a, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		stack.push(encodeScriptNum(binaryNumOp(op.opcode, a, b)))
+		if op.opcode == OP_NUMEQUALVERIFY {
+			return verifyTop(stack, "OP_NUMEQUALVERIFY")
+		}
+
+	case OP_WITHIN:
+		max, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		min, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		x, err := stack.popNum()
+		if err != nil {
+			return err
+		}
+		stack.push(boolBytes(min <= x && x < max))
+
+	case OP_SHA256, OP_HASH160, OP_HASH256:
+		data, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		switch op.opcode {
+		case OP_SHA256:
+			hash := sha256.Sum256(data)
+			stack.push(hash[:])
+		case OP_HASH160:
+			stack.push(HashPubKey(data))
+		case OP_HASH256:
+			first := sha256.Sum256(data)
+			hash := sha256.Sum256(first[:])
+			stack.push(hash[:])
+		}
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		stack.push(boolBytes(checkSignature(pubKey, sig, ctx.sigHash)))
+		if op.opcode == OP_CHECKSIGVERIFY {
+			return verifyTop(stack, "OP_CHECKSIGVERIFY")
+		}
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := checkMultisig(stack, ctx)
+		if err != nil {
+			return err
+		}
+		stack.push(boolBytes(ok))
+		if op.opcode == OP_CHECKMULTISIGVERIFY {
+			return verifyTop(stack, "OP_CHECKMULTISIGVERIFY")
+		}
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		// 栈顶的值不出栈, 通常后面跟 OP_DROP
+		data, err := stack.peek(0)
+		if err != nil {
+			return err
+		}
+		lockTime, err := decodeScriptNum(data, 5)
+		if err != nil {
+			return err
+		}
+		if ctx.tx.Vin[ctx.inIdx].Sequence == maxSequence {
+			return errors.New("script: lock time is disabled by the input sequence")
+		}
+		return checkLockTime(lockTime, ctx.tx.LockTime)
+
+	case OP_CHECKSEQUENCEVERIFY:
+		data, err := stack.peek(0)
+		if err != nil {
+			return err
+		}
+		sequence, err := decodeScriptNum(data, 5)
+		if err != nil {
+			return err
+		}
+		return checkSequence(sequence, ctx.tx.Vin[ctx.inIdx].Sequence)
+
+	default:
+		return fmt.Errorf("script: unknown opcode %#x", op.opcode)
+	}
+
+	return nil
+}
+
+func boolNum(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func binaryNumOp(opcode byte, a, b int64) int64 {
+	switch opcode {
+	case OP_ADD:
+		return a + b
+	case OP_SUB:
+		return a - b
+	case OP_BOOLAND:
+		return boolNum(a != 0 && b != 0)
+	case OP_BOOLOR:
+		return boolNum(a != 0 || b != 0)
+	case OP_NUMEQUAL, OP_NUMEQUALVERIFY:
+		return boolNum(a == b)
+	case OP_LESSTHAN:
+		return boolNum(a < b)
+	case OP_GREATERTHAN:
+		return boolNum(a > b)
+	case OP_LESSTHANOREQUAL:
+		return boolNum(a <= b)
+	case OP_GREATERTHANOREQUAL:
+		return boolNum(a >= b)
+	case OP_MIN:
+		if a < b {
+			return a
+		}
+		return b
+	default: // OP_MAX
+		if a > b {
+			return a
+		}
+		return b
+	}
+}
+
+func verifyTop(stack *scriptStack, name string) error {
+	ok, err := stack.popBool()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("script: %s failed", name)
+	}
+	return nil
+}
+
+// 栈中从下到上为 <签名 1> ... <签名 N> M <公钥 1> ... <公钥 N> N
+// 每个公钥对应一个签名的位置, 还没有签名的位置为空, 这样部分签名的交易可以交给其他人继续签名
+// 至少有 M 个有效的签名才成功, 不为空的签名必须都是有效的
+func checkMultisig(stack *scriptStack, ctx *scriptContext) (bool, error) {
+	n, err := stack.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxMultisigKeys {
+		return false, fmt.Errorf("script: invalid multisig key count %d", n)
+	}
+
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := stack.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("script: invalid multisig threshold %d of %d", m, n)
+	}
+
+	valid := int64(0)
+	for i := n - 1; i >= 0; i-- {
+		sig, err := stack.pop()
+		if err != nil {
+			return false, err
+		}
+		if len(sig) == 0 {
+			continue
+		}
+		if !checkSignature(pubKeys[i], sig, ctx.sigHash) {
+			return false, nil
+		}
+		valid++
+	}
+
+	return valid >= m, nil
+}
+
+// 交易的 LockTime 必须和脚本要求的是同一种 (高度或时间), 并且不小于脚本要求的值
+func checkLockTime(required, txLockTime int64) error {
+	if required < 0 {
+		return errors.New("script: negative lock time")
+	}
+	if (required < lockTimeThreshold) != (txLockTime < lockTimeThreshold) {
+		return errors.New("script: lock time type mismatch")
+	}
+	if required > txLockTime {
+		return fmt.Errorf("script: lock time %d not reached, transaction lock time is %d", required, txLockTime)
+	}
+	return nil
+}
+
+// input 的 Sequence 必须是相对时间锁, 单位和脚本要求的一样, 并且不小于脚本要求的值
+// 脚本中的值设置了 sequenceDisableFlag 时什么都不检查
+func checkSequence(required int64, txSequence uint32) error {
+	if required < 0 {
+		return errors.New("script: negative sequence")
+	}
+	if required&sequenceDisableFlag != 0 {
+		return nil
+	}
+	if txSequence&sequenceDisableFlag != 0 {
+		return errors.New("script: relative lock time is disabled by the input sequence")
+	}
+
+	mask := int64(sequenceTypeFlag | sequenceLockMask)
+	if required&sequenceTypeFlag != int64(txSequence)&sequenceTypeFlag {
+		return errors.New("script: relative lock time type mismatch")
+	}
+	if required&mask > int64(txSequence)&mask {
+		return fmt.Errorf("script: relative lock %#x not reached, input sequence is %#x", required, txSequence)
+	}
+	return nil
+}
+
+// 验证通过的签名放进 sigCache, 下次遇到同样的签名直接返回
+func checkSignature(pubKey, sig, hash []byte) bool {
+	if sigCache.Contains(hash, pubKey, sig) {
+		return true
+	}
+	if !verifySignature(pubKey, sig, hash) {
+		return false
+	}
+
+	sigCache.Add(hash, pubKey, sig)
+	return true
+}
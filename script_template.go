@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+)
+
+// 标准的脚本模板, 钱包只会生成和识别这些脚本, 其他脚本也可以被花费, 只要满足脚本的条件
+
+const pubKeyHashLen = 20
+
+const secretSize = 32 // HTLC 中 secret 的长度
+
+const maxDataCarrierSize = 80 // 数据 output 最多能放的字节数
+
+const maxNullDataScriptSize = maxDataCarrierSize + 3 // OP_RETURN 加上压入 maxDataCarrierSize 字节的操作 (最多 2 字节)
+
+// P2PKH: 转到公钥 hash, 花费时提供公钥和签名, 也就是之前 PubKeyHash 和 UsesKey 的规则
+//
+//	ScriptPubKey: OP_DUP OP_HASH160 <PubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+//	ScriptSig:    <Signature> <PubKey>
+func NewP2PKHScript(pubKeyHash []byte) []byte {
+	return newScriptBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+func NewP2PKHScriptSig(signature, pubKey []byte) []byte {
+	return newScriptBuilder().AddData(signature).AddData(pubKey).Script()
+}
+
+// 是 P2PKH 脚本时返回其中的公钥 hash, 否则返回 nil
+func ExtractPubKeyHash(script []byte) []byte {
+	if len(script) != pubKeyHashLen+5 || script[0] != OP_DUP || script[1] != OP_HASH160 ||
+		script[2] != pubKeyHashLen || script[pubKeyHashLen+3] != OP_EQUALVERIFY || script[pubKeyHashLen+4] != OP_CHECKSIG {
+		return nil
+	}
+	return script[3 : pubKeyHashLen+3]
+}
+
+// 带时间锁的 P2PKH, 绝对时间锁用 OP_CHECKLOCKTIMEVERIFY, 相对时间锁用 OP_CHECKSEQUENCEVERIFY, lock 的含义见 timelock.go
+//
+//	ScriptPubKey: <lock> OP_CHECKLOCKTIMEVERIFY 或 OP_CHECKSEQUENCEVERIFY OP_DROP OP_DUP OP_HASH160 <PubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+//	ScriptSig:    <Signature> <PubKey>
+func NewTimeLockScript(lock int64, relative bool, pubKeyHash []byte) []byte {
+	opcode := byte(OP_CHECKLOCKTIMEVERIFY)
+	if relative {
+		opcode = OP_CHECKSEQUENCEVERIFY
+	}
+	return append(newScriptBuilder().AddInt(lock).AddOp(opcode).AddOp(OP_DROP).Script(), NewP2PKHScript(pubKeyHash)...)
+}
+
+// 是带时间锁的 P2PKH 脚本时返回锁定的值、是否是相对时间锁和公钥 hash, 否则 lock 为 -1
+func ExtractTimeLock(script []byte) (lock int64, relative bool, pubKeyHash []byte) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 3 || ops[2].opcode != OP_DROP ||
+		(ops[1].opcode != OP_CHECKLOCKTIMEVERIFY && ops[1].opcode != OP_CHECKSEQUENCEVERIFY) {
+		return -1, false, nil
+	}
+
+	var n int64
+	switch small, ok := smallInt(&ops[0]); {
+	case ok:
+		n = int64(small)
+	case ops[0].data != nil:
+		if n, err = decodeScriptNum(ops[0].data, 5); err != nil || n < 0 {
+			return -1, false, nil
+		}
+	case ops[0].opcode != OP_0:
+		return -1, false, nil
+	}
+
+	// 前三个操作码之后剩下的部分必须是 P2PKH
+	prefix := newScriptBuilder().AddInt(n).AddOp(ops[1].opcode).AddOp(OP_DROP).Script()
+	if !bytes.HasPrefix(script, prefix) {
+		return -1, false, nil
+	}
+	if pubKeyHash = ExtractPubKeyHash(script[len(prefix):]); pubKeyHash == nil {
+		return -1, false, nil
+	}
+
+	return n, ops[1].opcode == OP_CHECKSEQUENCEVERIFY, pubKeyHash
+}
+
+// M-of-N 多重签名, 公钥的顺序决定了签名的顺序, 没有签名的位置为空
+//
+//	ScriptPubKey: M <PubKey 1> ... <PubKey N> N OP_CHECKMULTISIG
+//	ScriptSig:    <Signature 1 或空> ... <Signature N 或空>
+func NewMultisigScript(m int, pubKeys [][]byte) []byte {
+	if m < 1 || m > len(pubKeys) || len(pubKeys) > maxMultisigKeys {
+		log.Panicf("ERROR: Invalid multisig %d of %d", m, len(pubKeys))
+	}
+
+	builder := newScriptBuilder().AddInt(int64(m))
+	for _, pubKey := range pubKeys {
+		builder.AddData(pubKey)
+	}
+	return builder.AddInt(int64(len(pubKeys))).AddOp(OP_CHECKMULTISIG).Script()
+}
+
+// 是多重签名脚本时返回 M 和所有公钥, 否则返回 0 和 nil
+func ExtractMultisig(script []byte) (int, [][]byte) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil
+	}
+
+	m, okM := smallInt(&ops[0])
+	n, okN := smallInt(&ops[len(ops)-2])
+	if !okM || !okN || n != len(ops)-3 || m < 1 || m > n {
+		return 0, nil
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if len(op.data) == 0 {
+			return 0, nil
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+	return m, pubKeys
+}
+
+// OP_1 到 OP_16 表示的数字
+func smallInt(op *scriptOp) (int, bool) {
+	if op.data != nil || op.opcode < OP_1 || op.opcode > OP_16 {
+		return 0, false
+	}
+	return int(op.opcode-OP_1) + 1, true
+}
+
+// 多重签名的 ScriptSig, sigs 中每个位置对应一个公钥, P2SH 时最后加上 redeem script
+func NewMultisigScriptSig(sigs [][]byte, redeemScript []byte) []byte {
+	builder := newScriptBuilder()
+	for _, sig := range sigs {
+		builder.AddData(sig)
+	}
+	if redeemScript != nil {
+		builder.AddData(redeemScript)
+	}
+	return builder.Script()
+}
+
+// P2SH: 转到脚本的 hash, 花费时提供脚本 (redeem script) 和满足脚本的数据, 地址更短, 脚本的内容由花费的人提供
+//
+//	ScriptPubKey: OP_HASH160 <ScriptHash> OP_EQUAL
+//	ScriptSig:    <满足 redeem script 的数据...> <redeem script>
+func NewP2SHScript(scriptHash []byte) []byte {
+	return newScriptBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+// redeem script 在 ScriptSig 中是一次压入, 超过 maxScriptElementSize 时转到它的 P2SH 地址的币永远不能被花费
+// 比如 Schnorr 公钥最多 15 个, P-256 公钥最多 7 个
+func checkRedeemScriptSize(redeemScript []byte) error {
+	if len(redeemScript) > maxScriptElementSize {
+		return fmt.Errorf("redeem script is %d bytes, P2SH allows at most %d", len(redeemScript), maxScriptElementSize)
+	}
+	return nil
+}
+
+// 是 P2SH 脚本时返回其中的脚本 hash, 否则返回 nil
+func ExtractScriptHash(script []byte) []byte {
+	if len(script) != pubKeyHashLen+3 || script[0] != OP_HASH160 || script[1] != pubKeyHashLen ||
+		script[pubKeyHashLen+2] != OP_EQUAL {
+		return nil
+	}
+	return script[2 : pubKeyHashLen+2]
+}
+
+// 只包含压入数据的脚本中压入的所有数据, 包含其他操作码时返回 nil
+func scriptPushes(script []byte) [][]byte {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil
+	}
+
+	pushes := [][]byte{}
+	for _, op := range ops {
+		switch {
+		case op.data != nil:
+			pushes = append(pushes, op.data)
+		case op.opcode == OP_0:
+			pushes = append(pushes, []byte{})
+		case op.opcode == OP_1NEGATE || (op.opcode >= OP_1 && op.opcode <= OP_16):
+			pushes = append(pushes, encodeScriptNum(int64(op.opcode)-OP_1+1))
+		default:
+			return nil
+		}
+	}
+	return pushes
+}
+
+// HTLC (hash time-locked contract): 知道 secret 的接收方可以花费, 或者 lockTime 之后退回给发送方, 用于原子交换
+// 要求 secret 的长度为 secretSize, 这样两条链上的合约对 secret 的要求一样
+//
+//	OP_IF
+//	    OP_SIZE <secretSize> OP_EQUALVERIFY OP_SHA256 <SecretHash> OP_EQUALVERIFY OP_DUP OP_HASH160 <RecipientHash>
+//	OP_ELSE
+//	    <lockTime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <RefundHash>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+//
+// 通常作为 P2SH 的 redeem script, 接收方的 ScriptSig 为 <Signature> <PubKey> <secret> OP_1 <redeem script>,
+// 退款的 ScriptSig 为 <Signature> <PubKey> OP_0 <redeem script>
+type HTLC struct {
+	SecretHash    []byte
+	RecipientHash []byte
+	RefundHash    []byte
+	LockTime      int64
+}
+
+func (htlc *HTLC) Script() []byte {
+	return newScriptBuilder().AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt(secretSize).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(htlc.SecretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(htlc.RecipientHash).
+		AddOp(OP_ELSE).
+		AddInt(htlc.LockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(htlc.RefundHash).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// 是 HTLC 脚本时返回合约的内容, 否则返回 nil
+func ExtractHTLC(script []byte) *HTLC {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 20 {
+		return nil
+	}
+
+	lockTime := int64(-1)
+	if small, ok := smallInt(&ops[11]); ok {
+		lockTime = int64(small)
+	} else if ops[11].data != nil {
+		if lockTime, err = decodeScriptNum(ops[11].data, 5); err != nil {
+			return nil
+		}
+	}
+	if lockTime < 0 {
+		return nil
+	}
+
+	// 用取出的字段重新生成脚本, 和原来的一样才是 HTLC
+	htlc := &HTLC{ops[5].data, ops[9].data, ops[16].data, lockTime}
+	if len(htlc.SecretHash) != sha256.Size || len(htlc.RecipientHash) != pubKeyHashLen ||
+		len(htlc.RefundHash) != pubKeyHashLen || !bytes.Equal(htlc.Script(), script) {
+		return nil
+	}
+	return htlc
+}
+
+// secret 为 nil 时走退款的分支
+func NewHTLCScriptSig(signature, pubKey, secret, redeemScript []byte) []byte {
+	builder := newScriptBuilder().AddData(signature).AddData(pubKey)
+	if secret != nil {
+		builder.AddData(secret).AddInt(1)
+	} else {
+		builder.AddInt(0)
+	}
+	return builder.AddData(redeemScript).Script()
+}
+
+// 从花费 HTLC 的 ScriptSig 中取出 secret, 是退款或者不是这个合约时返回 nil
+func ExtractHTLCSecret(scriptSig, redeemScript []byte) []byte {
+	pushes := scriptPushes(scriptSig)
+	if len(pushes) != 5 || !bytes.Equal(pushes[4], redeemScript) || len(pushes[2]) != secretSize {
+		return nil
+	}
+	return pushes[2]
+}
+
+// 以 OP_RETURN 开头的脚本一定执行失败, 可以用来在链上放数据, 这种 output 不会加到 UTXO 集中
+//
+//	ScriptPubKey: OP_RETURN <data>
+func NewNullDataScript(data []byte) []byte {
+	return newScriptBuilder().AddOp(OP_RETURN).AddData(data).Script()
+}
+
+// 是 OP_RETURN <data> 时返回 data, 否则返回 nil
+func ExtractNullData(script []byte) []byte {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 2 || ops[0].opcode != OP_RETURN || ops[1].data == nil {
+		return nil
+	}
+	return ops[1].data
+}
+
+func IsUnspendable(script []byte) bool {
+	return (len(script) > 0 && script[0] == OP_RETURN) || len(script) > maxScriptSize
+}
+
+// witness commitment 的脚本: OP_RETURN <witnessCommitmentHeader + witness root>
+func isWitnessCommitmentScript(script []byte) bool {
+	size := len(witnessCommitmentHeader) + sha256.Size
+	return len(script) == size+2 && script[0] == OP_RETURN && int(script[1]) == size &&
+		bytes.HasPrefix(script[2:], witnessCommitmentHeader)
+}
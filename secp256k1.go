@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math/big"
+)
+
+// secp256k1 曲线 y^2 = x^3 + 7, 标准库的 elliptic 只支持 a = -3 的曲线, 所以这里自己实现
+// 用 big.Int 计算, 不是常数时间的, 签名时可能通过时间泄露私钥, 只适合这个项目的用途
+var (
+	secp256k1P, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+	secp256k1N, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	secp256k1Gx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	secp256k1Gy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+
+	secp256k1G     = &curvePoint{secp256k1Gx, secp256k1Gy}
+	secp256k1HalfN = new(big.Int).Rsh(secp256k1N, 1)
+)
+
+// 仿射坐标的点, x 为 nil 时是无穷远点
+type curvePoint struct {
+	x, y *big.Int
+}
+
+func (p *curvePoint) isInfinity() bool {
+	return p.x == nil
+}
+
+func (p *curvePoint) hasEvenY() bool {
+	return p.y.Bit(0) == 0
+}
+
+// Jacobian 坐标 (X/Z^2, Y/Z^3), 加法和倍点不需要求逆, Z 为 0 时是无穷远点
+type jacobianPoint struct {
+	x, y, z *big.Int
+}
+
+func newJacobianInfinity() *jacobianPoint {
+	return &jacobianPoint{new(big.Int), new(big.Int), new(big.Int)}
+}
+
+func toJacobian(p *curvePoint) *jacobianPoint {
+	if p.isInfinity() {
+		return newJacobianInfinity()
+	}
+	return &jacobianPoint{new(big.Int).Set(p.x), new(big.Int).Set(p.y), big.NewInt(1)}
+}
+
+func (p *jacobianPoint) isInfinity() bool {
+	return p.z.Sign() == 0
+}
+
+func (p *jacobianPoint) toAffine() *curvePoint {
+	if p.isInfinity() {
+		return &curvePoint{}
+	}
+
+	zInv := new(big.Int).ModInverse(p.z, secp256k1P)
+	zInv2 := fieldMul(zInv, zInv)
+	return &curvePoint{fieldMul(p.x, zInv2), fieldMul(p.y, fieldMul(zInv2, zInv))}
+}
+
+func fieldMul(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, secp256k1P)
+}
+
+func fieldSub(a, b *big.Int) *big.Int {
+	r := new(big.Int).Sub(a, b)
+	return r.Mod(r, secp256k1P)
+}
+
+// dbl-2009-l, a = 0
+func (p *jacobianPoint) double() *jacobianPoint {
+	if p.isInfinity() || p.y.Sign() == 0 {
+		return newJacobianInfinity()
+	}
+
+	a := fieldMul(p.x, p.x)
+	b := fieldMul(p.y, p.y)
+	c := fieldMul(b, b)
+	d := new(big.Int).Add(p.x, b)
+	d = fieldSub(fieldMul(d, d), new(big.Int).Add(a, c))
+	d.Lsh(d, 1)
+	e := new(big.Int).Mul(a, big.NewInt(3))
+	f := fieldMul(e, e)
+
+	x := fieldSub(f, new(big.Int).Lsh(d, 1))
+	y := fieldSub(fieldMul(e, fieldSub(d, x)), new(big.Int).Lsh(c, 3))
+	z := fieldMul(new(big.Int).Lsh(p.y, 1), p.z)
+	return &jacobianPoint{x, y, z}
+}
+
+// add-2007-bl
+func (p *jacobianPoint) add(q *jacobianPoint) *jacobianPoint {
+	if p.isInfinity() {
+		return q
+	}
+	if q.isInfinity() {
+		return p
+	}
+
+	z1z1 := fieldMul(p.z, p.z)
+	z2z2 := fieldMul(q.z, q.z)
+	u1 := fieldMul(p.x, z2z2)
+	u2 := fieldMul(q.x, z1z1)
+	s1 := fieldMul(p.y, fieldMul(q.z, z2z2))
+	s2 := fieldMul(q.y, fieldMul(p.z, z1z1))
+
+	if u1.Cmp(u2) == 0 {
+		if s1.Cmp(s2) != 0 {
+			return newJacobianInfinity()
+		}
+		return p.double()
+	}
+
+	h := fieldSub(u2, u1)
+	hh := fieldMul(h, h)
+	hhh := fieldMul(h, hh)
+	r := fieldSub(s2, s1)
+	v := fieldMul(u1, hh)
+
+	x := fieldSub(fieldMul(r, r), new(big.Int).Add(hhh, new(big.Int).Lsh(v, 1)))
+	y := fieldSub(fieldMul(r, fieldSub(v, x)), fieldMul(s1, hhh))
+	z := fieldMul(fieldMul(p.z, q.z), h)
+	return &jacobianPoint{x, y, z}
+}
+
+// sum(scalars[i] * points[i]), 所有点共用同一串倍点 (Straus), 比分别计算再相加快很多
+func multiScalarMult(points []*curvePoint, scalars []*big.Int) *curvePoint {
+	jacobians := make([]*jacobianPoint, len(points))
+	maxBits := 0
+	for i, p := range points {
+		jacobians[i] = toJacobian(p)
+		if scalars[i].BitLen() > maxBits {
+			maxBits = scalars[i].BitLen()
+		}
+	}
+
+	acc := newJacobianInfinity()
+	for bit := maxBits - 1; bit >= 0; bit-- {
+		acc = acc.double()
+		for i, k := range scalars {
+			if k.Bit(bit) == 1 {
+				acc = acc.add(jacobians[i])
+			}
+		}
+	}
+	return acc.toAffine()
+}
+
+func scalarBaseMult(k *big.Int) *curvePoint {
+	return multiScalarMult([]*curvePoint{secp256k1G}, []*big.Int{k})
+}
+
+// 由 x 坐标求出 y 为偶数的点, x 不在曲线上时返回 nil
+func liftX(x *big.Int) *curvePoint {
+	if x.Sign() < 0 || x.Cmp(secp256k1P) >= 0 {
+		return nil
+	}
+
+	c := new(big.Int).Exp(x, big.NewInt(3), secp256k1P)
+	c.Add(c, big.NewInt(7))
+	c.Mod(c, secp256k1P)
+
+	// p % 4 == 3, 平方根是 c^((p+1)/4)
+	exp := new(big.Int).Add(secp256k1P, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	y := new(big.Int).Exp(c, exp, secp256k1P)
+	if fieldMul(y, y).Cmp(c) != 0 {
+		return nil
+	}
+
+	if y.Bit(0) == 1 {
+		y.Sub(secp256k1P, y)
+	}
+	return &curvePoint{new(big.Int).Set(x), y}
+}
+
+// 压缩格式: 0x02 (y 为偶数) 或 0x03 (y 为奇数) | 32 字节 x
+func compressPoint(p *curvePoint) []byte {
+	prefix := byte(0x02)
+	if !p.hasEvenY() {
+		prefix = 0x03
+	}
+	return append([]byte{prefix}, p.x.FillBytes(make([]byte, 32))...)
+}
+
+// 格式不对或者不在曲线上时返回 nil
+func decompressPoint(data []byte) *curvePoint {
+	if len(data) != 33 || (data[0] != 0x02 && data[0] != 0x03) {
+		return nil
+	}
+
+	p := liftX(new(big.Int).SetBytes(data[1:]))
+	if p == nil {
+		return nil
+	}
+	if data[0] == 0x03 {
+		p.y.Sub(secp256k1P, p.y)
+	}
+	return p
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 区块和交易的二进制格式, 同样的数据总是得到同样的字节, 交易 ID 和签名都是对这个格式求 hash
+// 交易 ID 不参与序列化, 反序列化时重新计算, 收到的交易 ID 一定和内容一致
+// ScriptSig (witness) 放在交易最后, 交易 ID 只对前面的部分求 hash, 见 witness.go
+//
+// 基本类型:
+//
+//	uvarint: 无符号整数, LEB128 编码, 必须是最短的编码
+//	varint:  有符号整数, zigzag 之后按 uvarint 编码
+//	bytes:   uvarint 长度 + 数据
+//
+// Block、Transaction、TXInput、TXOutput 单独序列化时以一个版本号字节开头, 嵌套在其他结构中时不再重复版本号
+//
+//	Block:       version | varint Timestamp | bytes PrevBlockHash | bytes Hash | varint Nonce | varint Height
+//	             | uvarint 交易数量 | Transaction...
+//	Transaction: version | varint Version | uvarint 输入数量 | TXInput... | uvarint 输出数量 | TXOutput...
+//	             | varint LockTime | 每个输入的 witness...
+//	TXInput:     version | bytes Txid | varint Vout | uvarint Sequence | witness, 在交易中时 witness 放在交易最后
+//	witness:     bytes ScriptSig
+//	TXOutput:    version | varint Value | bytes ScriptPubKey
+//
+// 格式的版本:
+//
+//	1: 交易中带 ID
+//	2: 交易去掉 ID, 增加 Version 和 LockTime
+//	3: 签名和公钥移到交易最后
+//	4: 签名和公钥换成 ScriptSig, PubKeyHash 换成 ScriptPubKey
+//	5: TXInput 增加 Sequence
+const serializationVersion = 5
+
+const maxSerializedItems = 1 << 20 // 数量和长度的上限, 防止损坏的数据导致分配太多内存
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) writeByte(b byte) {
+	e.buf.WriteByte(b)
+}
+
+func (e *encoder) writeUvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func (e *encoder) writeVarint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf.Write(tmp[:binary.PutVarint(tmp[:], v)])
+}
+
+func (e *encoder) writeBytes(data []byte) {
+	e.writeUvarint(uint64(len(data)))
+	e.buf.Write(data)
+}
+
+func (e *encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// 出错之后后面的读取都返回零值, 最后检查 err 就可以
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("decode: "+format+" at offset %d", append(a, d.pos)...)
+	}
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.pos >= len(d.data) {
+		d.fail("unexpected end of data")
+		return 0
+	}
+
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *decoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+
+	// 只接受最短的编码, 否则同样的数据会有多种编码
+	var tmp [binary.MaxVarintLen64]byte
+	if binary.PutUvarint(tmp[:], v) != n {
+		d.fail("non-minimal varint")
+		return 0
+	}
+
+	d.pos += n
+	return v
+}
+
+func (d *decoder) readVarint() int64 {
+	u := d.readUvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// 读取数量, 超过上限时出错
+func (d *decoder) readCount() int {
+	n := d.readUvarint()
+	if n > maxSerializedItems {
+		d.fail("count %d too large", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readCount()
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data)-d.pos < n {
+		d.fail("unexpected end of data")
+		return nil
+	}
+
+	data := append([]byte{}, d.data[d.pos:d.pos+n]...)
+	d.pos += n
+	return data
+}
+
+func (d *decoder) readVersion() {
+	if version := d.readByte(); d.err == nil && version != serializationVersion {
+		d.fail("unsupported version %d", version)
+	}
+}
+
+// 所有数据都读完之后调用, 后面还有多余的数据也是错误
+func (d *decoder) finish() error {
+	if d.err == nil && d.pos != len(d.data) {
+		d.fail("%d trailing bytes", len(d.data)-d.pos)
+	}
+	return d.err
+}
+
+func (b *Block) encode(e *encoder) {
+	e.writeVarint(b.Timestamp)
+	e.writeBytes(b.PrevBlockHash)
+	e.writeBytes(b.Hash)
+	e.writeVarint(int64(b.Nonce))
+	e.writeVarint(b.Height)
+
+	e.writeUvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		tx.encode(e)
+	}
+}
+
+func (b *Block) decode(d *decoder) {
+	b.Timestamp = d.readVarint()
+	b.PrevBlockHash = d.readBytes()
+	b.Hash = d.readBytes()
+	b.Nonce = int(d.readVarint())
+	b.Height = d.readVarint()
+
+	count := d.readCount()
+	for i := 0; i < count && d.err == nil; i++ {
+		tx := &Transaction{}
+		tx.decode(d)
+		b.Transactions = append(b.Transactions, tx)
+	}
+}
+
+func (tx *Transaction) encode(e *encoder) {
+	tx.encodeBase(e)
+
+	for i := range tx.Vin {
+		tx.Vin[i].encodeWitness(e)
+	}
+}
+
+// 不包含 witness 的部分, 交易 ID 就是对这部分求 hash
+func (tx *Transaction) encodeBase(e *encoder) {
+	e.writeVarint(int64(tx.Version))
+
+	e.writeUvarint(uint64(len(tx.Vin)))
+	for i := range tx.Vin {
+		tx.Vin[i].encode(e)
+	}
+
+	e.writeUvarint(uint64(len(tx.Vout)))
+	for i := range tx.Vout {
+		tx.Vout[i].encode(e)
+	}
+
+	e.writeVarint(tx.LockTime)
+}
+
+func (tx *Transaction) decode(d *decoder) {
+	tx.Version = int(d.readVarint())
+
+	count := d.readCount()
+	for i := 0; i < count && d.err == nil; i++ {
+		var in TXInput
+		in.decode(d)
+		tx.Vin = append(tx.Vin, in)
+	}
+
+	count = d.readCount()
+	for i := 0; i < count && d.err == nil; i++ {
+		var out TXOutput
+		out.decode(d)
+		tx.Vout = append(tx.Vout, out)
+	}
+
+	tx.LockTime = d.readVarint()
+
+	for i := range tx.Vin {
+		tx.Vin[i].decodeWitness(d)
+	}
+
+	if d.err == nil {
+		tx.Hash()
+	}
+}
+
+func (in *TXInput) encode(e *encoder) {
+	e.writeBytes(in.Txid)
+	e.writeVarint(int64(in.Vout))
+	e.writeUvarint(uint64(in.Sequence))
+}
+
+func (in *TXInput) decode(d *decoder) {
+	in.Txid = d.readBytes()
+	in.Vout = int(d.readVarint())
+
+	sequence := d.readUvarint()
+	if sequence > maxSequence {
+		d.fail("sequence %d too large", sequence)
+	}
+	in.Sequence = uint32(sequence)
+}
+
+func (in *TXInput) encodeWitness(e *encoder) {
+	e.writeBytes(in.ScriptSig)
+}
+
+func (in *TXInput) decodeWitness(d *decoder) {
+	in.ScriptSig = d.readBytes()
+}
+
+func (out *TXOutput) encode(e *encoder) {
+	e.writeVarint(int64(out.Value))
+	e.writeBytes(out.ScriptPubKey)
+}
+
+func (out *TXOutput) decode(d *decoder) {
+	out.Value = int(d.readVarint())
+	out.ScriptPubKey = d.readBytes()
+}
+
+// 带版本号序列化, 供各个类型的 Serialize 使用
+func serializeVersioned(encode func(e *encoder)) []byte {
+	e := &encoder{}
+	e.writeByte(serializationVersion)
+	encode(e)
+	return e.Bytes()
+}
+
+// 检查版本号后反序列化, 数据不完整或者有多余的数据时返回错误
+func deserializeVersioned(data []byte, decode func(d *decoder)) error {
+	if len(data) == 0 {
+		return errors.New("decode: empty data")
+	}
+
+	d := &decoder{data: data}
+	d.readVersion()
+	decode(d)
+	return d.finish()
+}
@@ -5,9 +5,14 @@ import (
 	"net"
 	"log"
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
-	"encoding/hex"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 const (
@@ -23,6 +28,14 @@ var (
 	bc            *BlockChain                     // 当前节点的区块
 	blockMemPool  = make(map[string]*Block)       // 临时存储收到的区块
 	txMemPool     = make(map[string]*Transaction) // 临时存储收到的交易
+	txMemPoolLock sync.Mutex
+	prunedNodes   = make(map[string]int64)        // 裁剪了旧区块的节点 => 它裁剪到的高度
+
+	lightPeers     = make(map[string]*BloomFilter) // 轻节点 => 它发来的 filter
+	lightPeersLock sync.Mutex
+
+	pendingBlocks     = make(map[string]*partialBlock) // 区块 hash => 等待 blockTxn 的紧凑区块
+	pendingBlocksLock sync.Mutex
 )
 
 //  网络中的数据包
@@ -47,10 +60,59 @@ type getData struct {
 	Item []byte // ID
 }
 
+// 握手时交换的信息
+type blockHeight struct {
+	Height      int64
+	Pruned      bool  // 节点裁剪了旧区块, 不能向它请求 PruneHeight 及以下的区块
+	PruneHeight int64
+}
+
+// 轻节点请求区块头, Locator 见 LightChain.BlockLocator
+type getHeaders struct {
+	Locator [][]byte
+}
+
+// 发给轻节点的区块: 和它的 filter 匹配的交易, 以及每笔交易在区块中的证明
+type merkleBlock struct {
+	BlockHash []byte
+	Txs       [][]byte // 序列化后的交易
+	Proofs    [][]byte // 序列化后的 TxProof, 和 Txs 一一对应
+}
+
+// getcfilters 和 getcfheaders 请求, 主链上从 StartHeight 到 StopHash 的区块
+type getCFilters struct {
+	StartHeight int64
+	StopHash    []byte
+}
+
+// 一个区块的 compact filter
+type cFilter struct {
+	BlockHash []byte
+	Filter    []byte // 序列化后的 GCSFilter
+}
+
+// getcfheaders 的回复, 第 i 个区块的 filter header 为 filterHeader(FilterHashes[i], 前一个 filter header)
+type cfHeaders struct {
+	StopHash         []byte
+	PrevFilterHeader []byte
+	FilterHashes     [][]byte
+}
+
+// getTransaction 请求的回复
+type txInfo struct {
+	TxID          []byte
+	Transaction   []byte // 序列化后的交易, 没找到时为 nil
+	Confirmations int64
+	Error         string // 没找到并且还不能确定交易不在链上时的原因
+}
+
 func StartServer(nodeId, addr string) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeId)
 	walletAddress = addr
 	bc = NewBlockChain(walletAddress, nodeId)
+	go closeOnSignal()
+	go bc.syncSnapshotHistory(sendGetBlocksData)
+
 	if nodeAddress != centralNode {
 		//knownNodes = append(knownNodes, nodeAddress)
 		sendBlockHeight(centralNode)
@@ -73,6 +135,17 @@ func StartServer(nodeId, addr string) {
 
 }
 
+// 退出时关闭区块链, 把 UTXO 缓存写回数据库
+func closeOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	fmt.Println("Shutting down, flushing the UTXO cache")
+	bc.Close()
+	os.Exit(0)
+}
+
 func handleConn(conn net.Conn) {
 
 	reqData, err := ioutil.ReadAll(conn)
@@ -82,7 +155,10 @@ func handleConn(conn net.Conn) {
 	}
 
 	packet := &packet{}
-	GobDecode(reqData, packet)
+	if err := TryGobDecode(reqData, packet); err != nil {
+		fmt.Printf("Malformed packet from %s: %s, dropped\n", conn.RemoteAddr(), err)
+		return
+	}
 	command := packet.Command
 	//Version := packet.Version
 
@@ -102,6 +178,39 @@ func handleConn(conn net.Conn) {
 	case "block":
 		// 处理回复
 		handleReceivedBlock(packet)
+	case "tx":
+		// 处理回复
+		handleReceivedTx(packet)
+	case "getTransaction":
+		// 处理请求
+		handleGetTransactionReq(packet)
+	case "txInfo":
+		// 处理回复
+		handleReceivedTxInfo(packet)
+	case "notFound":
+		// 处理回复
+		handleNotFound(packet)
+	case "filterLoad":
+		// 处理请求
+		handleFilterLoad(packet)
+	case "getHeaders":
+		// 处理请求
+		handleGetHeadersReq(packet)
+	case "getcfilters":
+		// 处理请求
+		handleGetCFiltersReq(packet)
+	case "getcfheaders":
+		// 处理请求
+		handleGetCFHeadersReq(packet)
+	case "cmpctBlock":
+		// 处理回复
+		handleReceivedCompactBlock(packet)
+	case "getblocktxn":
+		// 处理请求
+		handleGetBlockTxnReq(packet)
+	case "blockTxn":
+		// 处理回复
+		handleReceivedBlockTxn(packet)
 	default:
 		fmt.Println("Unknown Command")
 	}
@@ -110,8 +219,25 @@ func handleConn(conn net.Conn) {
 // 处理收到一个块
 func handleReceivedBlock(packet *packet) {
 
-	var block *Block
-	GobDecode(packet.Data, block)
+	var blockData []byte
+	if err := TryGobDecode(packet.Data, &blockData); err != nil {
+		fmt.Printf("Malformed block from %s: %s, dropped\n", packet.SourAddress, err)
+		return
+	}
+	block, err := DeserializeBlock(blockData)
+	if err != nil {
+		fmt.Printf("Malformed block from %s: %s, dropped\n", packet.SourAddress, err)
+		return
+	}
+	processBlock(block, packet.SourAddress)
+}
+
+// 处理收到的完整区块或者还原出来的紧凑区块, source 是发来区块的节点
+func processBlock(block *Block, source string) {
+	// 从快照启动后下载的历史区块
+	if bc.addHistoryBlock(block) {
+		return
+	}
 
 	/*
 	收到一个区块时处理的步骤
@@ -132,12 +258,17 @@ func handleReceivedBlock(packet *packet) {
 	// heightDiff == 0(区块和我一样多) 直接丢去收到的区块
 
 	if heightDiff < 0 { // 区块比我少
-		sendBlockHeight(packet.SourAddress)
+		sendBlockHeight(source)
 
 	} else if heightDiff == 1 { // 刚好合适, 收到下一个区块
 		if verifyBlock(block) {
-			bc.AddBlock(block)
-
+			if err := bc.AddBlock(block); err != nil {
+				fmt.Printf("Block %x: %s, ignored\n", block.Hash, err)
+				return
+			}
+			announceHeader(block)
+			relayCompactBlock(block, source)
+			removeFromMemPool(block)
 		}
 
 	} else if heightDiff > 1 { // 区块比我多
@@ -150,7 +281,23 @@ func organizeBlockMemPool() {
 
 }
 
+// 交易 ID 是收到时重新算出来的, 区块 hash 又包含了交易 ID 的 Merkle root, 所以只要工作量证明正确, 区块中的交易就没有被修改过
+// 签名不在交易 ID 中, 由 coinbase 中的 witness commitment 保证没有被修改过
+// 交易的签名, 时间锁以及被花费的 output 在连接区块时检查
 func verifyBlock(block *Block) bool {
+	if !ValidateHeader(block.Header()) {
+		fmt.Printf("Block %x has an invalid hash, ignored\n", block.Hash)
+		return false
+	}
+	if block.MerkleTree().Mutated {
+		fmt.Printf("Block %x has duplicate transactions, ignored\n", block.Hash)
+		return false
+	}
+	if !block.CheckWitnessCommitment() {
+		fmt.Printf("Block %x has an invalid witness commitment, ignored\n", block.Hash)
+		return false
+	}
+
 	return true
 }
 
@@ -158,7 +305,11 @@ func verifyBlock(block *Block) bool {
 func handleGetBlocksReq(req *packet) {
 	var amount int64 // 要获取的区块的数量
 	GobDecode(req.Data, &amount)
-	hashes := bc.GetBlocksHash(amount)
+	hashes, err := bc.GetBlocksHash(amount)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	sendInv(req.SourAddress, &inv{"block", hashes})
 }
@@ -167,14 +318,16 @@ func handleGetBlocksReq(req *packet) {
 func handleGetDataReq(req *packet) {
 
 	getData := getData{}
-	GobDecode(req.Data, getData)
+	GobDecode(req.Data, &getData)
 
 	item := getData.Item
 	switch getData.Type {
 	case "block":
 		sendBlock(req.SourAddress, item)
+	case "filteredBlock":
+		sendMerkleBlock(req.SourAddress, item)
 	case "tx":
-		// 会有这种请求吗?!!
+		sendTx(req.SourAddress, item)
 	}
 }
 
@@ -193,7 +346,12 @@ func handleReceivedInv(packet *packet) {
 		// get block data from different node
 		sendGetBlocksData(items)
 	case "tx":
-
+		// 交易只向发来 inv 的节点请求, 别的节点不一定有
+		for _, txID := range items {
+			if !inMemPool(txID) {
+				sendNetworkPacket(buildNetworkPacket(packet.SourAddress, "getData", &getData{"tx", txID}))
+			}
+		}
 	default:
 		fmt.Println("Unknown type")
 	}
@@ -203,21 +361,21 @@ func sendGetBlocksData(hashes [][]byte) {
 
 	for _, hash := range hashes {
 
-		sendGetDataReq("block", hash)  // 每次随机选取一个已知节点发请求
+		sendGetDataReq(&getData{"block", hash}) // 每次随机选取一个已知节点发请求
 
 	}
 }
 
-// 随机选取一个已知节点发请求
-func sendGetDataReq(command string, date []byte) {
+// 随机选取一个已知节点发请求, 优先选没有裁剪过区块的节点
+func sendGetDataReq(data *getData) {
 
-	destAddr := GetRandomNodeAddr()
+	destAddr := GetRandomFullNodeAddr("")
 
 	if destAddr == "" {
 		log.Panic("No available node")
 	}
 
-	err := sendNetworkPacket(buildNetworkPacket(destAddr, command, date))
+	err := sendNetworkPacket(buildNetworkPacket(destAddr, "getData", data))
 
 	if err != nil {
 		knownNodes.Delete(destAddr)
@@ -225,55 +383,466 @@ func sendGetDataReq(command string, date []byte) {
 			log.Panic("No available node")
 		}
 
-		sendGetDataReq(command, date)
+		sendGetDataReq(data)
 	}
 }
 
+// 区块被裁剪或者不存在时回复 notFound, 让对方去别的节点获取
 func sendBlock(destAddr string, hash []byte) {
 
 	b := bc.GetBlock(hash)
+	if b == nil {
+		sendNetworkPacket(buildNetworkPacket(destAddr, "notFound", &getData{"block", hash}))
+		return
+	}
+
 	sendNetworkPacket(buildNetworkPacket(destAddr, "block", b.Serialize()))
 }
 
+// 交易池中没有这笔交易时 (已经被打包或者删除了) 不回复
+func sendTx(destAddr string, txID []byte) {
+	txMemPoolLock.Lock()
+	tx := txMemPool[hex.EncodeToString(txID)]
+	txMemPoolLock.Unlock()
+
+	if tx != nil {
+		sendNetworkPacket(buildNetworkPacket(destAddr, "tx", tx.Serialize()))
+	}
+}
+
+// 收到新交易, 验证通过之后放进交易池, 再把交易 ID 发给其他节点
+func handleReceivedTx(packet *packet) {
+	var txData []byte
+	if err := TryGobDecode(packet.Data, &txData); err != nil {
+		fmt.Printf("Malformed transaction from %s: %s, dropped\n", packet.SourAddress, err)
+		return
+	}
+	tx, err := DeserializeTransaction(txData)
+	if err != nil {
+		fmt.Printf("Malformed transaction from %s: %s, dropped\n", packet.SourAddress, err)
+		return
+	}
+
+	if err := acceptToMemPool(tx); err != nil {
+		fmt.Printf("Transaction %x from %s: %s, ignored\n", tx.ID, packet.SourAddress, err)
+		return
+	}
+	fmt.Printf("Transaction %x added to the memory pool\n", tx.ID)
+
+	for _, addr := range knownNodes.ToSlice() {
+		if addr != nodeAddress && addr != packet.SourAddress {
+			sendInv(addr, &inv{"tx", [][]byte{tx.ID}})
+		}
+	}
+}
+
+// 对方没有我们要的数据(比如区块已经被裁剪了), 换一个没有裁剪过的节点重新请求
+func handleNotFound(packet *packet) {
+	data := &getData{}
+	GobDecode(packet.Data, data)
+
+	fmt.Printf("%s doesn't have %s %x\n", packet.SourAddress, data.Type, data.Item)
+
+	if _, ok := prunedNodes[packet.SourAddress]; !ok {
+		prunedNodes[packet.SourAddress] = -1 // 不知道对方裁剪到了哪里
+	}
+
+	destAddr := GetRandomFullNodeAddr(packet.SourAddress)
+	if _, pruned := prunedNodes[destAddr]; destAddr == "" || pruned {
+		fmt.Printf("No full node has %s %x\n", data.Type, data.Item)
+		return
+	}
+
+	sendNetworkPacket(buildNetworkPacket(destAddr, "getData", data))
+}
+
+// 轻节点发来 filter, 以后只给它发和 filter 匹配的交易
+func handleFilterLoad(req *packet) {
+	filter := &BloomFilter{}
+	GobDecode(req.Data, filter)
+
+	if !filter.IsValid() {
+		fmt.Printf("Invalid bloom filter from %s, ignored\n", req.SourAddress)
+		return
+	}
+
+	lightPeersLock.Lock()
+	lightPeers[req.SourAddress] = filter
+	lightPeersLock.Unlock()
+}
+
+func handleGetHeadersReq(req *packet) {
+	data := &getHeaders{}
+	GobDecode(req.Data, data)
+
+	headers := bc.GetHeaders(data.Locator, maxHeadersPerMsg)
+	if len(headers) > 0 {
+		sendNetworkPacket(buildNetworkPacket(req.SourAddress, "headers", headers))
+	}
+}
+
+func handleGetCFiltersReq(req *packet) {
+	data := &getCFilters{}
+	GobDecode(req.Data, data)
+
+	filters, err := bc.GetCFilters(data.StartHeight, data.StopHash)
+	if err != nil {
+		fmt.Printf("Can't serve getcfilters from %s: %s\n", req.SourAddress, err)
+		return
+	}
+
+	sendNetworkPacket(buildNetworkPacket(req.SourAddress, "cfilters", filters))
+}
+
+func handleGetCFHeadersReq(req *packet) {
+	data := &getCFilters{}
+	GobDecode(req.Data, data)
+
+	headers, err := bc.GetCFHeaders(data.StartHeight, data.StopHash)
+	if err != nil {
+		fmt.Printf("Can't serve getcfheaders from %s: %s\n", req.SourAddress, err)
+		return
+	}
+
+	sendNetworkPacket(buildNetworkPacket(req.SourAddress, "cfheaders", headers))
+}
+
+// 没有 filter 或者区块已经被裁剪时回复 notFound, 轻节点会重新发送 filter 或者换一个节点
+func sendMerkleBlock(destAddr string, hash []byte) {
+	lightPeersLock.Lock()
+	filter := lightPeers[destAddr]
+	var mb *merkleBlock
+	if filter != nil {
+		mb = bc.newMerkleBlock(hash, filter) // 会更新 filter, 需要加锁
+	}
+	lightPeersLock.Unlock()
+
+	if mb == nil {
+		sendNetworkPacket(buildNetworkPacket(destAddr, "notFound", &getData{"filteredBlock", hash}))
+		return
+	}
+
+	sendNetworkPacket(buildNetworkPacket(destAddr, "merkleBlock", mb))
+}
+
+// 把新区块的区块头发给轻节点, 轻节点收到之后再来请求区块中匹配的交易
+func announceHeader(block *Block) {
+	lightPeersLock.Lock()
+	var peers []string
+	for addr := range lightPeers {
+		peers = append(peers, addr)
+	}
+	lightPeersLock.Unlock()
+
+	for _, addr := range peers {
+		if sendNetworkPacket(buildNetworkPacket(addr, "headers", []BlockHeader{*block.Header()})) != nil {
+			lightPeersLock.Lock()
+			delete(lightPeers, addr)
+			lightPeersLock.Unlock()
+		}
+	}
+}
+
+// 把新区块以紧凑区块的形式发给其他全节点, 不发回给 source
+func relayCompactBlock(block *Block, source string) {
+	cb := NewCompactBlock(block, randomNonce())
+
+	for _, addr := range knownNodes.ToSlice() {
+		if addr != nodeAddress && addr != source {
+			sendNetworkPacket(buildNetworkPacket(addr, "cmpctBlock", cb))
+		}
+	}
+}
+
+// 新区块的紧凑区块, 用交易池中的交易还原, 缺少的交易用 getblocktxn 向对方请求
+func handleReceivedCompactBlock(packet *packet) {
+	cb := &compactBlock{}
+	GobDecode(packet.Data, cb)
+	hash := cb.Header.Hash
+
+	if bc.hasBlock(hash) {
+		return
+	}
+	if !ValidateHeader(&cb.Header) {
+		fmt.Printf("Compact block %x has an invalid hash, ignored\n", hash)
+		return
+	}
+
+	// 没有接在主链末尾时 (比如中间缺了区块), 请求完整的区块按原来的方式处理
+	if !bytes.Equal(cb.Header.PrevBlockHash, bc.tip) {
+		sendNetworkPacket(buildNetworkPacket(packet.SourAddress, "getData", &getData{"block", hash}))
+		return
+	}
+
+	pb, err := newPartialBlock(cb, memPoolTxs())
+	if err != nil {
+		fmt.Printf("Invalid compact block from %s: %s\n", packet.SourAddress, err)
+		return
+	}
+
+	if len(pb.missing) > 0 {
+		pendingBlocksLock.Lock()
+		pendingBlocks[string(hash)] = pb
+		pendingBlocksLock.Unlock()
+
+		fmt.Printf("Compact block %x is missing %d transactions\n", hash, len(pb.missing))
+		sendNetworkPacket(buildNetworkPacket(packet.SourAddress, "getblocktxn", &getBlockTxn{hash, pb.missing}))
+		return
+	}
+
+	completeCompactBlock(pb, packet.SourAddress)
+}
+
+// 区块被裁剪或者不存在时回复 notFound, 下标不对时不回复
+func handleGetBlockTxnReq(req *packet) {
+	data := &getBlockTxn{}
+	GobDecode(req.Data, data)
+
+	block := bc.GetBlock(data.BlockHash)
+	if block == nil {
+		sendNetworkPacket(buildNetworkPacket(req.SourAddress, "notFound", &getData{"block", data.BlockHash}))
+		return
+	}
+
+	txn := &blockTxn{BlockHash: data.BlockHash}
+	for _, index := range data.Indexes {
+		if index < 0 || index >= len(block.Transactions) {
+			fmt.Printf("Bad transaction index %d in getblocktxn from %s, ignored\n", index, req.SourAddress)
+			return
+		}
+		txn.Txs = append(txn.Txs, block.Transactions[index].Serialize())
+	}
+
+	sendNetworkPacket(buildNetworkPacket(req.SourAddress, "blockTxn", txn))
+}
+
+func handleReceivedBlockTxn(packet *packet) {
+	txn := &blockTxn{}
+	GobDecode(packet.Data, txn)
+
+	pendingBlocksLock.Lock()
+	pb := pendingBlocks[string(txn.BlockHash)]
+	delete(pendingBlocks, string(txn.BlockHash))
+	pendingBlocksLock.Unlock()
+
+	if pb == nil {
+		return
+	}
+
+	if err := pb.fill(txn); err != nil {
+		fmt.Printf("Invalid blockTxn from %s: %s, requesting the full block\n", packet.SourAddress, err)
+		sendNetworkPacket(buildNetworkPacket(packet.SourAddress, "getData", &getData{"block", txn.BlockHash}))
+		return
+	}
+
+	completeCompactBlock(pb, packet.SourAddress)
+}
+
+// 交易都齐了之后和收到完整区块一样处理, 短 ID 冲突导致还原出的交易不对时请求完整的区块
+func completeCompactBlock(pb *partialBlock, source string) {
+	block, err := pb.block()
+	if err != nil {
+		fmt.Printf("%s, requesting the full block\n", err)
+		sendNetworkPacket(buildNetworkPacket(source, "getData", &getData{"block", pb.header.Hash}))
+		return
+	}
+
+	processBlock(block, source)
+}
+
+func memPoolTxs() []*Transaction {
+	txMemPoolLock.Lock()
+	defer txMemPoolLock.Unlock()
+
+	txs := make([]*Transaction, 0, len(txMemPool))
+	for _, tx := range txMemPool {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+func inMemPool(txID []byte) bool {
+	txMemPoolLock.Lock()
+	defer txMemPoolLock.Unlock()
+
+	_, ok := txMemPool[hex.EncodeToString(txID)]
+	return ok
+}
+
+// 交易进入交易池之前的检查: 被花费的 output 在 UTXO 集中, 时间锁和签名都满足 (VerifyTx)
+// 并且没有和交易池中的其他交易花费同一个 output, 验证过的签名会放进 sigCache, 区块到达时不用重新验证
+func acceptToMemPool(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return errors.New("coinbase transaction")
+	}
+
+	txMemPoolLock.Lock()
+	defer txMemPoolLock.Unlock()
+
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := txMemPool[txID]; ok {
+		return errors.New("already in the memory pool")
+	}
+	for _, other := range txMemPool {
+		if spendsSameOutput(tx, other) {
+			return fmt.Errorf("conflicts with transaction %x in the memory pool", other.ID)
+		}
+	}
+	if !bc.VerifyTx(tx) {
+		return errors.New("invalid transaction")
+	}
+
+	txMemPool[txID] = tx
+	return nil
+}
+
+func spendsSameOutput(a, b *Transaction) bool {
+	for _, inA := range a.Vin {
+		for _, inB := range b.Vin {
+			if inA.Vout == inB.Vout && bytes.Equal(inA.Txid, inB.Txid) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 已经打包进区块的交易, 以及和区块中的交易花费同一个 output 的交易从交易池中删除
+func removeFromMemPool(block *Block) {
+	txMemPoolLock.Lock()
+	defer txMemPoolLock.Unlock()
+
+	for _, tx := range block.Transactions {
+		delete(txMemPool, hex.EncodeToString(tx.ID))
+	}
+
+	for id, tx := range txMemPool {
+		for _, blockTx := range block.Transactions {
+			if !blockTx.IsCoinbase() && spendsSameOutput(tx, blockTx) {
+				delete(txMemPool, id)
+				break
+			}
+		}
+	}
+}
+
 func sendInv(destAddr string, inv *inv) {
 	sendNetworkPacket(buildNetworkPacket(destAddr, "inv", inv))
 }
 
 func handleBlockHeightReq(packet *packet) {
-	var height int64
-	GobDecode(packet.Data, &height)
+	info := &blockHeight{}
+	GobDecode(packet.Data, info)
+	height := info.Height
+
+	if info.Pruned {
+		prunedNodes[packet.SourAddress] = info.PruneHeight
+	} else {
+		delete(prunedNodes, packet.SourAddress)
+	}
+
+	if !knownNodes.Contains(packet.SourAddress) {
+		knownNodes.Add(packet.SourAddress)
+	}
 
 	myHeight := bc.GetBestHeight()
 
 	if myHeight > height {
-		sendBlockHeight(nodeAddress) // 把我的区块高度发给他
+		sendBlockHeight(packet.SourAddress) // 把我的区块高度发给他
 	} else if myHeight < height {
 		sendGetBlocks(height-myHeight+6) // 如果比我的多, 请求他的区块
 	}
-
-	if !knownNodes.Contains(packet.SourAddress) {
-		knownNodes.Add(packet.SourAddress)
-	}
 }
 
 // 根据手续费排序
 func sortTx() []*Transaction {
 
+	txMemPoolLock.Lock()
+	defer txMemPoolLock.Unlock()
+
 	var s []*Transaction
 
 	for id, tx := range txMemPool {
 		if bc.VerifyTx(tx) {
-
+			s = append(s, tx)
 		} else {
 			delete(txMemPool, id)
 		}
 	}
+
+	return s
+}
+
+// 通过交易索引查找交易, 把交易和确认数发回去
+func handleGetTransactionReq(req *packet) {
+	var txID []byte
+	GobDecode(req.Data, &txID)
+
+	info := txInfo{TxID: txID}
+	tx, confirmations, err := bc.GetTransaction(txID)
+	if err != nil {
+		info.Error = err.Error()
+	}
+	if tx != nil {
+		info.Transaction = tx.Serialize()
+		info.Confirmations = confirmations
+	}
+
+	sendNetworkPacket(buildNetworkPacket(req.SourAddress, "txInfo", info))
+}
+
+func handleReceivedTxInfo(packet *packet) {
+	info := &txInfo{}
+	if err := TryGobDecode(packet.Data, info); err != nil {
+		fmt.Printf("Malformed txInfo from %s: %s, dropped\n", packet.SourAddress, err)
+		return
+	}
+
+	if info.Transaction == nil && info.Error != "" {
+		fmt.Printf("Transaction %x not found on %s: %s\n", info.TxID, packet.SourAddress, info.Error)
+		return
+	}
+	if info.Transaction == nil {
+		fmt.Printf("Transaction %x not found on %s\n", info.TxID, packet.SourAddress)
+		return
+	}
+
+	// 交易 ID 是反序列化时重新算出来的, 和请求的不一致说明对方发来的交易是错的
+	tx, err := DeserializeTransaction(info.Transaction)
+	if err != nil {
+		fmt.Printf("Malformed transaction from %s: %s, dropped\n", packet.SourAddress, err)
+		return
+	}
+	if !bytes.Equal(tx.ID, info.TxID) {
+		fmt.Printf("Transaction from %s doesn't match the requested ID %x, got %x\n", packet.SourAddress, info.TxID, tx.ID)
+		return
+	}
+
+	fmt.Println(tx)
+	fmt.Printf("Confirmations: %d\n", info.Confirmations)
 }
 
 func GetRandomNodeAddr() string {
 	return knownNodes.GetRandomElement()
 }
 
+// 随机选取一个没有裁剪过区块的节点, 都裁剪过时随便选一个, except 不会被选中
+func GetRandomFullNodeAddr(except string) string {
+	fallback := ""
+
+	for addr := range knownNodes {
+		if addr == except {
+			continue
+		}
+		if _, pruned := prunedNodes[addr]; !pruned {
+			return addr
+		}
+		fallback = addr
+	}
+
+	return fallback
+}
+
 func sendGetBlocks(amount int64) {
 
 	destAddr := GetRandomNodeAddr()
@@ -287,8 +856,9 @@ func sendGetBlocks(amount int64) {
 // 用于交换两个节点间的区块高度
 func sendBlockHeight(destAddr string) {
 
-	height := bc.GetBestHeight()
-	packet := buildNetworkPacket(destAddr, "blockHeight", height)
+	pruneHeight := bc.PruneHeight()
+	info := &blockHeight{bc.GetBestHeight(), pruneHeight >= 0, pruneHeight}
+	packet := buildNetworkPacket(destAddr, "blockHeight", info)
 
 	sendNetworkPacket(packet)
 
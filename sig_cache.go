@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// 已经验证通过的签名, 交易进入交易池时验证过的签名, 在区块中再出现时不用重新验证
+// 满了之后随机删除一个, 别人没法预测哪些签名会被删掉
+const maxSigCacheEntries = 50000
+
+var sigCache = NewSigCache(maxSigCacheEntries)
+
+type SigCache struct {
+	entries    map[[sha256.Size]byte]struct{}
+	maxEntries int
+	lock       sync.RWMutex
+}
+
+func NewSigCache(maxEntries int) *SigCache {
+	return &SigCache{entries: make(map[[sha256.Size]byte]struct{}), maxEntries: maxEntries}
+}
+
+// 公钥和签名的长度都不固定, 公钥前面加上长度, 避免两者的边界不同时得到同样的 key
+func sigCacheKey(sigHash, pubKey, sig []byte) [sha256.Size]byte {
+	data := append(append([]byte{}, sigHash...), byte(len(pubKey)))
+	data = append(append(data, pubKey...), sig...)
+	return sha256.Sum256(data)
+}
+
+func (c *SigCache) Contains(sigHash, pubKey, sig []byte) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	_, ok := c.entries[sigCacheKey(sigHash, pubKey, sig)]
+	return ok
+}
+
+func (c *SigCache) Add(sigHash, pubKey, sig []byte) {
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := sigCacheKey(sigHash, pubKey, sig)
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+
+	// map 的遍历顺序是随机的
+	for len(c.entries) >= c.maxEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = struct{}{}
+}
+
+func (c *SigCache) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.entries)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"fmt"
+	"log"
+	"math/big"
+)
+
+// 签名方案, 公钥的第一个字节是签名方案, 后面是固定长度的公钥, 所以公钥 hash (地址) 确定了签名方案
+// ECDSA 签名用 DER 编码, s 必须是较小的那个 (否则把 s 换成 n-s 签名仍然有效), Schnorr 签名固定 64 字节
+// 没有签名方案字节的公钥是旧版本的 P-256 公钥 X||Y, 签名是 r||s, 只用来验证已有的交易
+type SigScheme byte
+
+const (
+	SigSchemeP256      SigScheme = 0x01 // P-256 ECDSA, 公钥 X||Y 各 32 字节
+	SigSchemeSecp256k1 SigScheme = 0x02 // secp256k1 ECDSA, 33 字节的压缩公钥
+	SigSchemeSchnorr   SigScheme = 0x03 // secp256k1 BIP340 Schnorr, 32 字节的 x-only 公钥
+
+	defaultSigScheme = SigSchemeSchnorr
+)
+
+type signatureScheme interface {
+	Name() string
+	AddressVersion() byte            // P2PKH 地址的版本
+	PubKeyLen() int                  // 不包括签名方案字节
+	NewPrivateKey() []byte           // 32 字节
+	PublicKey(privKey []byte) []byte // 不包括签名方案字节
+	Sign(privKey, hash []byte) []byte
+	Verify(pubKey, sig, hash []byte) bool // pubKey 不包括签名方案字节
+}
+
+var signatureSchemes = map[SigScheme]signatureScheme{
+	SigSchemeP256:      p256ECDSA{},
+	SigSchemeSecp256k1: secp256k1ECDSA{},
+	SigSchemeSchnorr:   schnorrScheme{},
+}
+
+func (s SigScheme) impl() signatureScheme {
+	impl, ok := signatureSchemes[s]
+	if !ok {
+		log.Panicf("ERROR: Unknown signature scheme %d", s)
+	}
+	return impl
+}
+
+func (s SigScheme) String() string {
+	if impl, ok := signatureSchemes[s]; ok {
+		return impl.Name()
+	}
+	return fmt.Sprintf("unknown(%d)", byte(s))
+}
+
+func ParseSigScheme(name string) (SigScheme, error) {
+	for scheme, impl := range signatureSchemes {
+		if impl.Name() == name {
+			return scheme, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown signature scheme '%s', use p256, secp256k1 or schnorr", name)
+}
+
+// 地址版本对应的签名方案, 不是 P2PKH 地址时返回 false
+func sigSchemeForAddress(addrVersion byte) (SigScheme, bool) {
+	for scheme, impl := range signatureSchemes {
+		if impl.AddressVersion() == addrVersion {
+			return scheme, true
+		}
+	}
+	return 0, false
+}
+
+func isP2PKHVersion(addrVersion byte) bool {
+	_, ok := sigSchemeForAddress(addrVersion)
+	return ok
+}
+
+// 公钥的签名方案和去掉签名方案字节之后的公钥, 不是带签名方案的公钥时返回 false
+func parsePubKey(pubKey []byte) (SigScheme, []byte, bool) {
+	if len(pubKey) == 0 {
+		return 0, nil, false
+	}
+
+	scheme := SigScheme(pubKey[0])
+	impl, ok := signatureSchemes[scheme]
+	if !ok || len(pubKey)-1 != impl.PubKeyLen() {
+		return 0, nil, false
+	}
+	return scheme, pubKey[1:], true
+}
+
+func verifySignature(pubKey, sig, hash []byte) bool {
+	if scheme, key, ok := parsePubKey(pubKey); ok {
+		return scheme.impl().Verify(key, sig, hash)
+	}
+	return verifyLegacySignature(pubKey, sig, hash)
+}
+
+// 旧版本的公钥是 X 和 Y 拼在一起, 签名是 r 和 s 拼在一起, 有前导 0 时长度不固定
+func verifyLegacySignature(pubKey, sig, hash []byte) bool {
+	if len(pubKey) == 0 || len(sig) == 0 {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(sig[:len(sig)/2])
+	s := new(big.Int).SetBytes(sig[len(sig)/2:])
+
+	x := new(big.Int).SetBytes(pubKey[:len(pubKey)/2])
+	y := new(big.Int).SetBytes(pubKey[len(pubKey)/2:])
+
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	return elliptic.P256().IsOnCurve(x, y) && ecdsa.Verify(&rawPubKey, hash, r, s)
+}
+
+// 私钥和它的签名方案
+type PrivateKey struct {
+	Scheme SigScheme
+	D      []byte // 32 字节
+}
+
+func NewPrivateKey(scheme SigScheme) PrivateKey {
+	return PrivateKey{scheme, scheme.impl().NewPrivateKey()}
+}
+
+// 带签名方案字节的公钥, 放在 ScriptSig 和多重签名脚本中
+func (k PrivateKey) PublicKey() []byte {
+	return append([]byte{byte(k.Scheme)}, k.Scheme.impl().PublicKey(k.D)...)
+}
+
+func (k PrivateKey) Sign(hash []byte) []byte {
+	return k.Scheme.impl().Sign(k.D, hash)
+}
+
+// [1, n-1] 中的随机数
+func randomScalar(n *big.Int) []byte {
+	k, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1)))
+	if err != nil {
+		log.Panic(err)
+	}
+	return bytes32(k.Add(k, big.NewInt(1)))
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// s 取 s 和 n-s 中较小的那个
+func encodeECDSASignature(r, s, n *big.Int) []byte {
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s = new(big.Int).Sub(n, s)
+	}
+
+	sig, err := asn1.Marshal(ecdsaSignature{r, s})
+	if err != nil {
+		log.Panic(err)
+	}
+	return sig
+}
+
+// 只接受标准的 DER 编码 (重新编码之后完全一样), r 和 s 在 [1, n-1] 中, 并且 s 是较小的那个
+func parseECDSASignature(sig []byte, n *big.Int) (*big.Int, *big.Int, bool) {
+	var parsed ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &parsed)
+	if err != nil || len(rest) > 0 {
+		return nil, nil, false
+	}
+
+	if encoded, err := asn1.Marshal(parsed); err != nil || !bytes.Equal(encoded, sig) {
+		return nil, nil, false
+	}
+
+	r, s := parsed.R, parsed.S
+	if r.Sign() <= 0 || r.Cmp(n) >= 0 || s.Sign() <= 0 || s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		return nil, nil, false
+	}
+	return r, s, true
+}
+
+type p256ECDSA struct{}
+
+func (p256ECDSA) Name() string         { return "p256" }
+func (p256ECDSA) AddressVersion() byte { return version }
+func (p256ECDSA) PubKeyLen() int       { return 64 }
+
+func (p256ECDSA) NewPrivateKey() []byte {
+	return randomScalar(elliptic.P256().Params().N)
+}
+
+func (p256ECDSA) PublicKey(privKey []byte) []byte {
+	x, y := elliptic.P256().ScalarBaseMult(privKey)
+	return append(bytes32(x), bytes32(y)...)
+}
+
+func (p256ECDSA) Sign(privKey, hash []byte) []byte {
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(privKey)
+	key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y}, D: new(big.Int).SetBytes(privKey)}
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		log.Panic(err)
+	}
+	return encodeECDSASignature(r, s, curve.Params().N)
+}
+
+func (p256ECDSA) Verify(pubKey, sig, hash []byte) bool {
+	curve := elliptic.P256()
+	r, s, ok := parseECDSASignature(sig, curve.Params().N)
+	if !ok {
+		return false
+	}
+
+	x := new(big.Int).SetBytes(pubKey[:32])
+	y := new(big.Int).SetBytes(pubKey[32:])
+	if !curve.IsOnCurve(x, y) {
+		return false
+	}
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, hash, r, s)
+}
+
+type secp256k1ECDSA struct{}
+
+func (secp256k1ECDSA) Name() string         { return "secp256k1" }
+func (secp256k1ECDSA) AddressVersion() byte { return secp256k1Version }
+func (secp256k1ECDSA) PubKeyLen() int       { return 33 }
+
+func (secp256k1ECDSA) NewPrivateKey() []byte {
+	return randomScalar(secp256k1N)
+}
+
+func (secp256k1ECDSA) PublicKey(privKey []byte) []byte {
+	return compressPoint(scalarBaseMult(new(big.Int).SetBytes(privKey)))
+}
+
+// s = (hash + r*d) / k
+func (secp256k1ECDSA) Sign(privKey, hash []byte) []byte {
+	d := new(big.Int).SetBytes(privKey)
+	e := new(big.Int).SetBytes(hash)
+
+	for {
+		k := new(big.Int).SetBytes(randomScalar(secp256k1N))
+		r := new(big.Int).Mod(scalarBaseMult(k).x, secp256k1N)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		s := new(big.Int).Mul(r, d)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(k, secp256k1N))
+		s.Mod(s, secp256k1N)
+		if s.Sign() == 0 {
+			continue
+		}
+		return encodeECDSASignature(r, s, secp256k1N)
+	}
+}
+
+// (hash/s)*G + (r/s)*P 的 x 坐标等于 r
+func (secp256k1ECDSA) Verify(pubKey, sig, hash []byte) bool {
+	r, s, ok := parseECDSASignature(sig, secp256k1N)
+	if !ok {
+		return false
+	}
+	p := decompressPoint(pubKey)
+	if p == nil {
+		return false
+	}
+
+	w := new(big.Int).ModInverse(s, secp256k1N)
+	u1 := new(big.Int).Mul(new(big.Int).SetBytes(hash), w)
+	u1.Mod(u1, secp256k1N)
+	u2 := new(big.Int).Mul(r, w)
+	u2.Mod(u2, secp256k1N)
+
+	R := multiScalarMult([]*curvePoint{secp256k1G, p}, []*big.Int{u1, u2})
+	return !R.isInfinity() && new(big.Int).Mod(R.x, secp256k1N).Cmp(r) == 0
+}
+
+type schnorrScheme struct{}
+
+func (schnorrScheme) Name() string         { return "schnorr" }
+func (schnorrScheme) AddressVersion() byte { return schnorrVersion }
+func (schnorrScheme) PubKeyLen() int       { return 32 }
+
+func (schnorrScheme) NewPrivateKey() []byte {
+	return randomScalar(secp256k1N)
+}
+
+func (schnorrScheme) PublicKey(privKey []byte) []byte {
+	return schnorrPubKey(privKey)
+}
+
+func (schnorrScheme) Sign(privKey, hash []byte) []byte {
+	aux := make([]byte, 32)
+	if _, err := rand.Read(aux); err != nil {
+		log.Panic(err)
+	}
+	return schnorrSign(privKey, hash, aux)
+}
+
+func (schnorrScheme) Verify(pubKey, sig, hash []byte) bool {
+	return schnorrVerify(pubKey, hash, sig)
+}
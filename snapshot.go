@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// 快照文件格式, 整数都是大端序, []byte 前面是 4 字节的长度:
+//
+//	magic(4) + version(1)
+//	区块头数量(8) + 从创世区块到快照区块的所有区块头
+//	UTXO 数量(8) + 按 (txid, vout) 排序的 UTXO: txid + vout(4) + 所在区块的高度(8) + value(8) + ScriptPubKey
+//	commitment(32): 按顺序对每个 UTXO 序列化之后的数据求 sha256
+const (
+	snapshotVersion      = 3
+	snapshotMaxItemSize  = 1024 * 1024 // 文件中单个 []byte 的最大长度, 防止读到损坏的长度时分配太多内存
+	snapshotLoadBatch    = 10000       // 加载快照时每个事务写入的 UTXO 数量
+	snapshotHistoryBatch = 100         // 每次向其他节点请求的历史区块数量
+	snapshotHistoryRetry = 10 * time.Second
+)
+
+var (
+	snapshotMagic = []byte("utxo")
+	snapshotKey   = []byte("snapshot") // metaBucket 中, 从快照启动并且历史区块还没有验证完时存在
+)
+
+type utxoSnapshotInfo struct {
+	BlockHash  []byte
+	Height     int64
+	Coins      int64
+	Commitment []byte
+}
+
+// 出错之后后面的写入都会被忽略, 最后检查 err 就可以
+type snapshotWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *snapshotWriter) write(v interface{}) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.BigEndian, v)
+	}
+}
+
+func (sw *snapshotWriter) writeRaw(data []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(data)
+	}
+}
+
+func (sw *snapshotWriter) writeBytes(data []byte) {
+	sw.write(uint32(len(data)))
+	sw.writeRaw(data)
+}
+
+func (sw *snapshotWriter) writeHeader(header *BlockHeader) {
+	sw.write(header.Timestamp)
+	sw.writeBytes(header.PrevBlockHash)
+	sw.writeBytes(header.Hash)
+	sw.writeBytes(header.TxsHash)
+	sw.write(int64(header.Nonce))
+	sw.write(header.Height)
+}
+
+type snapshotReader struct {
+	r   io.Reader
+	err error
+}
+
+func (sr *snapshotReader) read(v interface{}) {
+	if sr.err == nil {
+		sr.err = binary.Read(sr.r, binary.BigEndian, v)
+	}
+}
+
+func (sr *snapshotReader) readRaw(n int) []byte {
+	data := make([]byte, n)
+	if sr.err == nil {
+		_, sr.err = io.ReadFull(sr.r, data)
+	}
+	return data
+}
+
+func (sr *snapshotReader) readBytes() []byte {
+	var size uint32
+	sr.read(&size)
+	if sr.err == nil && size > snapshotMaxItemSize {
+		sr.err = fmt.Errorf("snapshot: item too large (%d bytes)", size)
+	}
+	if sr.err != nil {
+		return nil
+	}
+	return sr.readRaw(int(size))
+}
+
+func (sr *snapshotReader) readHeader() *BlockHeader {
+	header := &BlockHeader{}
+	var nonce int64
+
+	sr.read(&header.Timestamp)
+	header.PrevBlockHash = sr.readBytes()
+	header.Hash = sr.readBytes()
+	header.TxsHash = sr.readBytes()
+	sr.read(&nonce)
+	sr.read(&header.Height)
+
+	header.Nonce = int(nonce)
+	return header
+}
+
+func (sr *snapshotReader) readCoin() ([]byte, int, int64, TXOutput, []byte) {
+	var outIdx uint32
+	var height, value int64
+
+	txID := sr.readBytes()
+	sr.read(&outIdx)
+	sr.read(&height)
+	sr.read(&value)
+	scriptPubKey := sr.readBytes()
+
+	out := TXOutput{int(value), scriptPubKey}
+	return txID, int(outIdx), height, out, encodeSnapshotCoin(txID, int(outIdx), height, out)
+}
+
+// 单个 UTXO 在快照中的编码, commitment 就是对这些数据求 hash
+// 高度也在 commitment 中, 从快照启动的节点检查相对时间锁时和重放整条链的节点结果一样
+func encodeSnapshotCoin(txID []byte, outIdx int, height int64, out TXOutput) []byte {
+	var buf bytes.Buffer
+	sw := &snapshotWriter{w: &buf}
+
+	sw.writeBytes(txID)
+	sw.write(uint32(outIdx))
+	sw.write(height)
+	sw.write(int64(out.Value))
+	sw.writeBytes(out.ScriptPubKey)
+
+	return buf.Bytes()
+}
+
+func sortedOutIdxs(outs TXOutputs) []int {
+	var idxs []int
+	for outIdx := range outs {
+		idxs = append(idxs, outIdx)
+	}
+	sort.Ints(idxs)
+	return idxs
+}
+
+// 计算 UTXO 集的 commitment, utxos 和 heights 的 key 是 hex 编码的 txid, hex 的顺序和字节的顺序一致
+func utxoCommitment(utxos map[string]TXOutputs, heights map[string]int64) []byte {
+	var txIDs []string
+	for txID := range utxos {
+		txIDs = append(txIDs, txID)
+	}
+	sort.Strings(txIDs)
+
+	hasher := sha256.New()
+	for _, txID := range txIDs {
+		id, _ := hex.DecodeString(txID)
+		for _, outIdx := range sortedOutIdxs(utxos[txID]) {
+			hasher.Write(encodeSnapshotCoin(id, outIdx, heights[txID], utxos[txID][outIdx]))
+		}
+	}
+
+	return hasher.Sum(nil)
+}
+
+// 把 UTXO 集和它对应的区块(以及之前的所有区块头)写到文件中
+func (bc *BlockChain) DumpUTXOSet(path string) (*utxoSnapshotInfo, error) {
+	bc.utxoSet.Flush() // 下面直接读数据库中的 UTXO 集
+
+	best := bc.utxoSet.BestBlock()
+	header := bc.GetBlockHeader(best)
+	if header == nil || !bytes.Equal(bc.GetBlockHash(header.Height), best) {
+		return nil, errors.New("snapshot: the UTXO set is not at a main chain block")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	sw := &snapshotWriter{w: w}
+	sw.writeRaw(snapshotMagic)
+	sw.write(uint8(snapshotVersion))
+
+	sw.write(header.Height + 1)
+	for height := int64(0); height <= header.Height; height++ {
+		sw.writeHeader(bc.GetBlockHeader(bc.GetBlockHash(height)))
+	}
+
+	info := &utxoSnapshotInfo{BlockHash: best, Height: header.Height}
+	hasher := sha256.New()
+
+	bc.db.View(func(tx StorageTx) error {
+		bucket := tx.Bucket([]byte(utxoSetBucket))
+
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			info.Coins += int64(len(deserializeUTXOEntry(value).Outs))
+		}
+		sw.write(info.Coins)
+
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			entry := deserializeUTXOEntry(value)
+			for _, outIdx := range sortedOutIdxs(entry.Outs) {
+				coin := encodeSnapshotCoin(key, outIdx, entry.Height, entry.Outs[outIdx])
+				sw.writeRaw(coin)
+				hasher.Write(coin)
+			}
+		}
+		return nil
+	})
+
+	info.Commitment = hasher.Sum(nil)
+	sw.writeRaw(info.Commitment)
+
+	if sw.err == nil {
+		sw.err = w.Flush()
+	}
+	if sw.err != nil {
+		return nil, sw.err
+	}
+
+	return info, nil
+}
+
+// 解析快照文件, 校验区块头和 commitment, coinFn 为 nil 时只校验
+func readUTXOSnapshot(path string, coinFn func(txID []byte, outIdx int, height int64, out TXOutput) error) (*utxoSnapshotInfo, []*BlockHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	sr := &snapshotReader{r: bufio.NewReader(f)}
+
+	var version uint8
+	magic := sr.readRaw(len(snapshotMagic))
+	sr.read(&version)
+	if sr.err == nil && (!bytes.Equal(magic, snapshotMagic) || version != snapshotVersion) {
+		return nil, nil, fmt.Errorf("snapshot: not a version %d UTXO snapshot", snapshotVersion)
+	}
+
+	var headerCount int64
+	sr.read(&headerCount)
+	if sr.err == nil && headerCount <= 0 {
+		return nil, nil, errors.New("snapshot: no block headers")
+	}
+
+	// 区块头必须从创世区块开始连成一条链, 并且都有工作量证明
+	var headers []*BlockHeader
+	for height := int64(0); height < headerCount && sr.err == nil; height++ {
+		header := sr.readHeader()
+		if sr.err != nil {
+			break
+		}
+
+		if header.Height != height || !ValidateHeader(header) {
+			return nil, nil, fmt.Errorf("snapshot: invalid block header at height %d", height)
+		}
+		if height > 0 && !bytes.Equal(header.PrevBlockHash, headers[height-1].Hash) {
+			return nil, nil, fmt.Errorf("snapshot: block header at height %d doesn't link to the previous one", height)
+		}
+		headers = append(headers, header)
+	}
+
+	var coins int64
+	sr.read(&coins)
+
+	hasher := sha256.New()
+	for i := int64(0); i < coins && sr.err == nil; i++ {
+		txID, outIdx, height, out, coin := sr.readCoin()
+		if sr.err != nil {
+			break
+		}
+		hasher.Write(coin)
+
+		if coinFn != nil {
+			if err := coinFn(txID, outIdx, height, out); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	commitment := sr.readRaw(sha256.Size)
+	if sr.err != nil {
+		return nil, nil, fmt.Errorf("snapshot: %s", sr.err)
+	}
+
+	info := &utxoSnapshotInfo{headers[len(headers)-1].Hash, headerCount - 1, coins, hasher.Sum(nil)}
+	if !bytes.Equal(commitment, info.Commitment) {
+		return nil, nil, errors.New("snapshot: UTXO set doesn't match the commitment in the file")
+	}
+
+	return info, headers, nil
+}
+
+// 用快照创建区块链: 快照必须在 ChainParams.AssumeUTXO 中, 存储中不能已经有区块链
+// 快照之前的区块只有区块头, 和裁剪过的区块一样, 启动节点之后在后台下载并验证
+func LoadUTXOSnapshot(db Storage, files BlockFiles, path string) (*BlockChain, error) {
+	info, headers, err := readUTXOSnapshot(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	assumed := activeChainParams.FindAssumeUTXO(info.Height, hex.EncodeToString(info.BlockHash))
+	if assumed == nil {
+		return nil, fmt.Errorf("snapshot: block %x at height %d is not in the %s chain params", info.BlockHash, info.Height, activeChainParams.Name)
+	}
+	if assumed.Commitment != hex.EncodeToString(info.Commitment) {
+		return nil, fmt.Errorf("snapshot: commitment %x doesn't match the chain params", info.Commitment)
+	}
+
+	err = db.Update(func(tx StorageTx) error {
+		if tx.Bucket(blocksBucket) != nil {
+			return errors.New("snapshot: a blockchain already exists")
+		}
+
+		// 交易索引在快照之前的区块验证完之后才能建
+		buckets := [][]byte{blocksBucket, metaBucket, []byte(heightIndexBucket), []byte(utxoSetBucket),
+			[]byte(addrUtxoBucket), []byte(addrHistoryBucket)}
+		for _, name := range buckets {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+
+		blocks := tx.Bucket(blocksBucket)
+		heights := tx.Bucket([]byte(heightIndexBucket))
+		for _, header := range headers {
+			entry := blockIndexEntry{Header: *header, Pruned: true}
+			if err := blocks.Put(header.Hash, entry.Serialize()); err != nil {
+				return err
+			}
+			if err := heights.Put(IntToHex(header.Height), header.Hash); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if err := meta.Put(tipKey, info.BlockHash); err != nil {
+			return err
+		}
+		if err := meta.Put(pruneHeightKey, GobEncode(info.Height)); err != nil {
+			return err
+		}
+		if err := meta.Put(snapshotKey, GobEncode(info)); err != nil {
+			return err
+		}
+		return putSchemaVersion(tx, schemaVersion)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 同一笔交易的 output 是连续的, 但可能被分到两批中, 所以写入时和已经写入的合并
+	batch := make(map[string]*utxoEntry)
+	batchSize := 0
+	writeBatch := func() error {
+		err := db.Update(func(tx StorageTx) error {
+			bucket := tx.Bucket([]byte(utxoSetBucket))
+			addrBucket := tx.Bucket([]byte(addrUtxoBucket))
+
+			for key, entry := range batch {
+				txID := []byte(key)
+				if value := bucket.Get(txID); value != nil {
+					for outIdx, out := range deserializeUTXOEntry(value).Outs {
+						entry.Outs[outIdx] = out
+					}
+				}
+
+				if err := bucket.Put(txID, entry.Serialize()); err != nil {
+					return err
+				}
+				for outIdx, out := range entry.Outs {
+					if err := putAddrUtxo(addrBucket, txID, outIdx, out); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+
+		batch = make(map[string]*utxoEntry)
+		batchSize = 0
+		return err
+	}
+
+	progress := &progressReporter{}
+	progress.Start("load UTXO snapshot", int(info.Coins))
+
+	_, _, err = readUTXOSnapshot(path, func(txID []byte, outIdx int, height int64, out TXOutput) error {
+		if batch[string(txID)] == nil {
+			batch[string(txID)] = &utxoEntry{height, NewTxOutputs()}
+		}
+		batch[string(txID)].Outs[outIdx] = out
+		batchSize++
+		progress.Step()
+
+		if batchSize >= snapshotLoadBatch {
+			return writeBatch()
+		}
+		return nil
+	})
+
+	if err == nil {
+		err = writeBatch()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 最后写入 UTXO 集对应的区块, 之前中断的话需要删除数据库重新加载
+	err = db.Update(func(tx StorageTx) error {
+		return tx.Bucket(metaBucket).Put(utxoBestKey, info.BlockHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadBlockChainWithStorage(db, files), nil
+}
+
+// 从快照启动时快照对应的区块, 不是从快照启动或者历史区块已经验证完时返回 nil
+func (bc *BlockChain) SnapshotBase() *utxoSnapshotInfo {
+	var info *utxoSnapshotInfo
+
+	bc.db.View(func(tx StorageTx) error {
+		if value := tx.Bucket(metaBucket).Get(snapshotKey); value != nil {
+			info = &utxoSnapshotInfo{}
+			GobDecode(value, info)
+		}
+		return nil
+	})
+
+	return info
+}
+
+// 快照之前还没有下载的区块, 最多返回 limit 个
+func (bc *BlockChain) missingHistoryBlocks(base *utxoSnapshotInfo, limit int) [][]byte {
+	var hashes [][]byte
+
+	for height := int64(0); height <= base.Height && len(hashes) < limit; height++ {
+		hash := bc.GetBlockHash(height)
+		if !bc.HaveBlockData(hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes
+}
+
+// 收到区块时调用, 是快照之前缺少的区块时保存区块数据并返回 true
+func (bc *BlockChain) addHistoryBlock(block *Block) bool {
+	base := bc.SnapshotBase()
+	if base == nil || block.Height > base.Height {
+		return false
+	}
+
+	entry := bc.getBlockIndex(block.Hash)
+	if entry == nil || !entry.Pruned {
+		return false
+	}
+
+	if tree := block.MerkleTree(); !bytes.Equal(tree.Root.Data, entry.Header.TxsHash) || tree.Mutated {
+		fmt.Printf("Block %x doesn't match its header, dropped\n", block.Hash)
+		return true
+	}
+
+	entry.TxCount = len(block.Transactions)
+	err := bc.db.Update(func(tx StorageTx) error {
+		return bc.writeBlockData(tx, block, entry)
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return true
+}
+
+// 历史区块都下载完之后调用, 从创世区块重放到快照的区块, 和连接区块时一样检查每个区块中的交易, 最后和快照的 commitment 对比
+// 重放时给历史区块写回滚数据, 并补上地址索引
+func (bc *BlockChain) validateSnapshot(base *utxoSnapshotInfo) error {
+	for height := int64(0); height <= base.Height; height++ {
+		if err := bc.verifyBlock(height, verifyLevelMerkle); err != nil {
+			return err
+		}
+	}
+
+	utxos, createdAt, err := bc.replayUTXOs(base.Height, func(block *Block, undo *blockUndo) error {
+		if err := bc.checkBlockTxs(block, undo); err != nil {
+			return err
+		}
+
+		bc.writeUndo(block, undo)
+		bc.addrIndex.ConnectBlock(block, undo)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if commitment := utxoCommitment(utxos, createdAt); !bytes.Equal(commitment, base.Commitment) {
+		return fmt.Errorf("replaying the chain gives commitment %x, the snapshot has %x", commitment, base.Commitment)
+	}
+
+	// 验证期间不会裁剪, 所以这时所有区块都有数据
+	return bc.db.Update(func(tx StorageTx) error {
+		meta := tx.Bucket(metaBucket)
+		if err := meta.Delete(snapshotKey); err != nil {
+			return err
+		}
+		return meta.Delete(pruneHeightKey)
+	})
+}
+
+// 从快照启动的节点在后台下载快照之前的区块, 都下载完之后验证快照
+// request 用来向其他节点请求区块
+func (bc *BlockChain) syncSnapshotHistory(request func(hashes [][]byte)) {
+	for {
+		base := bc.SnapshotBase()
+		if base == nil {
+			return
+		}
+
+		missing := bc.missingHistoryBlocks(base, snapshotHistoryBatch)
+		if len(missing) == 0 {
+			if err := bc.validateSnapshot(base); err != nil {
+				log.Panicf("ERROR: The UTXO snapshot doesn't match the chain history: %s", err)
+			}
+
+			fmt.Printf("UTXO snapshot at height %d validated\n", base.Height)
+			bc.filterIndex.CatchUp() // 快照之前的区块都有了, 可以构建它们的 filter
+			bc.txIndex = initTxIndex(bc)
+			return
+		}
+
+		fmt.Printf("Downloading blocks before the UTXO snapshot, %d requested\n", len(missing))
+		request(missing)
+		time.Sleep(snapshotHistoryRetry)
+	}
+}
+
+// 从快照启动并且快照之前的区块还没有验证完时, 交易索引和地址索引中没有那些区块, 返回错误
+func (bc *BlockChain) checkHistoryIndexed() error {
+	if base := bc.SnapshotBase(); base != nil {
+		return fmt.Errorf("blocks before the UTXO snapshot at height %d are not indexed until they are downloaded and validated", base.Height)
+	}
+	return nil
+}
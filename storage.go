@@ -0,0 +1,34 @@
+package main
+
+// 区块链使用的 key-value 存储, 接口参照 bolt 设计: 数据按 bucket 分组, 所有读写都在事务中进行,
+// bucket 内的 key 按字节序排序, 可以用 cursor 遍历.
+// 目前有 bolt(写文件) 和 memory(纯内存, 用于测试和模拟) 两种实现
+type Storage interface {
+	View(fn func(tx StorageTx) error) error   // 只读事务
+	Update(fn func(tx StorageTx) error) error // 读写事务, fn 返回 error 时回滚
+	Close() error
+}
+
+type StorageTx interface {
+	Bucket(name []byte) StorageBucket // bucket 不存在时返回 nil
+	CreateBucket(name []byte) (StorageBucket, error)
+	CreateBucketIfNotExists(name []byte) (StorageBucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// Get 返回的 value 只在事务内有效
+type StorageBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Cursor() StorageCursor
+}
+
+// 遍历结束时 key 为 nil
+type StorageCursor interface {
+	First() (key, value []byte)
+	Last() (key, value []byte)
+	Next() (key, value []byte)
+	Prev() (key, value []byte)
+	Seek(seek []byte) (key, value []byte) // 移动到第一个 >= seek 的 key
+}
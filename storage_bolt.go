@@ -0,0 +1,88 @@
+package main
+
+import "github.com/boltdb/bolt"
+
+// 基于 bolt 的 Storage 实现
+type boltStorage struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+type boltBucket struct {
+	bucket *bolt.Bucket
+}
+
+func OpenBoltStorage(path string) (Storage, error) {
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStorage{db}, nil
+}
+
+func (s *boltStorage) View(fn func(tx StorageTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (s *boltStorage) Update(fn func(tx StorageTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (s *boltStorage) Close() error {
+	return s.db.Close()
+}
+
+func (t *boltTx) Bucket(name []byte) StorageBucket {
+	bucket := t.tx.Bucket(name)
+	if bucket == nil {
+		return nil // 不能返回包着 nil 指针的接口
+	}
+
+	return &boltBucket{bucket}
+}
+
+func (t *boltTx) CreateBucket(name []byte) (StorageBucket, error) {
+	bucket, err := t.tx.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltBucket{bucket}, nil
+}
+
+func (t *boltTx) CreateBucketIfNotExists(name []byte) (StorageBucket, error) {
+	bucket, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltBucket{bucket}, nil
+}
+
+func (t *boltTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+func (b *boltBucket) Get(key []byte) []byte {
+	return b.bucket.Get(key)
+}
+
+func (b *boltBucket) Put(key, value []byte) error {
+	return b.bucket.Put(key, value)
+}
+
+func (b *boltBucket) Delete(key []byte) error {
+	return b.bucket.Delete(key)
+}
+
+func (b *boltBucket) Cursor() StorageCursor {
+	return b.bucket.Cursor() // *bolt.Cursor 已经实现了 StorageCursor
+}
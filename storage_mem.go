@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	errTxNotWritable  = errors.New("storage: tx not writable")
+	errBucketExists   = errors.New("storage: bucket already exists")
+	errBucketNotFound = errors.New("storage: bucket not found")
+	errKeyRequired    = errors.New("storage: key required")
+)
+
+// 纯内存的 Storage 实现, 不会读写磁盘, 进程退出后数据就没了
+// 写事务使用 copy-on-write: 事务中第一次修改某个 bucket 时复制一份, 提交时整体替换, 回滚时直接丢弃
+type memStorage struct {
+	lock    sync.RWMutex // 读写事务互斥, 只读事务可以并发
+	buckets map[string]memBucketData
+}
+
+type memBucketData map[string][]byte
+
+type memTx struct {
+	storage  *memStorage
+	writable bool
+	buckets  map[string]memBucketData
+	copied   map[string]bool // 本事务中已经复制过的 bucket
+}
+
+type memBucket struct {
+	tx   *memTx
+	name string
+}
+
+// 遍历的是创建 cursor 时的快照, 遍历过程中修改 bucket 不会影响 cursor
+type memCursor struct {
+	keys   []string // 已排序
+	values [][]byte // 和 keys 一一对应
+	index  int
+}
+
+func NewMemStorage() Storage {
+	return &memStorage{buckets: make(map[string]memBucketData)}
+}
+
+func (s *memStorage) View(fn func(tx StorageTx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return fn(&memTx{storage: s, buckets: s.buckets})
+}
+
+func (s *memStorage) Update(fn func(tx StorageTx) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buckets := make(map[string]memBucketData, len(s.buckets))
+	for name, data := range s.buckets {
+		buckets[name] = data
+	}
+
+	tx := &memTx{s, true, buckets, make(map[string]bool)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.buckets = tx.buckets
+	return nil
+}
+
+func (s *memStorage) Close() error {
+	return nil
+}
+
+func (t *memTx) Bucket(name []byte) StorageBucket {
+	if _, ok := t.buckets[string(name)]; !ok {
+		return nil
+	}
+
+	return &memBucket{t, string(name)}
+}
+
+func (t *memTx) CreateBucket(name []byte) (StorageBucket, error) {
+	if !t.writable {
+		return nil, errTxNotWritable
+	}
+	if _, ok := t.buckets[string(name)]; ok {
+		return nil, errBucketExists
+	}
+
+	t.buckets[string(name)] = make(memBucketData)
+	t.copied[string(name)] = true
+	return &memBucket{t, string(name)}, nil
+}
+
+func (t *memTx) CreateBucketIfNotExists(name []byte) (StorageBucket, error) {
+	if bucket := t.Bucket(name); bucket != nil {
+		return bucket, nil
+	}
+
+	return t.CreateBucket(name)
+}
+
+func (t *memTx) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+	if _, ok := t.buckets[string(name)]; !ok {
+		return errBucketNotFound
+	}
+
+	delete(t.buckets, string(name))
+	delete(t.copied, string(name))
+	return nil
+}
+
+// 返回可以修改的 bucket 数据
+func (b *memBucket) writableData() (memBucketData, error) {
+	if !b.tx.writable {
+		return nil, errTxNotWritable
+	}
+
+	data := b.tx.buckets[b.name]
+	if !b.tx.copied[b.name] {
+		copied := make(memBucketData, len(data))
+		for key, value := range data {
+			copied[key] = value
+		}
+
+		data = copied
+		b.tx.buckets[b.name] = data
+		b.tx.copied[b.name] = true
+	}
+
+	return data, nil
+}
+
+func (b *memBucket) Get(key []byte) []byte {
+	return b.tx.buckets[b.name][string(key)]
+}
+
+func (b *memBucket) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return errKeyRequired
+	}
+
+	data, err := b.writableData()
+	if err != nil {
+		return err
+	}
+
+	data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memBucket) Delete(key []byte) error {
+	data, err := b.writableData()
+	if err != nil {
+		return err
+	}
+
+	delete(data, string(key))
+	return nil
+}
+
+func (b *memBucket) Cursor() StorageCursor {
+	data := b.tx.buckets[b.name]
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = data[key]
+	}
+
+	return &memCursor{keys, values, 0}
+}
+
+func (c *memCursor) current() ([]byte, []byte) {
+	if c.index < 0 || c.index >= len(c.keys) {
+		return nil, nil
+	}
+
+	return []byte(c.keys[c.index]), c.values[c.index]
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	c.index = 0
+	return c.current()
+}
+
+func (c *memCursor) Last() ([]byte, []byte) {
+	c.index = len(c.keys) - 1
+	return c.current()
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	if c.index < len(c.keys) {
+		c.index++
+	}
+	return c.current()
+}
+
+func (c *memCursor) Prev() ([]byte, []byte) {
+	if c.index >= 0 {
+		c.index--
+	}
+	return c.current()
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	c.index = sort.SearchStrings(c.keys, string(seek))
+	return c.current()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+)
+
+// 两条链之间的原子交换, 不需要信任对方:
+//   1. 发起方生成 secret, 在链 A 上把币转到 HTLC (接收方为参与方, 超时时间较长, 比如 48 小时)
+//   2. 参与方在链 A 上检查合约之后, 在链 B 上用同一个 secret hash 把币转到 HTLC (接收方为发起方, 超时时间较短, 比如 24 小时)
+//   3. 发起方检查链 B 上的合约, 用 secret 花费, secret 因此出现在链 B 上
+//   4. 参与方从链 B 上取到 secret, 花费链 A 上的合约
+// 任何一方中途放弃, 另一方都可以在超时之后取回自己的币
+// 参与方的超时时间必须比发起方的短, 否则发起方可以等参与方的合约超时之后再用 secret 花费两边的合约
+
+// 生成随机的 secret 和它的 hash
+func NewSwapSecret() ([]byte, []byte) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		log.Panic(err)
+	}
+
+	hash := sha256.Sum256(secret)
+	return secret, hash[:]
+}
+
+// HTLC 的 P2SH 地址, 合约中的币都在这个地址下
+func (htlc *HTLC) Address() []byte {
+	return NewP2SHAddress(htlc.Script())
+}
+
+// 把 amount 转到 HTLC, 接收方为 to, 超时之后退回给 from
+func (bc *BlockChain) NewHTLCTransaction(from *Wallet, to string, amount int, secretHash []byte, lockTime int64) (*Transaction, *HTLC) {
+	addrVersion, recipientHash := decodeAddress(to)
+	if !isP2PKHVersion(addrVersion) {
+		log.Panic("ERROR: The recipient of a swap must be a wallet address")
+	}
+	if len(secretHash) != sha256.Size {
+		log.Panic("ERROR: Wrong secret hash")
+	}
+
+	htlc := &HTLC{secretHash, recipientHash, HashPubKey(from.PublicKey), lockTime}
+	tx := bc.newPaymentTransaction(from, TXOutput{amount, NewP2SHScript(HashPubKey(htlc.Script()))})
+
+	return tx, htlc
+}
+
+// 花费 HTLC 中所有的币, 转到 w 的地址
+// secret 不为 nil 时是接收方用 secret 取走, 否则是发送方在超时之后退款
+func (bc *BlockChain) NewHTLCSpendTransaction(w *Wallet, redeemScript, secret []byte) *Transaction {
+	htlc := ExtractHTLC(redeemScript)
+	if htlc == nil {
+		log.Panic("ERROR: Not a swap contract")
+	}
+
+	pubKeyHash := HashPubKey(w.PublicKey)
+	if secret != nil {
+		hash := sha256.Sum256(secret)
+		if !bytes.Equal(hash[:], htlc.SecretHash) {
+			log.Panic("ERROR: The secret doesn't match the contract")
+		}
+		if !bytes.Equal(pubKeyHash, htlc.RecipientHash) {
+			log.Panic("ERROR: The wallet is not the recipient of the contract")
+		}
+	} else if !bytes.Equal(pubKeyHash, htlc.RefundHash) {
+		log.Panic("ERROR: The wallet is not the refund address of the contract")
+	}
+
+	acc, spendableOutputs := bc.FindSpendableOutputs(HashPubKey(redeemScript), math.MaxInt32)
+	if acc == 0 {
+		log.Panic("ERROR: The contract has no funds")
+	}
+
+	tx := Transaction{nil, txVersion, nil, []TXOutput{NewTxOutput(acc, hex.EncodeToString(w.GetAddress()))}, 0}
+	for txid, outIdxs := range spendableOutputs {
+		txID, _ := hex.DecodeString(txid)
+
+		for _, outIdx := range outIdxs {
+			tx.Vin = append(tx.Vin, TXInput{txID, outIdx, nil, maxSequence})
+		}
+	}
+
+	// 退款需要满足 OP_CHECKLOCKTIMEVERIFY
+	if secret == nil {
+		tx.LockTime = htlc.LockTime
+		for i := range tx.Vin {
+			tx.Vin[i].Sequence = maxSequence - 1
+		}
+	}
+
+	tx.Hash()
+	tx.signHTLC(w, redeemScript, secret)
+	return &tx
+}
+
+// 给所有花费 HTLC 的 input 签名
+func (tx *Transaction) signHTLC(w *Wallet, redeemScript, secret []byte) {
+	copyTx := tx.TrimmedCopy()
+	copyTx.Hash()
+
+	for i := range tx.Vin {
+		signature := w.PrivateKey.Sign(copyTx.ID)
+		tx.Vin[i].ScriptSig = NewHTLCScriptSig(signature, w.PublicKey, secret, redeemScript)
+	}
+}
+
+// 从链上找到接收方花费 HTLC 的交易, 返回其中的 secret, 还没有被接收方花费时返回 nil
+func (bc *BlockChain) FindHTLCSecret(redeemScript []byte) []byte {
+	for _, entry := range bc.addrIndex.History(HashPubKey(redeemScript)) {
+		tx := bc.findTx(entry.TxID)
+		if tx == nil {
+			continue
+		}
+
+		for _, in := range tx.Vin {
+			if secret := ExtractHTLCSecret(in.ScriptSig, redeemScript); secret != nil {
+				return secret
+			}
+		}
+	}
+	return nil
+}
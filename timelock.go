@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// 时间锁, 和比特币的规则一致:
+//   绝对时间锁: 交易的 LockTime 小于 lockTimeThreshold 时是区块高度, 否则是 unix 时间, 交易只能放在高度 (或者中位时间) 大于 LockTime 的区块中
+//               所有 input 的 Sequence 都是 maxSequence 时不检查 LockTime, coinbase 就是这样用 LockTime 保存高度的
+//   相对时间锁: input 的 Sequence 没有设置 sequenceDisableFlag 时, 被花费的 output 确认之后要经过 Sequence 表示的区块数或者时间才能花费
+//   脚本中的 OP_CHECKLOCKTIMEVERIFY 和 OP_CHECKSEQUENCEVERIFY 要求交易的 LockTime 和 input 的 Sequence 不小于脚本中的值,
+//   这样锁就可以加在 output 上
+// 时间都用中位时间 (前 11 个区块时间戳的中位数), 矿工不能通过修改区块的时间戳提前解锁
+
+const (
+	maxSequence         = 0xffffffff // 不使用任何时间锁
+	sequenceDisableFlag = 1 << 31    // 设置时不使用相对时间锁
+	sequenceTypeFlag    = 1 << 22    // 设置时以 512 秒为单位, 否则以区块为单位
+	sequenceLockMask    = 0x0000ffff
+	sequenceGranularity = 9 // 时间以 2^9 = 512 秒为单位
+
+	medianTimeSpan = 11
+)
+
+// 锁定 blocks 个区块的 Sequence
+func SequenceForBlocks(blocks int64) uint32 {
+	return uint32(blocks) & sequenceLockMask
+}
+
+// 锁定 seconds 秒的 Sequence, 向上取整到 512 秒
+func SequenceForSeconds(seconds int64) uint32 {
+	units := (seconds + 1<<sequenceGranularity - 1) >> sequenceGranularity
+	return sequenceTypeFlag | uint32(units)&sequenceLockMask
+}
+
+// 区块中的交易是否满足绝对时间锁, medianTime 是前一个区块的中位时间
+func (tx *Transaction) IsFinal(height, medianTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	limit := height
+	if tx.LockTime >= lockTimeThreshold {
+		limit = medianTime
+	}
+	if tx.LockTime < limit {
+		return true
+	}
+
+	for _, in := range tx.Vin {
+		if in.Sequence != maxSequence {
+			return false
+		}
+	}
+	return true
+}
+
+// 区块高度 height 以及之前 10 个区块的时间戳的中位数
+func (bc *BlockChain) MedianTimePast(height int64) int64 {
+	var times []int64
+
+	for h := height; h >= 0 && h > height-medianTimeSpan; h-- {
+		header := bc.GetBlockHeader(bc.GetBlockHash(h))
+		if header == nil {
+			break
+		}
+		times = append(times, header.Timestamp)
+	}
+
+	if len(times) == 0 {
+		return 0
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// 在高度 coinHeight 确认的 output 在高度 height 的区块中能否被 Sequence 为 sequence 的 input 花费
+func (bc *BlockChain) sequenceLockSatisfied(sequence uint32, coinHeight, height int64) bool {
+	if sequence&sequenceDisableFlag != 0 {
+		return true
+	}
+
+	value := int64(sequence & sequenceLockMask)
+	if sequence&sequenceTypeFlag == 0 {
+		return height >= coinHeight+value
+	}
+
+	// 从 output 所在区块的前一个区块的中位时间开始算
+	coinTime := bc.MedianTimePast(coinHeight - 1)
+	if coinHeight == 0 {
+		coinTime = bc.MedianTimePast(0)
+	}
+	return bc.MedianTimePast(height-1) >= coinTime+value<<sequenceGranularity
+}
+
+// 检查交易放在高度 height 的区块中时是否满足绝对和相对时间锁
+// coinHeights 和 Vin 对应, 是被花费的 output 所在区块的高度, 从 UTXO 集或者回滚数据中取, 和节点有没有交易索引无关
+func (bc *BlockChain) CheckTxLocks(tx *Transaction, height int64, coinHeights []int64) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	if !tx.IsFinal(height, bc.MedianTimePast(height-1)) {
+		return fmt.Errorf("transaction %x is locked until %d", tx.ID, tx.LockTime)
+	}
+
+	for inIdx, in := range tx.Vin {
+		if in.Sequence&sequenceDisableFlag != 0 {
+			continue
+		}
+
+		if !bc.sequenceLockSatisfied(in.Sequence, coinHeights[inIdx], height) {
+			return fmt.Errorf("input %d of transaction %x has an unexpired relative lock %#x", inIdx, tx.ID, in.Sequence)
+		}
+	}
+
+	return nil
+}
+
+// 钱包选择 UTXO 时用的过滤器, 跳过下一个区块中还不能花费的带时间锁的 output
+// 一笔交易只有一个 LockTime, 所以按高度和按时间锁定的 output 不能在同一笔交易中花费, 以先选中的为准
+func (bc *BlockChain) newTimeLockFilter() func(txID []byte, out *TXOutput) bool {
+	height := bc.GetBestHeight() + 1
+	medianTime := bc.MedianTimePast(height - 1)
+	lockType := -1 // 0: 高度, 1: 时间
+
+	return func(txID []byte, out *TXOutput) bool {
+		lock, relative, _ := ExtractTimeLock(out.ScriptPubKey)
+		if lock < 0 {
+			return true
+		}
+
+		if relative {
+			return bc.sequenceLockSatisfied(uint32(lock), bc.utxoSet.CoinHeight(txID), height)
+		}
+
+		currentType, limit := 0, height
+		if lock >= lockTimeThreshold {
+			currentType, limit = 1, medianTime
+		}
+		if lock >= limit || (lockType >= 0 && lockType != currentType) {
+			return false
+		}
+
+		lockType = currentType
+		return true
+	}
+}
+
+// 花费带时间锁的 output 时, 设置交易的 LockTime 和 input 的 Sequence 以满足脚本的要求, 需要在签名之前调用
+func (tx *Transaction) setTimeLocks(prevTxs map[string]*Transaction) {
+	for i := range tx.Vin {
+		in := &tx.Vin[i]
+		prevOut := prevTxs[hex.EncodeToString(in.Txid)].Vout[in.Vout]
+
+		lock, relative, _ := ExtractTimeLock(prevOut.ScriptPubKey)
+		switch {
+		case lock < 0:
+		case relative:
+			in.Sequence = uint32(lock)
+		default:
+			// Sequence 为 maxSequence 时不检查 LockTime, OP_CHECKLOCKTIMEVERIFY 也会失败
+			if in.Sequence == maxSequence {
+				in.Sequence = maxSequence - 1
+			}
+			if lock > tx.LockTime {
+				tx.LockTime = lock
+			}
+		}
+	}
+}
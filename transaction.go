@@ -1,41 +1,44 @@
 package main
 
 import (
-	"fmt"
 	"bytes"
-	"encoding/gob"
+	"fmt"
 	"crypto/sha256"
-	"crypto/ecdsa"
 	"encoding/hex"
 	"log"
-	"crypto/rand"
-	"math/big"
-	"crypto/elliptic"
-	"time"
 )
 
 const subsidy = 10 // 是挖出新块的奖励金
 
+const txVersion = 1 // 新建交易的版本
+
 // 一笔交易由一些输入（input）和输出（output）组合而来
+// ID 不参与序列化, 是其他字段序列化结果的 hash, 反序列化时重新计算
 type Transaction struct {
-	ID         []byte
-	Vin        []TXInput
-	Vout       []TXOutput
-	timesStamp int64
+	ID       []byte
+	Version  int
+	Vin      []TXInput
+	Vout     []TXOutput
+	LockTime int64 // 绝对时间锁, 见 timelock.go
 }
 
-func NewCoinBaseTX(to, data string) *Transaction {
-	if data == "" {
-		data = fmt.Sprintf("Reword to '%s'", to)
+// coinbase 的 LockTime 为区块高度, 这样不同区块中的 coinbase 交易 ID 不会相同
+// input 的 Sequence 为 maxSequence, 所以 LockTime 不会锁住 coinbase
+// data 不为空时放在一个数据 output 中
+func NewCoinBaseTX(to, data string, height int64) *Transaction {
+	txInput := TXInput{[]byte{}, -1, nil, maxSequence}
+	txOutputs := []TXOutput{NewTxOutput(subsidy, to)}
+	if data != "" {
+		txOutputs = append(txOutputs, NewDataOutput([]byte(data)))
 	}
-	txInput := TXInput{[]byte{}, -1, nil, nil}
-	txOutput := NewTxOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txInput}, []TXOutput{txOutput}, time.Now().UnixNano()}
+	tx := Transaction{nil, txVersion, []TXInput{txInput}, txOutputs, height}
 	tx.Hash()
 	return &tx
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]*Transaction) {
+// 给转到 privKey 对应的公钥 hash 的 P2PKH output (包括带时间锁的) 签名, 其他 input 不处理
+// 多重签名 (直接的或者 P2SH 的) 的 input 在公钥对应的位置加上签名, 其他位置已有的签名保留, 其他人可以继续签名
+func (tx *Transaction) Sign(privKey PrivateKey, prevTxs map[string]*Transaction) {
 
 	for _, in := range tx.Vin {
 
@@ -46,60 +49,102 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]*Transa
 
 	}
 
+	// 交易 ID 不包含签名, 所以签名的就是最终的交易 ID, 签名之后 ID 不会再变
 	copyTx := tx.TrimmedCopy()
+	copyTx.Hash()
 
-	for inIdx, in := range copyTx.Vin {
-		in.Signature = nil
-		txID := hex.EncodeToString(in.Txid)
-		in.PubKey = prevTxs[txID].Vout[in.Vout].PubKeyHash
-		copyTx.Hash()
+	pubKey := privKey.PublicKey()
+	pubKeyHash := HashPubKey(pubKey)
+
+	for inIdx, in := range tx.Vin {
+		prevOut := prevTxs[hex.EncodeToString(in.Txid)].Vout[in.Vout]
 
-		in.PubKey = nil // 是使用tx来求hash得
+		if _, _, lockedHash := ExtractTimeLock(prevOut.ScriptPubKey); bytes.Equal(lockedHash, pubKeyHash) ||
+			bytes.Equal(ExtractPubKeyHash(prevOut.ScriptPubKey), pubKeyHash) {
+			signature := privKey.Sign(copyTx.ID)
+			tx.Vin[inIdx].ScriptSig = NewP2PKHScriptSig(signature, pubKey)
+			continue
+		}
 
-		r, s, _ := ecdsa.Sign(rand.Reader, &privKey, copyTx.ID)
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Vin[inIdx].Signature = signature
+		if scriptSig := signMultisig(in.ScriptSig, prevOut.ScriptPubKey, privKey, pubKey, copyTx.ID); scriptSig != nil {
+			tx.Vin[inIdx].ScriptSig = scriptSig
+		}
 	}
 }
 
-func (tx *Transaction) Verify(prevTxs map[string]*Transaction) bool {
-	curve := elliptic.P256()
-	copyTx := tx.TrimmedCopy()
-
-	for inIdx, in := range tx.Vin {
-		// 验证每一个 in 的 signature 是否都是合理的
-
-		txID := hex.EncodeToString(in.Txid)
+// 在多重签名的 ScriptSig 中 pubKey 对应的位置加上签名, 返回新的 ScriptSig
+// P2SH 时 redeem script 从已有的 ScriptSig 中取, 所以创建交易时就要放进去
+// 不是多重签名或者 pubKey 不在其中时返回 nil
+func signMultisig(scriptSig, scriptPubKey []byte, privKey PrivateKey, pubKey, hash []byte) []byte {
+	pushes := scriptPushes(scriptSig)
+	if pushes == nil {
+		return nil
+	}
 
-		copyIn := copyTx.Vin[inIdx]
+	var redeemScript []byte
+	multisigScript := scriptPubKey
+	if scriptHash := ExtractScriptHash(scriptPubKey); scriptHash != nil {
+		if len(pushes) == 0 || !bytes.Equal(HashPubKey(pushes[len(pushes)-1]), scriptHash) {
+			return nil
+		}
+		redeemScript = pushes[len(pushes)-1]
+		multisigScript = redeemScript
+		pushes = pushes[:len(pushes)-1]
+	}
 
-		copyIn.Signature = nil
-		copyIn.PubKey = prevTxs[txID].Vout[in.Vout].PubKeyHash
-		copyTx.Hash()
-		copyIn.PubKey = nil  // hash 完就把 public key 制空
+	_, pubKeys := ExtractMultisig(multisigScript)
+	keyIdx := -1
+	for i, key := range pubKeys {
+		if bytes.Equal(key, pubKey) {
+			keyIdx = i
+		}
+	}
+	if keyIdx < 0 {
+		return nil
+	}
 
-		sign := in.Signature
-		sLen := len(sign)
-		r := big.Int{}
-		s := big.Int{}
+	sigs := make([][]byte, len(pubKeys))
+	copy(sigs, pushes)
+	sigs[keyIdx] = privKey.Sign(hash)
 
-		r.SetBytes(sign[:(sLen / 2)])
-		s.SetBytes(sign[(sLen / 2):])
+	return NewMultisigScriptSig(sigs, redeemScript)
+}
 
-		pubKey := in.PubKey
-		keyLen := len(pubKey)
-		x := big.Int{}
-		y := big.Int{}
+// 多重签名的 input 中有效签名的数量和需要的数量, 不是多重签名时返回 0, 0
+func (tx *Transaction) MultisigStatus(inIdx int, prevOut *TXOutput) (int, int) {
+	pushes := scriptPushes(tx.Vin[inIdx].ScriptSig)
+	multisigScript := prevOut.ScriptPubKey
+	if ExtractScriptHash(prevOut.ScriptPubKey) != nil && len(pushes) > 0 {
+		multisigScript = pushes[len(pushes)-1]
+		pushes = pushes[:len(pushes)-1]
+	}
 
-		x.SetBytes(pubKey[:(keyLen / 2)])
-		y.SetBytes(pubKey[(keyLen / 2):])
+	m, pubKeys := ExtractMultisig(multisigScript)
+	if m == 0 {
+		return 0, 0
+	}
 
-		rowPubKey := ecdsa.PublicKey{curve, &x, &y}
+	copyTx := tx.TrimmedCopy()
+	copyTx.Hash()
 
-		if ecdsa.Verify(&rowPubKey, copyTx.ID, &r, &s) == false {
-			return false
+	signed := 0
+	for i, sig := range pushes {
+		if i < len(pubKeys) && checkSignature(pubKeys[i], sig, copyTx.ID) {
+			signed++
 		}
+	}
+	return signed, m
+}
 
+// 每个 input 的 ScriptSig 都要满足被花费的 output 的 ScriptPubKey, input 多时并行验证
+func (tx *Transaction) Verify(prevTxs map[string]*Transaction) bool {
+	checks, err := tx.inputChecks(prevTxs)
+	if err == nil {
+		err = runInputChecks(checks)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return false
 	}
 
 	return true
@@ -111,33 +156,44 @@ func (tx *Transaction) TrimmedCopy() *Transaction {
 	var outputs []TXOutput
 
 	for _, in := range tx.Vin {
-		inputs = append(inputs, TXInput{in.Txid, in.Vout, nil, nil})
+		inputs = append(inputs, TXInput{in.Txid, in.Vout, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Vout {
-		outputs = append(outputs, TXOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TXOutput{out.Value, out.ScriptPubKey})
 	}
 
-	return &Transaction{nil, inputs, outputs, tx.timesStamp}
+	return &Transaction{nil, tx.Version, inputs, outputs, tx.LockTime}
 }
 
+// 交易 ID 是不包含 witness 的序列化结果的 hash, 修改签名不会改变交易 ID
 func (tx *Transaction) Hash() {
+	hash := sha256.Sum256(tx.serializeWithoutWitness())
 
-	var buffer bytes.Buffer
-	var hash [32]byte
-
-	encoder := gob.NewEncoder(&buffer)
+	tx.ID = hash[:]
+}
 
-	encoder.Encode(tx)
+func (tx *Transaction) String() string {
 
-	b := buffer.Bytes()
+	var res string
+	res += fmt.Sprintf("Transaction %x:\n", tx.ID)
+	res += fmt.Sprintf("  Version:  %d\n", tx.Version)
+	res += fmt.Sprintf("  LockTime: %d\n", tx.LockTime)
 
-	// 把时间添加进去防止 产生的hash相同
-	b = append(b, byte(tx.timesStamp))
+	for i, in := range tx.Vin {
+		res += fmt.Sprintf("  Input %d:\n", i)
+		res += fmt.Sprintf("    TXID:      %x\n", in.Txid)
+		res += fmt.Sprintf("    Out:       %d\n", in.Vout)
+		res += fmt.Sprintf("    ScriptSig: %s\n", DisasmScript(in.ScriptSig))
+	}
 
-	hash = sha256.Sum256(b)
+	for i, out := range tx.Vout {
+		res += fmt.Sprintf("  Output %d:\n", i)
+		res += fmt.Sprintf("    Value:      %d\n", out.Value)
+		res += fmt.Sprintf("    ScriptPubKey: %s\n", DisasmScript(out.ScriptPubKey))
+	}
 
-	tx.ID = hash[:]
+	return res
 }
 
 func (tx Transaction) IsCoinbase() bool {
@@ -145,30 +201,20 @@ func (tx Transaction) IsCoinbase() bool {
 }
 
 func (tx *Transaction) Serialize() []byte {
+	return serializeVersioned(tx.encode)
+}
 
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-
-	err := encoder.Encode(tx)
-
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return buf.Bytes()
+func (tx *Transaction) serializeWithoutWitness() []byte {
+	return serializeVersioned(tx.encodeBase)
 }
 
-func DeserializeTransaction(b []byte) *Transaction {
+// 反序列化时会重新计算交易 ID
+func DeserializeTransaction(b []byte) (*Transaction, error) {
 	var tx Transaction
-	reader := bytes.NewReader(b)
-
-	decoder := gob.NewDecoder(reader)
-	err := decoder.Decode(&tx)
 
-	if err != nil {
-	    log.Panic(err)
+	if err := deserializeVersioned(b, tx.decode); err != nil {
+		return nil, err
 	}
 
-	return &tx
-
+	return &tx, nil
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+)
+
+const txIndexBucket = "txIndex"
+
+// 是否维护交易索引, 关闭后 findTx 退化为从 tip 开始遍历整条链, 验证区块不需要交易索引
+// 设置保存在 metaBucket 中, 只有 startNode -txindex 会修改, 没有保存过时 (新建的或者旧版本的数据库) 不启用:
+// 索引需要所有区块的数据, 而且只有 getTransaction 用到, 大部分节点不需要
+var (
+	txIndexFlag    *bool // startNode -txindex 的值, 没有指定时为 nil
+	txIndexKey     = []byte("txIndex")
+	txIndexBestKey = []byte("txIndexBest") // 索引已经包含到的区块, 和索引在同一个事务中更新
+)
+
+// 交易在链上的位置
+type txLocation struct {
+	BlockHash []byte
+	Index     int // 交易在区块 Transactions 中的下标
+}
+
+func (loc *txLocation) Serialize() []byte {
+	return GobEncode(loc)
+}
+
+func deserializeTxLocation(b []byte) *txLocation {
+	loc := &txLocation{}
+	GobDecode(b, loc)
+	return loc
+}
+
+// txid => 所在区块的 hash 和位置, 用于 O(1) 查找交易
+type TxIndex struct {
+	bc *BlockChain
+}
+
+func NewTxIndex(bc *BlockChain) *TxIndex {
+	return &TxIndex{bc}
+}
+
+// 读取交易索引的设置, 启用时返回初始化好的索引
+// 关闭时删除已有的索引 (关闭期间不会更新), 重新启用时从整条链重新构建
+func initTxIndex(bc *BlockChain) *TxIndex {
+	enabled := false
+	err := bc.db.Update(func(tx StorageTx) error {
+		meta := tx.Bucket(metaBucket)
+		if value := meta.Get(txIndexKey); len(value) == 1 {
+			enabled = value[0] == 1
+		}
+		if txIndexFlag != nil {
+			enabled = *txIndexFlag
+		}
+
+		setting := []byte{0}
+		if enabled {
+			setting[0] = 1
+		}
+		if err := meta.Put(txIndexKey, setting); err != nil {
+			return err
+		}
+
+		if !enabled && tx.Bucket([]byte(txIndexBucket)) != nil {
+			fmt.Println("Transaction index disabled, deleting it")
+			return deleteTxIndex(tx)
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	// 被裁剪的链上建不出完整的索引, 删掉建了一半的索引, 不使用交易索引
+	index := NewTxIndex(bc)
+	if err := index.Init(); err != nil {
+		fmt.Printf("%s, running without it\n", err)
+		err := bc.db.Update(func(tx StorageTx) error {
+			return deleteTxIndex(tx)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		return nil
+	}
+	return index
+}
+
+// 删除索引和索引对应的区块
+func deleteTxIndex(tx StorageTx) error {
+	if tx.Bucket([]byte(txIndexBucket)) != nil {
+		if err := tx.DeleteBucket([]byte(txIndexBucket)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(metaBucket).Delete(txIndexBestKey)
+}
+
+// 从 txIndexBestKey 记录的区块更新到 tip, 构建或者更新到一半退出时下次启动接着做
+// 没有记录时 (第一次启用) 从整条链构建
+func (index *TxIndex) Init() error {
+	var best []byte
+	index.bc.db.View(func(tx StorageTx) error {
+		if tx.Bucket([]byte(txIndexBucket)) != nil {
+			if value := tx.Bucket(metaBucket).Get(txIndexBestKey); value != nil {
+				best = append([]byte{}, value...)
+			}
+		}
+		return nil
+	})
+
+	if best == nil {
+		fmt.Println("Building the transaction index")
+		return index.Reindex()
+	}
+	return index.catchUp(best)
+}
+
+// 需要所有区块的数据, 被裁剪的链不能重建
+func (index *TxIndex) Reindex() error {
+	if index.bc.IsPruned() {
+		return errors.New("can't build the transaction index of a pruned chain")
+	}
+
+	bucketName := []byte(txIndexBucket)
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		if err := deleteTxIndex(tx); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(bucketName)
+		return err
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return index.catchUp(nil)
+}
+
+// 把索引从 best 更新到 tip, best 为 nil 时从创世区块开始
+// 需要的区块已经被裁剪时返回错误
+func (index *TxIndex) catchUp(best []byte) error {
+	bc := index.bc
+
+	// 回滚中断时 best 可能在分支上, 先回滚到主链
+	for best != nil {
+		header := bc.GetBlockHeader(best)
+		if header == nil {
+			return fmt.Errorf("the transaction index is at unknown block %x", best)
+		}
+		if bytes.Equal(bc.GetBlockHash(header.Height), best) {
+			break
+		}
+
+		block := bc.GetBlock(best)
+		if block == nil {
+			return fmt.Errorf("can't roll back the transaction index: block %x is pruned", best)
+		}
+		index.DisconnectBlock(block)
+		best = block.PrevBlockHash
+	}
+
+	from := int64(0)
+	if best != nil {
+		from = bc.GetBlockHeader(best).Height + 1
+	}
+
+	to := bc.GetBestHeight()
+	if from > to {
+		return nil
+	}
+
+	progress := &progressReporter{}
+	progress.Start("connect blocks to the transaction index", int(to-from+1))
+
+	for height := from; height <= to; height++ {
+		block := bc.GetBlockByHeight(height)
+		if block == nil {
+			return fmt.Errorf("can't update the transaction index: no block data at height %d", height)
+		}
+		index.ConnectBlock(block)
+		progress.Step()
+	}
+	return nil
+}
+
+// 区块加入主链时调用
+func (index *TxIndex) ConnectBlock(b *Block) {
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		bucket := tx.Bucket([]byte(txIndexBucket))
+
+		for i, transaction := range b.Transactions {
+			loc := txLocation{b.Hash, i}
+			if err := bucket.Put(transaction.ID, loc.Serialize()); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(txIndexBestKey, b.Hash)
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 区块从主链上回滚时调用
+func (index *TxIndex) DisconnectBlock(b *Block) {
+	err := index.bc.db.Update(func(tx StorageTx) error {
+		bucket := tx.Bucket([]byte(txIndexBucket))
+
+		for _, transaction := range b.Transactions {
+			if err := bucket.Delete(transaction.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(txIndexBestKey, b.PrevBlockHash)
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 找不到时返回 nil
+func (index *TxIndex) Find(txID []byte) *txLocation {
+	var loc *txLocation
+
+	index.bc.db.View(func(tx StorageTx) error {
+		value := tx.Bucket([]byte(txIndexBucket)).Get(txID)
+		if value != nil {
+			loc = deserializeTxLocation(value)
+		}
+		return nil
+	})
+
+	return loc
+}
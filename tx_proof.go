@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// 交易在区块中的证明, 对方只需要有区块头就能验证, 不需要整个区块
+//
+//	格式: version | bytes TxID | bytes BlockHash | uvarint 路径长度 | (bytes Hash | byte Left)...
+type TxProof struct {
+	TxID      []byte
+	BlockHash []byte
+	Proof     MerkleProof // 交易 ID 到区块头中 TxsHash 的路径
+}
+
+func (p *TxProof) Serialize() []byte {
+	return serializeVersioned(func(e *encoder) {
+		e.writeBytes(p.TxID)
+		e.writeBytes(p.BlockHash)
+
+		e.writeUvarint(uint64(len(p.Proof)))
+		for _, step := range p.Proof {
+			e.writeBytes(step.Hash)
+			if step.Left {
+				e.writeByte(1)
+			} else {
+				e.writeByte(0)
+			}
+		}
+	})
+}
+
+func DeserializeTxProof(data []byte) (*TxProof, error) {
+	p := &TxProof{}
+
+	err := deserializeVersioned(data, func(d *decoder) {
+		p.TxID = d.readBytes()
+		p.BlockHash = d.readBytes()
+
+		count := d.readCount()
+		for i := 0; i < count && d.err == nil; i++ {
+			step := MerkleProofStep{Hash: d.readBytes()}
+			switch d.readByte() {
+			case 0:
+			case 1:
+				step.Left = true
+			default:
+				d.fail("bad proof side")
+			}
+			p.Proof = append(p.Proof, step)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// 生成交易在主链上所在区块的证明, 需要区块还没有被裁剪
+func (bc *BlockChain) GetTxProof(txID []byte) (*TxProof, error) {
+	tx, block := bc.findTxWithBlock(txID)
+	if tx == nil {
+		return nil, fmt.Errorf("transaction %x is not on the chain, or its block is pruned", txID)
+	}
+
+	for i := range block.Transactions {
+		if bytes.Equal(block.Transactions[i].ID, txID) {
+			return &TxProof{txID, block.Hash, block.MerkleTree().Proof(i)}, nil
+		}
+	}
+
+	log.Panicf("ERROR: Transaction %x is not in block %x", txID, block.Hash)
+	return nil, nil
+}
+
+// 只用区块头检查证明, 区块必须在主链上, 成功时返回交易所在的区块头
+func (bc *BlockChain) VerifyTxProof(p *TxProof) (*BlockHeader, error) {
+	header := bc.GetBlockHeader(p.BlockHash)
+	if header == nil || !bytes.Equal(bc.GetBlockHash(header.Height), header.Hash) {
+		return nil, fmt.Errorf("block %x is not on the main chain", p.BlockHash)
+	}
+	if !ValidateHeader(header) {
+		return nil, fmt.Errorf("block %x has an invalid proof of work", p.BlockHash)
+	}
+	if !VerifyMerkleProof(header.TxsHash, p.TxID, p.Proof) {
+		return nil, errors.New("the merkle proof doesn't match the block header")
+	}
+
+	return header, nil
+}
+
+// 区块中和 filter 匹配的交易以及它们的证明, 区块不存在或者已经被裁剪时返回 nil
+func (bc *BlockChain) newMerkleBlock(hash []byte, filter *BloomFilter) *merkleBlock {
+	block := bc.GetBlock(hash)
+	if block == nil {
+		return nil
+	}
+
+	tree := block.MerkleTree()
+	mb := &merkleBlock{BlockHash: block.Hash}
+	for i, tx := range block.Transactions {
+		if filter.MatchTx(tx) {
+			mb.Txs = append(mb.Txs, tx.Serialize())
+			mb.Proofs = append(mb.Proofs, (&TxProof{tx.ID, block.Hash, tree.Proof(i)}).Serialize())
+		}
+	}
+
+	return mb
+}
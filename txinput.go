@@ -1,23 +1,31 @@
 package main
 
-import "bytes"
+import "log"
 
 type TXInput struct {
 	Txid      []byte // 存储的是之前交易的 ID
 	Vout      int    // 该输出在之前那笔交易中所输出的索引
-	Signature []byte
-	PubKey    []byte
+	ScriptSig []byte // 满足被花费的 output 的 ScriptPubKey 的数据, 比如签名和公钥
+	Sequence  uint32 // 相对时间锁, 为 maxSequence 时不使用任何时间锁, 见 timelock.go
 }
 
-
-
-// 校验是否是由 当前PubKeyHash 发起的交易
-func (in *TXInput) UsesKey(PubKeyHash []byte) bool {
-	hashPubKey := HashPubKey(in.PubKey)
-	return bytes.Compare(PubKeyHash, hashPubKey) == 0
+func (in *TXInput) Serialize() []byte {
+	return serializeVersioned(func(e *encoder) {
+		in.encode(e)
+		in.encodeWitness(e)
+	})
 }
 
+func DeserializeInput(b []byte) *TXInput {
+	var input TXInput
 
+	err := deserializeVersioned(b, func(d *decoder) {
+		input.decode(d)
+		input.decodeWitness(d)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
 
-
-
+	return &input
+}
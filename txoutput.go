@@ -7,8 +7,8 @@ import (
 )
 
 type TXOutput struct {
-	Value      int    // 一定量的比特币
-	PubKeyHash []byte // 公钥
+	Value        int    // 一定量的比特币
+	ScriptPubKey []byte // 花费这个 output 需要满足的脚本
 }
 
 func NewTxOutput(amount int, addr string) TXOutput {
@@ -18,35 +18,43 @@ func NewTxOutput(amount int, addr string) TXOutput {
 	return output
 }
 
+// 不能被花费的数据 output, 金额为 0, data 最多 maxDataCarrierSize 字节
+func NewDataOutput(data []byte) TXOutput {
+	if len(data) == 0 || len(data) > maxDataCarrierSize {
+		log.Panicf("ERROR: Data output must carry 1 to %d bytes, got %d", maxDataCarrierSize, len(data))
+	}
+	return TXOutput{0, NewNullDataScript(data)}
+}
+
 // 是否是转到 PubKeyHash 下
 func (out *TXOutput) IsLockedWith(PubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, PubKeyHash) == 0
+	return bytes.Compare(out.AddressHash(), PubKeyHash) == 0
 }
 
 func (out *TXOutput) Lock(addr string) {
-	pubKeyHash := GetPubKeyHashFromAddr(addr)
-	out.PubKeyHash = pubKeyHash
+	out.ScriptPubKey = ScriptForAddress(addr)
 }
 
-func (out *TXOutput) Serialize() []byte {
-	var result bytes.Buffer
-	encoder := gob.NewEncoder(&result)
-	err := encoder.Encode(out)
-
-	if err != nil {
-		log.Panic(err)
+// 地址中的 hash (公钥 hash 或者 P2SH 的脚本 hash), 地址索引用它作为 key, 没有对应的地址时返回 nil
+// 带时间锁的 P2PKH 也算在公钥 hash 下, 所以余额中包含还没有解锁的部分
+func (out *TXOutput) AddressHash() []byte {
+	if hash := ExtractPubKeyHash(out.ScriptPubKey); hash != nil {
+		return hash
 	}
-	return result.Bytes()
+	if _, _, hash := ExtractTimeLock(out.ScriptPubKey); hash != nil {
+		return hash
+	}
+	return ExtractScriptHash(out.ScriptPubKey)
 }
 
-func DeserializeOutput(b []byte) *TXOutput {
+func (out *TXOutput) Serialize() []byte {
+	return serializeVersioned(out.encode)
+}
 
+func DeserializeOutput(b []byte) *TXOutput {
 	var output TXOutput
-	reader := bytes.NewReader(b)
-	decoder := gob.NewDecoder(reader)
 
-	err := decoder.Decode(&output)
-	if err != nil {
+	if err := deserializeVersioned(b, output.decode); err != nil {
 		log.Panic(err)
 	}
 
@@ -5,8 +5,11 @@ import (
 	"encoding/binary"
 	"log"
 	"encoding/gob"
+	"fmt"
 )
 
+const progressLogEvery = 1000 // 每处理这么多条数据打印一次进度
+
 // IntToHex converts an int64 to a byte array
 func IntToHex(num int64) []byte {
 	buff := new(bytes.Buffer)
@@ -18,6 +21,11 @@ func IntToHex(num int64) []byte {
 	return buff.Bytes()
 }
 
+// HexToInt converts a byte array produced by IntToHex back to an int64
+func HexToInt(data []byte) int64 {
+	return int64(binary.BigEndian.Uint64(data))
+}
+
 // ReverseBytes reverses a byte array
 func ReverseBytes(data []byte) {
 	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
@@ -39,14 +47,18 @@ func GobEncode(e interface{}) []byte {
 
 // 传入反序列化的数据和对象的指针
 func GobDecode(data []byte, e interface{}) {
-	reader := bytes.NewReader(data)
-	decoder := gob.NewDecoder(reader)
-	err := decoder.Decode(e)
-	if err != nil {
+	if err := TryGobDecode(data, e); err != nil {
 		log.Panic(err)
 	}
 }
 
+// 解码其他节点发来的数据, 格式不对时返回错误而不是 panic
+func TryGobDecode(data []byte, e interface{}) error {
+	reader := bytes.NewReader(data)
+	decoder := gob.NewDecoder(reader)
+	return decoder.Decode(e)
+}
+
 func SliceIterator(bytes [][]byte) func() ([]byte, bool) {
 
 	idx := 0
@@ -56,4 +68,23 @@ func SliceIterator(bytes [][]byte) func() ([]byte, bool) {
 		hasNext := idx < len(bytes)
 		return value, hasNext
 	}
-}
\ No newline at end of file
+}
+
+// 长时间的操作(迁移数据库, 重建索引)用来打印进度
+type progressReporter struct {
+	step  string
+	done  int
+	total int
+}
+
+func (p *progressReporter) Start(step string, total int) {
+	p.step, p.done, p.total = step, 0, total
+	fmt.Printf("  %s: 0/%d\n", step, total)
+}
+
+func (p *progressReporter) Step() {
+	p.done++
+	if p.done%progressLogEvery == 0 || p.done == p.total {
+		fmt.Printf("  %s: %d/%d\n", p.step, p.done, p.total)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// UTXO 缓存的大小, 由 startNode 的 -dbcache 参数修改
+var utxoCacheSize int64 = 64 * 1024 * 1024
+
+const (
+	utxoCacheEntryOverhead  = 96 // 估算的每个缓存项的 map 和结构体占用的内存
+	utxoCacheOutputOverhead = 48 // 估算的每个 output 除了 ScriptPubKey 之外占用的内存
+)
+
+type utxoCacheEntry struct {
+	outs   TXOutputs // 为空时表示这笔交易的 output 全部被花费了, 写回时从数据库删除
+	height int64     // 交易所在区块的高度
+	dirty  bool      // 和数据库中的不一致, 需要写回
+	fresh  bool      // 数据库中没有这一项, 全部被花费之后直接丢掉, 不需要写回
+}
+
+// 数据库中 UTXO 集前面的一层缓存, 修改只写到缓存中, 超过大小或者关闭时一起写回数据库
+// 连接区块时读写的都是内存, 同步区块时就不会被磁盘拖慢
+type utxoCache struct {
+	lock    sync.Mutex
+	db      Storage
+	entries map[string]*utxoCacheEntry // key 为 string(txid)
+	owners  map[string]map[string]bool // string(地址 hash) => 有 output 属于这个地址的缓存项的 key
+	best    []byte                     // 缓存中的 UTXO 集对应的区块, 为 nil 时和数据库一致
+	changed bool                       // 有没有需要写回的修改
+	size    int64
+	limit   int64
+}
+
+func newUTXOCache(db Storage, limit int64) *utxoCache {
+	cache := &utxoCache{db: db, limit: limit}
+	cache.clear()
+	return cache
+}
+
+func utxoCacheEntrySize(txID string, outs TXOutputs) int64 {
+	size := int64(utxoCacheEntryOverhead + len(txID))
+	for _, out := range outs {
+		size += int64(utxoCacheOutputOverhead + len(out.ScriptPubKey))
+	}
+	return size
+}
+
+func copyOutputs(outs TXOutputs) TXOutputs {
+	result := NewTxOutputs()
+	for outIdx, out := range outs {
+		result[outIdx] = out
+	}
+	return result
+}
+
+// 调用前需要持有锁, 缓存中没有时从数据库读, 数据库中也没有时返回 nil
+func (cache *utxoCache) fetch(txID []byte) *utxoCacheEntry {
+	key := string(txID)
+	if entry, ok := cache.entries[key]; ok {
+		return entry
+	}
+
+	var stored *utxoEntry
+	cache.db.View(func(tx StorageTx) error {
+		if utxos := tx.Bucket([]byte(utxoSetBucket)).Get(txID); utxos != nil {
+			stored = deserializeUTXOEntry(utxos)
+		}
+		return nil
+	})
+
+	if stored == nil {
+		return nil
+	}
+
+	entry := &utxoCacheEntry{outs: stored.Outs, height: stored.Height}
+	cache.entries[key] = entry
+	cache.size += utxoCacheEntrySize(key, entry.outs)
+	cache.addOwners(key, entry.outs)
+	return entry
+}
+
+// 调用前需要持有锁
+func (cache *utxoCache) put(key string, entry *utxoCacheEntry) {
+	if old, ok := cache.entries[key]; ok {
+		cache.size -= utxoCacheEntrySize(key, old.outs)
+		cache.removeOwners(key, old.outs)
+	}
+
+	cache.entries[key] = entry
+	cache.size += utxoCacheEntrySize(key, entry.outs)
+	cache.addOwners(key, entry.outs)
+	cache.changed = true
+}
+
+// 调用前需要持有锁
+func (cache *utxoCache) drop(key string) {
+	if old, ok := cache.entries[key]; ok {
+		cache.size -= utxoCacheEntrySize(key, old.outs)
+		cache.removeOwners(key, old.outs)
+		delete(cache.entries, key)
+	}
+}
+
+// 调用前需要持有锁, 记录缓存项 key 中的 output 属于哪些地址
+func (cache *utxoCache) addOwners(key string, outs TXOutputs) {
+	for _, out := range outs {
+		owner := string(out.AddressHash())
+		if owner == "" {
+			continue
+		}
+
+		if cache.owners[owner] == nil {
+			cache.owners[owner] = make(map[string]bool)
+		}
+		cache.owners[owner][key] = true
+	}
+}
+
+// 调用前需要持有锁
+func (cache *utxoCache) removeOwners(key string, outs TXOutputs) {
+	for _, out := range outs {
+		owner := string(out.AddressHash())
+		if keys, ok := cache.owners[owner]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(cache.owners, owner)
+			}
+		}
+	}
+}
+
+// 返回交易中未花费的 output 和交易所在区块的高度, 没有时返回 nil
+func (cache *utxoCache) Get(txID []byte) (TXOutputs, int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry := cache.fetch(txID)
+	if entry == nil || len(entry.outs) == 0 {
+		return nil, 0
+	}
+	return copyOutputs(entry.outs), entry.height
+}
+
+// 缓存中有没有这笔交易, 有的话以缓存中的为准
+func (cache *utxoCache) Has(txID []byte) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	_, ok := cache.entries[string(txID)]
+	return ok
+}
+
+// 添加高度 height 的区块中的交易产生的 output
+// 只有 coinbase 可能和之前的交易 ID 相同, 这时需要查数据库, 确定写回时是不是要覆盖
+func (cache *utxoCache) Add(txID []byte, outs TXOutputs, height int64, mayOverwrite bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	key := string(txID)
+	fresh := true
+	if old, ok := cache.entries[key]; ok {
+		fresh = old.fresh
+	} else if mayOverwrite && cache.fetch(txID) != nil {
+		fresh = false
+	}
+
+	cache.put(key, &utxoCacheEntry{copyOutputs(outs), height, true, fresh})
+}
+
+// 花费一个 output, output 不存在时返回 false
+func (cache *utxoCache) Spend(txID []byte, outIdx int) (TXOutput, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	key := string(txID)
+	entry := cache.fetch(txID)
+	if entry == nil {
+		return TXOutput{}, false
+	}
+
+	out, ok := entry.outs[outIdx]
+	if !ok {
+		return TXOutput{}, false
+	}
+
+	outs := copyOutputs(entry.outs)
+	delete(outs, outIdx)
+
+	if len(outs) == 0 && entry.fresh {
+		cache.drop(key)
+		cache.changed = true
+	} else {
+		cache.put(key, &utxoCacheEntry{outs, entry.height, true, entry.fresh})
+	}
+
+	return out, true
+}
+
+// 回滚时恢复一个被花费的 output, height 是回滚数据中记录的 output 所在的高度
+func (cache *utxoCache) Restore(txID []byte, outIdx int, out TXOutput, height int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	key := string(txID)
+	entry := cache.fetch(txID)
+	if entry == nil {
+		entry = &utxoCacheEntry{outs: NewTxOutputs(), fresh: true}
+	}
+
+	outs := copyOutputs(entry.outs)
+	outs[outIdx] = out
+	cache.put(key, &utxoCacheEntry{outs, height, true, entry.fresh})
+}
+
+// 回滚时删除交易产生的所有 output
+func (cache *utxoCache) Remove(txID []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	key := string(txID)
+	if entry, ok := cache.entries[key]; ok && entry.fresh {
+		cache.drop(key)
+		cache.changed = true
+		return
+	}
+
+	cache.put(key, &utxoCacheEntry{NewTxOutputs(), 0, true, false})
+}
+
+func (cache *utxoCache) SetBest(hash []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.best = hash
+	cache.changed = true
+}
+
+func (cache *utxoCache) Best() []byte {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.best
+}
+
+// 遍历缓存中 pubKeyHash 下的所有 output, 只查找 owners 中记录的缓存项, fn 返回 false 时停止遍历
+func (cache *utxoCache) forEachOwnedBy(pubKeyHash []byte, fn func(txID []byte, outIdx int, out *TXOutput) bool) {
+	type cachedUTXO struct {
+		txID   []byte
+		outIdx int
+		out    TXOutput
+	}
+
+	var owned []cachedUTXO
+	cache.lock.Lock()
+	for key := range cache.owners[string(pubKeyHash)] {
+		for outIdx, out := range cache.entries[key].outs {
+			if out.IsLockedWith(pubKeyHash) {
+				owned = append(owned, cachedUTXO{[]byte(key), outIdx, out})
+			}
+		}
+	}
+	cache.lock.Unlock()
+
+	for i := range owned {
+		if !fn(owned[i].txID, owned[i].outIdx, &owned[i].out) {
+			return
+		}
+	}
+}
+
+// 超过大小时写回数据库
+func (cache *utxoCache) FlushIfFull() {
+	cache.lock.Lock()
+	full := cache.size > cache.limit
+	cache.lock.Unlock()
+
+	if full {
+		cache.Flush()
+	}
+}
+
+// 把修改写回数据库, 同时更新地址索引和 UTXO 集对应的区块, 然后清空缓存
+func (cache *utxoCache) Flush() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if !cache.changed {
+		return
+	}
+
+	err := cache.db.Update(func(tx StorageTx) error {
+		bucket := tx.Bucket([]byte(utxoSetBucket))
+		addrBucket := tx.Bucket([]byte(addrUtxoBucket))
+
+		for key, entry := range cache.entries {
+			if !entry.dirty {
+				continue
+			}
+			txID := []byte(key)
+
+			// 和数据库中的对比, 更新地址索引
+			old := NewTxOutputs()
+			if !entry.fresh {
+				if utxos := bucket.Get(txID); utxos != nil {
+					old = deserializeUTXOEntry(utxos).Outs
+				}
+			}
+
+			for outIdx, out := range old {
+				if newOut, ok := entry.outs[outIdx]; !ok || !sameOutput(out, newOut) {
+					if err := deleteAddrUtxo(addrBucket, txID, outIdx, out); err != nil {
+						return err
+					}
+				}
+			}
+			for outIdx, out := range entry.outs {
+				if oldOut, ok := old[outIdx]; !ok || !sameOutput(out, oldOut) {
+					if err := putAddrUtxo(addrBucket, txID, outIdx, out); err != nil {
+						return err
+					}
+				}
+			}
+
+			var err error
+			if len(entry.outs) == 0 {
+				err = bucket.Delete(txID)
+			} else {
+				err = bucket.Put(txID, (&utxoEntry{entry.height, entry.outs}).Serialize())
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if cache.best == nil {
+			return nil
+		}
+		return tx.Bucket(metaBucket).Put(utxoBestKey, cache.best)
+	})
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	cache.clear()
+}
+
+// 丢掉缓存中的所有内容, 重建 UTXO 集时调用
+func (cache *utxoCache) Clear() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.clear()
+}
+
+func (cache *utxoCache) clear() {
+	cache.entries = make(map[string]*utxoCacheEntry)
+	cache.owners = make(map[string]map[string]bool)
+	cache.best = nil
+	cache.changed = false
+	cache.size = 0
+}
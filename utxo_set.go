@@ -1,99 +1,299 @@
 package main
 
 import (
-	"github.com/boltdb/bolt"
 	"encoding/hex"
 	"log"
+	"bytes"
 	"fmt"
 )
 
 const utxoSetBucket = "utxoSet"
 
-// 用于存放 区块链中的所有 UTXO
+// metaBucket 中 UTXO 集对应的区块 hash, 和 UTXO 集在同一个事务中更新
+var utxoBestKey = []byte("utxoBest")
+
+// utxoSetBucket 中的 value: 交易还没有被花费的 output, 以及交易所在区块的高度, 相对时间锁从这个高度开始算
+type utxoEntry struct {
+	Height int64
+	Outs   TXOutputs
+}
+
+func (entry *utxoEntry) Serialize() []byte {
+	return GobEncode(entry)
+}
+
+func deserializeUTXOEntry(b []byte) *utxoEntry {
+	entry := &utxoEntry{}
+	GobDecode(b, entry)
+	return entry
+}
+
+// 用于存放 区块链中的所有 UTXO, 读写都经过缓存
 type UTXOSet struct {
-	bc *BlockChain
+	bc    *BlockChain
+	cache *utxoCache
 }
 
 func NewUTXOSet(bc *BlockChain) *UTXOSet {
-	return &UTXOSet{bc}
+	return &UTXOSet{bc, newUTXOCache(bc.db, utxoCacheSize)}
+}
+
+// 启动时调用, UTXO 集记录了它对应的区块, 和 tip 不一致时(上次退出时中断了)从那个区块更新到 tip
+// 没有记录时(第一次创建或者重建被中断了)从创世区块重建
+func (set *UTXOSet) Init(reindex bool) {
+	best := set.BestBlock()
+
+	if reindex || best == nil {
+		set.Reindex()
+		return
+	}
+
+	set.catchUp(best)
 }
 
-// 每次生成新区块链的时候调用
+// 清空 UTXO 集, 从创世区块开始重建, 缓存满了就写回一次, 中断之后下次启动时从最后写回的区块继续
 func (set *UTXOSet) Reindex() {
+	if set.bc.IsPruned() {
+		log.Panic("ERROR: Can't reindex the UTXO set of a pruned chain")
+	}
+
+	fmt.Println("Reindexing the UTXO set")
+
 	db := set.bc.db
 	bucketName := []byte(utxoSetBucket)
-	db.Update(func(tx *bolt.Tx) error {
+	addrBucketName := []byte(addrUtxoBucket)
+	err := db.Update(func(tx StorageTx) error {
 		tx.DeleteBucket(bucketName)
-		tx.CreateBucket(bucketName)
-		return nil
-	})
-
-	utxos := set.bc.FindAllUTXOs()
+		tx.DeleteBucket(addrBucketName)
+		if _, err := tx.CreateBucket(bucketName); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(addrBucketName); err != nil {
+			return err
+		}
 
-	db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Delete(utxoBestKey)
+	})
 
-		bucket := tx.Bucket(bucketName)
+	if err != nil {
+		log.Panic(err)
+	}
 
-		for txID, outs := range utxos {
-			txId, _ := hex.DecodeString(txID)
-			err := bucket.Put(txId, outs.Serialize())
+	set.cache.Clear()
+	set.catchUp(nil)
+}
 
-			if err != nil {
-				log.Panic(err)
-				return err
+// UTXO 集对应的区块, 没有时返回 nil
+func (set *UTXOSet) BestBlock() []byte {
+	best := set.cache.Best()
+	if best != nil {
+		return best
+	}
+
+	set.bc.db.View(func(tx StorageTx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil && tx.Bucket([]byte(utxoSetBucket)) != nil {
+			if value := meta.Get(utxoBestKey); value != nil {
+				best = append([]byte{}, value...)
 			}
 		}
-
 		return nil
 	})
-}
 
-// 每生成一个区块后 更行UTXO StringSet
-func (set *UTXOSet) Update(b *Block) {
+	return best
+}
 
-	db := set.bc.db
+// 把 UTXO 集从 best 更新到 tip, best 为 nil 时从创世区块开始
+func (set *UTXOSet) catchUp(best []byte) {
+	bc := set.bc
 
-	db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(utxoSetBucket))
+	// 回滚中断时 best 可能在分支上, 先回滚到主链
+	for best != nil {
+		header := bc.GetBlockHeader(best)
+		if bytes.Equal(bc.GetBlockHash(header.Height), best) {
+			break
+		}
 
-		for _, tx := range b.Transactions {
+		block := bc.GetBlock(best)
+		set.Rollback(block, bc.readUndo(block))
+		best = block.PrevBlockHash
+	}
+
+	from := int64(0)
+	if best != nil {
+		from = bc.GetBlockHeader(best).Height + 1
+	}
+	to := bc.GetBestHeight()
+	if from > to {
+		return
+	}
+
+	progress := &progressReporter{}
+	progress.Start("connect blocks to the UTXO set", int(to-from+1))
+
+	for height := from; height <= to; height++ {
+		set.Update(bc.GetBlockByHeight(height))
+		progress.Step()
+	}
+
+	set.Flush()
+}
 
+// 每生成一个区块后 更行UTXO StringSet
+func (set *UTXOSet) Update(b *Block) {
+	for _, tx := range b.Transactions {
 
-			// 把所有产生的UTXO添加到set中
-			outs := NewTxOutputs()
-			for outIdx, out := range tx.Vout {
+		// 把所有产生的UTXO添加到set中, 不能被花费的 output 不用添加
+		outs := NewTxOutputs()
+		for outIdx, out := range tx.Vout {
+			if !IsUnspendable(out.ScriptPubKey) {
 				outs[outIdx] = out
 			}
+		}
+		set.cache.Add(tx.ID, outs, b.Height, tx.IsCoinbase())
 
-			fmt.Printf("update添加的 txID %x\n", tx.ID)
-			bucket.Put(tx.ID, outs.Serialize())
+		if tx.IsCoinbase() {
+			continue
+		}
 
-			if tx.IsCoinbase() {
-				continue
+		// 删除花费掉的 output
+		for _, in := range tx.Vin {
+			if _, ok := set.cache.Spend(in.Txid, in.Vout); !ok {
+				log.Panicf("ERROR: Output %x:%d is not in the UTXO set", in.Txid, in.Vout)
 			}
+		}
+	}
 
-			// 删除花费掉的 output
-			for _, in := range tx.Vin {
-				utxos := bucket.Get(in.Txid) // 当前in.Txid下所有的UTXO
+	set.cache.SetBest(b.Hash)
+	set.cache.FlushIfFull()
+}
+
+// 把缓存中的修改写回数据库, 关闭区块链和裁剪区块之前调用
+func (set *UTXOSet) Flush() {
+	set.cache.Flush()
+}
 
-				outs := DeserializeOutputs(utxos)
-				delete(outs, in.Vout)
+// 在更新 UTXO 集之前调用, 找出区块中每个 input 花费掉的 output 和它所在的高度, 作为区块的回滚数据
+// 被花费的 output 必须在 UTXO 集中或者是同一个区块中前面的交易产生的, 并且只能被花费一次
+func (set *UTXOSet) SpentOutputs(b *Block) (*blockUndo, error) {
+	undo := &blockUndo{make([][]TXOutput, len(b.Transactions)), make([][]int64, len(b.Transactions))}
+	created := make(map[string]TXOutputs) // 同一个区块中前面的交易产生的 output
+	spent := make(map[string]bool)        // 区块中已经被花费的 output, txID:outIdx
+
+	for i, transaction := range b.Transactions {
+		if !transaction.IsCoinbase() {
+			for _, in := range transaction.Vin {
+				outpoint := fmt.Sprintf("%x:%d", in.Txid, in.Vout)
+				if spent[outpoint] {
+					return nil, fmt.Errorf("transaction %x spends output %s which is already spent in the block", transaction.ID, outpoint)
+				}
+				spent[outpoint] = true
 
-				if len(outs) == 0 {
-					bucket.Delete(in.Txid)
-				} else {
-					bucket.Put(in.Txid, outs.Serialize())
+				outs, ok := created[hex.EncodeToString(in.Txid)]
+				height := b.Height
+				if !ok {
+					outs, height = set.cache.Get(in.Txid)
+				}
+				out, ok := outs[in.Vout]
+				if !ok {
+					return nil, fmt.Errorf("transaction %x spends output %s which is not in the UTXO set", transaction.ID, outpoint)
 				}
 
+				undo.SpentOutputs[i] = append(undo.SpentOutputs[i], out)
+				undo.SpentHeights[i] = append(undo.SpentHeights[i], height)
+			}
+		}
+
+		outs := NewTxOutputs()
+		for outIdx, out := range transaction.Vout {
+			if !IsUnspendable(out.ScriptPubKey) {
+				outs[outIdx] = out
 			}
+		}
+		created[hex.EncodeToString(transaction.ID)] = outs
+	}
+
+	return undo, nil
+}
+
+// 交易的每个 input 花费的 output 和它所在的高度, 必须都在 UTXO 集中, 并且不能被花费两次
+func (set *UTXOSet) InputOutputs(tx *Transaction) ([]TXOutput, []int64, error) {
+	var outs []TXOutput
+	var heights []int64
+	spent := make(map[string]bool)
+
+	for _, in := range tx.Vin {
+		outpoint := fmt.Sprintf("%x:%d", in.Txid, in.Vout)
+		prevOuts, height := set.cache.Get(in.Txid)
+		out, ok := prevOuts[in.Vout]
+		if !ok || spent[outpoint] {
+			return nil, nil, fmt.Errorf("transaction %x spends output %s which is not in the UTXO set", tx.ID, outpoint)
+		}
+		spent[outpoint] = true
+		outs = append(outs, out)
+		heights = append(heights, height)
+	}
+	return outs, heights, nil
+}
+
+// 交易的 output 所在区块的高度, 交易的 output 都已经被花费时返回 -1
+func (set *UTXOSet) CoinHeight(txID []byte) int64 {
+	outs, height := set.cache.Get(txID)
+	if outs == nil {
+		return -1
+	}
+	return height
+}
+
+// 区块被回滚时调用, 删除区块产生的 output, 用回滚数据恢复区块花费掉的 output
+func (set *UTXOSet) Rollback(b *Block, undo *blockUndo) {
+
+	// 倒序处理, 同一个区块内被花费的 output 会先恢复再被删除
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		transaction := b.Transactions[i]
+		set.cache.Remove(transaction.ID)
 
+		if transaction.IsCoinbase() {
+			continue
 		}
 
+		for inIdx, in := range transaction.Vin {
+			set.cache.Restore(in.Txid, in.Vout, undo.SpentOutputs[i][inIdx], undo.SpentHeights[i][inIdx])
+		}
+	}
+
+	set.cache.SetBest(b.PrevBlockHash)
+	set.cache.FlushIfFull()
+}
+
+// 用 UTXO 集中的数据构造交易, 只包含未花费的 output, 已花费的 output 为空
+// 区块被裁剪之后, 签名和验证交易时用它代替完整的交易
+func (set *UTXOSet) FindTx(txID []byte) *Transaction {
+	outs, _ := set.cache.Get(txID)
+	if outs == nil {
 		return nil
-	})
+	}
+
+	maxIdx := 0
+	for outIdx := range outs {
+		if outIdx > maxIdx {
+			maxIdx = outIdx
+		}
+	}
+
+	vout := make([]TXOutput, maxIdx+1)
+	for outIdx, out := range outs {
+		vout[outIdx] = out
+	}
+
+	return &Transaction{ID: txID, Vout: vout}
 }
 
-func (set *UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+// spendable 返回 false 的 output 不会被选中
+func (set *UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int, spendable func(txID []byte, out *TXOutput) bool) (int, map[string][]int) {
 
 	var spendableOutputs = make(map[string][]int) // 同一个 tx 下会有多个转入同一个地址的 output 吗?
 
@@ -102,60 +302,60 @@ func (set *UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, ma
 	// 但是如果考虑进手续费的话, 一个交易最多有3个output, 一个是买方地址，一个是找零地址, 还有挖出区块的人收的手续费的地址;
 	// 如果这笔交易是转给 A 地址, 同时 A 挖出了区块, 要收手续费的话, 就会在一个交易中有两个output同时转入 A 地址下.
 	accumulate := 0
-	db := set.bc.db
-
-	db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(utxoSetBucket))
-		cursor := bucket.Cursor()
-		// Cursor represents an iterator that can traverse over all key/value pairs in a bucket in sorted order.
 
-
-		// 循环遍历了每一个 Output
-		for key, value := cursor.First(); key != nil && accumulate < amount; key, value = cursor.Next() {
-			txID := hex.EncodeToString(key)
-			outs := DeserializeOutputs(value)
-
-			for outIdx, out := range outs {
-
-				if out.IsLockedWith(pubKeyHash) {
-
-					accumulate += out.Value
-					spendableOutputs[txID] = append(spendableOutputs[txID], outIdx)
-				}
-			}
+	set.forEachAddrUTXO(pubKeyHash, func(txID []byte, outIdx int, out *TXOutput) bool {
+		if !spendable(txID, out) {
+			return true
 		}
-		return nil
+
+		accumulate += out.Value
+		key := hex.EncodeToString(txID)
+		spendableOutputs[key] = append(spendableOutputs[key], outIdx)
+		return accumulate < amount
 	})
 
 	return accumulate, spendableOutputs
 }
 
 func (set *UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
-	db := set.bc.db
 	var outputs []TXOutput
 
-	db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(utxoSetBucket))
-		cursor := bucket.Cursor()
-		// Cursor represents an iterator that can traverse over all key/value pairs in a bucket in sorted order.
+	set.forEachAddrUTXO(pubKeyHash, func(txID []byte, outIdx int, out *TXOutput) bool {
+		outputs = append(outputs, *out)
+		return true
+	})
 
-		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+	return outputs
+}
 
-			fmt.Printf("FindUTXO 遍历的: txID %x\n", key)
-			outs := DeserializeOutputs(value)
-			for _, out := range outs {
+// 通过地址索引遍历 pubKeyHash 下的所有 UTXO, fn 返回 false 时停止遍历
+// 缓存中还没写回的交易以缓存为准, 其他的从数据库的地址索引中取
+func (set *UTXOSet) forEachAddrUTXO(pubKeyHash []byte, fn func(txID []byte, outIdx int, out *TXOutput) bool) {
+	stopped := false
+	set.cache.forEachOwnedBy(pubKeyHash, func(txID []byte, outIdx int, out *TXOutput) bool {
+		stopped = !fn(txID, outIdx, out)
+		return !stopped
+	})
 
+	if stopped {
+		return
+	}
 
-				fmt.Printf("FindUTXO的PubKeyHash: %x\n", pubKeyHash)
-				fmt.Printf("tx中的PubKeyHash    : %x\n", out.PubKeyHash)
+	db := set.bc.db
 
-				if out.IsLockedWith(pubKeyHash) {
-					outputs = append(outputs, out)
-				}
+	db.View(func(tx StorageTx) error {
+		cursor := tx.Bucket([]byte(addrUtxoBucket)).Cursor()
+
+		for key, value := cursor.Seek(pubKeyHash); key != nil && bytes.HasPrefix(key, pubKeyHash); key, value = cursor.Next() {
+			txID, outIdx := parseAddrUtxoKey(pubKeyHash, key)
+			if set.cache.Has(txID) {
+				continue
+			}
+
+			if !fn(txID, outIdx, DeserializeOutput(value)) {
+				break
 			}
 		}
 		return nil
 	})
-
-	return outputs
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// 校验的级别, 高级别包含低级别的所有检查
+//
+//	0: 工作量证明, 区块头和前一个区块的链接, 高度索引
+//	1: 区块数据和区块头一致, Merkle root 和 witness commitment 正确
+//	2: 用回滚数据校验交易签名和金额
+//	3: 从创世区块重放整条链, 和保存的 UTXO 集以及回滚数据对比
+const (
+	verifyLevelHeader = iota
+	verifyLevelMerkle
+	verifyLevelSignature
+	verifyLevelUTXO
+	maxVerifyLevel = verifyLevelUTXO
+)
+
+// 启动时的检查, 由 startNode 的参数修改, depth 为 0 时校验整条链, level 为 -1 时不检查
+var (
+	startupCheckDepth int64 = 6
+	startupCheckLevel       = verifyLevelSignature
+)
+
+// 校验失败的区块, Height 为 -1 时表示不是某个区块的问题
+type chainVerifyError struct {
+	Height int64
+	Hash   []byte
+	Level  int
+	Reason string
+}
+
+func (e *chainVerifyError) Error() string {
+	if e.Height < 0 {
+		return fmt.Sprintf("level %d: %s", e.Level, e.Reason)
+	}
+	return fmt.Sprintf("block %x at height %d failed level %d check: %s", e.Hash, e.Height, e.Level, e.Reason)
+}
+
+// 校验主链上最后 depth 个区块, depth 为 0 时校验整条链, 返回第一个(高度最低的)出错的区块
+// 已经被裁剪的区块只校验区块头
+func (bc *BlockChain) VerifyChain(depth int64, level int) error {
+	if level > maxVerifyLevel {
+		level = maxVerifyLevel
+	}
+
+	best := bc.GetBestHeight()
+	from := int64(0)
+	if depth > 0 && best-depth+1 > 0 {
+		from = best - depth + 1
+	}
+
+	if !bytes.Equal(bc.GetBlockHash(best), bc.tip) {
+		return &chainVerifyError{best, bc.tip, verifyLevelHeader, "tip is not in the height index"}
+	}
+
+	for height := from; height <= best; height++ {
+		if err := bc.verifyBlock(height, level); err != nil {
+			return err
+		}
+	}
+
+	if level >= verifyLevelUTXO {
+		return bc.verifyUTXOSet()
+	}
+
+	return nil
+}
+
+// 启动时调用, 校验失败时拒绝启动
+func (bc *BlockChain) startupCheck() {
+	if startupCheckLevel < 0 {
+		return
+	}
+
+	if err := bc.VerifyChain(startupCheckDepth, startupCheckLevel); err != nil {
+		log.Panicf("ERROR: Chain verification failed, run with -reindex or resync the chain: %s", err)
+	}
+}
+
+// 区块数据损坏时反序列化会 panic, 这里转成错误, 这样能报告出是哪个区块
+func (bc *BlockChain) verifyBlock(height int64, level int) (err error) {
+	hash := bc.GetBlockHash(height)
+
+	fail := func(level int, format string, a ...interface{}) error {
+		return &chainVerifyError{height, hash, level, fmt.Sprintf(format, a...)}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fail(level, "%v", r)
+		}
+	}()
+
+	if hash == nil {
+		return fail(verifyLevelHeader, "missing from the height index")
+	}
+
+	entry := bc.getBlockIndex(hash)
+	if entry == nil {
+		return fail(verifyLevelHeader, "missing from the block index")
+	}
+
+	header := &entry.Header
+	if !bytes.Equal(header.Hash, hash) || header.Height != height {
+		return fail(verifyLevelHeader, "block index entry is for block %x at height %d", header.Hash, header.Height)
+	}
+	if !ValidateHeader(header) {
+		return fail(verifyLevelHeader, "invalid proof of work")
+	}
+	if height > 0 && !bytes.Equal(header.PrevBlockHash, bc.GetBlockHash(height-1)) {
+		return fail(verifyLevelHeader, "previous block hash %x does not match the main chain", header.PrevBlockHash)
+	}
+	if height == 0 && len(header.PrevBlockHash) != 0 {
+		return fail(verifyLevelHeader, "genesis block has a previous block hash")
+	}
+
+	if level < verifyLevelMerkle || entry.Pruned {
+		return nil
+	}
+
+	data, err := bc.blockFiles.Read(entry.Pos)
+	if err != nil {
+		return fail(verifyLevelMerkle, "can't read block data: %s", err)
+	}
+
+	block, err := DeserializeBlock(data)
+	if err != nil {
+		return fail(verifyLevelMerkle, "can't decode block data: %s", err)
+	}
+	if !bytes.Equal(block.Hash, hash) || block.Height != height || !bytes.Equal(block.PrevBlockHash, header.PrevBlockHash) ||
+		block.Timestamp != header.Timestamp || block.Nonce != header.Nonce {
+		return fail(verifyLevelMerkle, "block data does not match the header")
+	}
+	if len(block.Transactions) == 0 || len(block.Transactions) != entry.TxCount {
+		return fail(verifyLevelMerkle, "expected %d transactions, got %d", entry.TxCount, len(block.Transactions))
+	}
+	if tree := block.MerkleTree(); !bytes.Equal(tree.Root.Data, header.TxsHash) {
+		return fail(verifyLevelMerkle, "merkle root mismatch")
+	} else if tree.Mutated {
+		return fail(verifyLevelMerkle, "duplicate transactions in the merkle tree")
+	}
+	if !block.CheckWitnessCommitment() {
+		return fail(verifyLevelMerkle, "witness commitment mismatch")
+	}
+
+	if level < verifyLevelSignature {
+		return nil
+	}
+
+	return bc.verifyBlockTxs(block, entry, fail)
+}
+
+// 被花费的 output 从回滚数据中取, 所以之前的区块被裁剪了也能校验
+func (bc *BlockChain) verifyBlockTxs(block *Block, entry *blockIndexEntry, fail func(int, string, ...interface{}) error) error {
+	coinbases := 0
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+	}
+	if coinbases != 1 {
+		return fail(verifyLevelSignature, "expected 1 coinbase transaction, got %d", coinbases)
+	}
+
+	if block.Height == 0 {
+		return nil
+	}
+
+	if !entry.HasUndo {
+		return fail(verifyLevelSignature, "missing undo data")
+	}
+
+	undoData, err := bc.blockFiles.ReadUndo(entry.UndoPos)
+	if err != nil {
+		return fail(verifyLevelSignature, "can't read undo data: %s", err)
+	}
+
+	undo := deserializeBlockUndo(undoData)
+	if len(undo.SpentOutputs) != len(block.Transactions) || len(undo.SpentHeights) != len(block.Transactions) {
+		return fail(verifyLevelSignature, "undo data has %d transactions, block has %d", len(undo.SpentOutputs), len(block.Transactions))
+	}
+
+	var checks []inputCheck
+	for i, tx := range block.Transactions {
+		if err := checkDataOutputs(tx); err != nil {
+			return fail(verifyLevelSignature, "%s", err)
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		spent := undo.SpentOutputs[i]
+		if len(spent) != len(tx.Vin) || len(undo.SpentHeights[i]) != len(tx.Vin) {
+			return fail(verifyLevelSignature, "tx %x: undo data has %d inputs, tx has %d", tx.ID, len(spent), len(tx.Vin))
+		}
+
+		in, out := 0, 0
+		for _, prevOut := range spent {
+			in += prevOut.Value
+		}
+
+		for _, vout := range tx.Vout {
+			out += vout.Value
+		}
+
+		if out > in {
+			return fail(verifyLevelSignature, "tx %x spends %d but only has %d", tx.ID, out, in)
+		}
+		if err := bc.CheckTxLocks(tx, block.Height, undo.SpentHeights[i]); err != nil {
+			return fail(verifyLevelSignature, "%s", err)
+		}
+
+		// 用被花费的 output 构造 Verify 需要的之前的交易
+		txChecks, err := tx.inputChecks(prevTxsFromOutputs(tx, spent))
+		if err != nil {
+			return fail(verifyLevelSignature, "%s", err)
+		}
+		checks = append(checks, txChecks...)
+	}
+
+	// 整个区块的签名一起并行验证
+	if err := runInputChecks(checks); err != nil {
+		return fail(verifyLevelSignature, "invalid signature: %s", err)
+	}
+	return nil
+}
+
+// 从创世区块开始重新计算 UTXO 集, 检查每个区块的回滚数据, 最后和保存的 UTXO 集对比
+func (bc *BlockChain) verifyUTXOSet() error {
+	if bc.IsPruned() {
+		fmt.Println("Skipping UTXO set check: blocks below the prune height are gone")
+		return nil
+	}
+
+	bc.utxoSet.Flush() // 下面直接读数据库中的 UTXO 集
+
+	utxos, createdAt, err := bc.replayUTXOs(bc.GetBestHeight(), nil)
+	if err != nil {
+		return err
+	}
+
+	// 对比保存的 UTXO 集
+	bc.db.View(func(tx StorageTx) error {
+		cursor := tx.Bucket([]byte(utxoSetBucket)).Cursor()
+
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			txID := hex.EncodeToString(key)
+			entry := deserializeUTXOEntry(value)
+			stored := entry.Outs
+			expected, ok := utxos[txID]
+
+			if !ok {
+				err = &chainVerifyError{-1, nil, verifyLevelUTXO, fmt.Sprintf("UTXO set has unexpected tx %s", txID)}
+				return nil
+			}
+			if entry.Height != createdAt[txID] {
+				reason := fmt.Sprintf("UTXO set entry for tx %s is at height %d", txID, entry.Height)
+				err = &chainVerifyError{createdAt[txID], bc.GetBlockHash(createdAt[txID]), verifyLevelUTXO, reason}
+				return nil
+			}
+
+			for outIdx, out := range expected {
+				if storedOut, ok := stored[outIdx]; !ok || !sameOutput(out, storedOut) {
+					err = bc.utxoMismatch(createdAt[txID], txID, outIdx)
+					return nil
+				}
+			}
+			for outIdx := range stored {
+				if _, ok := expected[outIdx]; !ok {
+					err = bc.utxoMismatch(createdAt[txID], txID, outIdx)
+					return nil
+				}
+			}
+
+			delete(utxos, txID)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for txID := range utxos {
+		for outIdx := range utxos[txID] {
+			return bc.utxoMismatch(createdAt[txID], txID, outIdx)
+		}
+	}
+
+	return nil
+}
+
+// 从创世区块重放主链到 to, 返回这时的 UTXO 集(key 为 hex 编码的 txid)和每笔交易所在的高度
+// 区块有回滚数据时(从快照启动后下载的历史区块没有)同时检查回滚数据, 返回第一个出错的区块
+// check 不为 nil 时, 每个区块重放之后用重放得到的回滚数据调用它
+func (bc *BlockChain) replayUTXOs(to int64, check func(block *Block, undo *blockUndo) error) (utxos map[string]TXOutputs, createdAt map[string]int64, err error) {
+	utxos = make(map[string]TXOutputs)
+	createdAt = make(map[string]int64)
+
+	var height int64
+	defer func() {
+		if r := recover(); r != nil {
+			err = &chainVerifyError{height, bc.GetBlockHash(height), verifyLevelUTXO, fmt.Sprint(r)}
+		}
+	}()
+
+	for height = 0; height <= to; height++ {
+		block := bc.GetBlockByHeight(height)
+
+		var undo *blockUndo
+		if bc.getBlockIndex(block.Hash).HasUndo {
+			undo = bc.readUndo(block)
+		}
+
+		fail := func(format string, a ...interface{}) error {
+			return &chainVerifyError{height, block.Hash, verifyLevelUTXO, fmt.Sprintf(format, a...)}
+		}
+
+		replayed := &blockUndo{make([][]TXOutput, len(block.Transactions)), make([][]int64, len(block.Transactions))}
+		for i, tx := range block.Transactions {
+			if !tx.IsCoinbase() {
+				for inIdx, in := range tx.Vin {
+					txID := hex.EncodeToString(in.Txid)
+					out, ok := utxos[txID][in.Vout]
+					if !ok {
+						return nil, nil, fail("tx %x spends missing output %x:%d", tx.ID, in.Txid, in.Vout)
+					}
+					if undo != nil && (!sameOutput(out, undo.SpentOutputs[i][inIdx]) || undo.SpentHeights[i][inIdx] != createdAt[txID]) {
+						return nil, nil, fail("undo data for output %x:%d is wrong", in.Txid, in.Vout)
+					}
+					replayed.SpentOutputs[i] = append(replayed.SpentOutputs[i], out)
+					replayed.SpentHeights[i] = append(replayed.SpentHeights[i], createdAt[txID])
+
+					delete(utxos[txID], in.Vout)
+					if len(utxos[txID]) == 0 {
+						delete(utxos, txID)
+					}
+				}
+			}
+
+			// 和 UTXOSet.Update 一样, 相同 ID 的交易会覆盖之前的 output
+			txID := hex.EncodeToString(tx.ID)
+			utxos[txID] = NewTxOutputs()
+			for outIdx, out := range tx.Vout {
+				if !IsUnspendable(out.ScriptPubKey) {
+					utxos[txID][outIdx] = out
+				}
+			}
+			createdAt[txID] = height
+		}
+
+		if check != nil {
+			if err := check(block, replayed); err != nil {
+				return nil, nil, fail("%s", err)
+			}
+		}
+	}
+
+	return utxos, createdAt, nil
+}
+
+func (bc *BlockChain) utxoMismatch(height int64, txID string, outIdx int) error {
+	reason := fmt.Sprintf("UTXO set entry for output %s:%d does not match the chain", txID, outIdx)
+	return &chainVerifyError{height, bc.GetBlockHash(height), verifyLevelUTXO, reason}
+}
+
+func sameOutput(a, b TXOutput) bool {
+	return a.Value == b.Value && bytes.Equal(a.ScriptPubKey, b.ScriptPubKey)
+}
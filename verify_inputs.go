@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// 一个 input 的脚本验证, 同一个区块中所有交易的 input 放在一起并行验证
+type inputCheck struct {
+	tx      *Transaction
+	inIdx   int
+	prevOut *TXOutput
+	sigHash []byte
+}
+
+func (c *inputCheck) run() error {
+	ctx := &scriptContext{c.tx, c.inIdx, c.sigHash}
+	if err := VerifyScript(c.tx.Vin[c.inIdx].ScriptSig, c.prevOut.ScriptPubKey, ctx); err != nil {
+		return fmt.Errorf("input %d of transaction %x: %s", c.inIdx, c.tx.ID, err)
+	}
+	return nil
+}
+
+// 交易每个 input 需要的验证, 找不到被花费的 output 时返回错误
+func (tx *Transaction) inputChecks(prevTxs map[string]*Transaction) ([]inputCheck, error) {
+	copyTx := tx.TrimmedCopy()
+	copyTx.Hash()
+
+	checks := make([]inputCheck, 0, len(tx.Vin))
+	for inIdx, in := range tx.Vin {
+		prevTx := prevTxs[hex.EncodeToString(in.Txid)]
+		if prevTx == nil || in.Vout < 0 || in.Vout >= len(prevTx.Vout) {
+			return nil, fmt.Errorf("input %d of transaction %x spends an unknown output %x:%d", inIdx, tx.ID, in.Txid, in.Vout)
+		}
+		checks = append(checks, inputCheck{tx, inIdx, &prevTx.Vout[in.Vout], copyTx.ID})
+	}
+	return checks, nil
+}
+
+// 用每个 input 花费的 output 构造 inputChecks 需要的之前的交易, 其他 output 为空
+func prevTxsFromOutputs(tx *Transaction, spent []TXOutput) map[string]*Transaction {
+	prevTxs := make(map[string]*Transaction)
+	for inIdx, in := range tx.Vin {
+		txID := hex.EncodeToString(in.Txid)
+		if prevTxs[txID] == nil {
+			prevTxs[txID] = &Transaction{ID: in.Txid}
+		}
+
+		prevTx := prevTxs[txID]
+		for len(prevTx.Vout) <= in.Vout {
+			prevTx.Vout = append(prevTx.Vout, TXOutput{})
+		}
+		prevTx.Vout[in.Vout] = spent[inIdx]
+	}
+	return prevTxs
+}
+
+// 标准 P2PKH input 中的 Schnorr 签名先批量验证, 通过之后放进 sigCache, 执行脚本时就不用一个一个验证了
+// 批量验证失败时不做任何事, 执行脚本时会找到无效的签名
+func batchVerifySchnorr(checks []inputCheck) {
+	var items []schnorrBatchItem
+	var pubKeys [][]byte
+
+	for i := range checks {
+		check := &checks[i]
+		pubKeyHash := ExtractPubKeyHash(check.prevOut.ScriptPubKey)
+		pushes := scriptPushes(check.tx.Vin[check.inIdx].ScriptSig)
+		if pubKeyHash == nil || len(pushes) != 2 {
+			continue
+		}
+
+		sig, pubKey := pushes[0], pushes[1]
+		scheme, key, ok := parsePubKey(pubKey)
+		if !ok || scheme != SigSchemeSchnorr || !bytes.Equal(HashPubKey(pubKey), pubKeyHash) ||
+			sigCache.Contains(check.sigHash, pubKey, sig) {
+			continue
+		}
+
+		items = append(items, schnorrBatchItem{key, check.sigHash, sig})
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	if len(items) < 2 || !schnorrBatchVerify(items) {
+		return
+	}
+	for i, item := range items {
+		sigCache.Add(item.msg, pubKeys[i], item.sig)
+	}
+}
+
+// 用 CPU 个数的 goroutine 并行验证, 有一个失败时不再分发剩下的验证, 返回第一个错误
+func runInputChecks(checks []inputCheck) error {
+	batchVerifySchnorr(checks)
+
+	workers := runtime.NumCPU()
+	if workers > len(checks) {
+		workers = len(checks)
+	}
+
+	jobs := make(chan *inputCheck)
+	failed := make(chan struct{})
+	var firstErr error
+	var once sync.Once
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range jobs {
+				if err := check.run(); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := range checks {
+		select {
+		case jobs <- &checks[i]:
+		case <-failed:
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
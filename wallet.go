@@ -1,9 +1,6 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"bytes"
@@ -12,15 +9,21 @@ import (
 	"fmt"
 	"os"
 	"encoding/hex"
+	"errors"
+	"math/big"
 	"golang.org/x/crypto/ripemd160"
 )
 
-const version = byte(0x01)
+// 公钥 hash 地址 (P2PKH) 的版本由签名方案决定, 见 sig_scheme.go
+const version = byte(0x01)          // P-256 公钥 hash 地址的版本
+const secp256k1Version = byte(0x02) // secp256k1 ECDSA 公钥 hash 地址的版本
+const schnorrVersion = byte(0x03)   // Schnorr 公钥 hash 地址的版本
+const p2shVersion = byte(0x05)      // 脚本 hash 地址 (P2SH) 的版本
 const addressChecksumLen = 4
 
 type Wallet struct {
-	PrivateKey ecdsa.PrivateKey
-	PublicKey  []byte
+	PrivateKey PrivateKey
+	PublicKey  []byte // 带签名方案字节的公钥
 }
 
 type Wallets struct {
@@ -28,33 +31,74 @@ type Wallets struct {
 }
 
 func NewWallet() *Wallet {
-	privKey, pubKey := newKeyPair()
-	wallet := Wallet{privKey, pubKey}
-	return &wallet
+	return NewWalletWithScheme(defaultSigScheme)
 }
 
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
-
-	curve := elliptic.P256()
-	privateKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
-
-	publicKey := append(privateKey.PublicKey.X.Bytes(), privateKey.PublicKey.Y.Bytes()...) // 两个slice拼接在一起
-
-	return *privateKey, publicKey
-
+func NewWalletWithScheme(scheme SigScheme) *Wallet {
+	privKey := NewPrivateKey(scheme)
+	wallet := Wallet{privKey, privKey.PublicKey()}
+	return &wallet
 }
 
+// 地址的版本表示钱包使用的签名方案
 func (w *Wallet) GetAddress() []byte {
 	hashPubKey := HashPubKey(w.PublicKey)
 
+	return encodeAddress(w.PrivateKey.Scheme.impl().AddressVersion(), hashPubKey)
+}
+
+// 脚本的 P2SH 地址 (比如多重签名或者 HTLC), 花费时需要提供 redeem script
+func NewP2SHAddress(redeemScript []byte) []byte {
+	if err := checkRedeemScriptSize(redeemScript); err != nil {
+		log.Panic("ERROR: ", err)
+	}
 
-	versionedPayload := append([]byte{version}, hashPubKey...)
+	return encodeAddress(p2shVersion, HashPubKey(redeemScript))
+}
+
+func encodeAddress(addrVersion byte, hash []byte) []byte {
+	versionedPayload := append([]byte{addrVersion}, hash...)
 	checkSum := checkSum(versionedPayload)
 
 	fullPayload := append(versionedPayload, checkSum...)
 	return Base58Encode(fullPayload)
 }
 
+// 返回地址的版本和其中的 hash, 地址不正确时 panic
+func decodeAddress(addr string) (byte, []byte) {
+	addrBytes, err := hex.DecodeString(addr)
+	if err != nil {
+		log.Panicf("ERROR: Invalid address '%s'", addr)
+	}
+
+	fullPayload := Base58Decode(addrBytes)
+	if len(fullPayload) != 1+pubKeyHashLen+addressChecksumLen {
+		log.Panicf("ERROR: Invalid address '%s'", addr)
+	}
+
+	versionedPayload := fullPayload[:len(fullPayload)-addressChecksumLen]
+	if !bytes.Equal(checkSum(versionedPayload), fullPayload[len(versionedPayload):]) {
+		log.Panicf("ERROR: Invalid address checksum '%s'", addr)
+	}
+
+	return versionedPayload[0], versionedPayload[1:]
+}
+
+// 转到地址的 ScriptPubKey, 根据地址的版本选择 P2PKH 或者 P2SH
+func ScriptForAddress(addr string) []byte {
+	addrVersion, hash := decodeAddress(addr)
+
+	switch {
+	case isP2PKHVersion(addrVersion):
+		return NewP2PKHScript(hash)
+	case addrVersion == p2shVersion:
+		return NewP2SHScript(hash)
+	}
+
+	log.Panicf("ERROR: Unknown address version %d", addrVersion)
+	return nil
+}
+
 func GetPubKeyHashFromAddr(addr string) []byte {
 
 	addrBytes, _ := hex.DecodeString(addr)
@@ -95,7 +139,6 @@ func (w *Wallet) SaveToFile(fileName string) bool {
 	}
 
 	var buf bytes.Buffer
-	gob.Register(elliptic.P256())
 
 	encoder := gob.NewEncoder(&buf)
 	encoder.Encode(w)
@@ -111,36 +154,53 @@ func ReadWalletFromFile(fileName string) (*Wallet, error) {
 		return nil, err
 	}
 
-	gob.Register(elliptic.P256())
-
-	content, _ := ioutil.ReadFile(fileName)
-	buf := bytes.NewReader(content)
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
 
-	decoder := gob.NewDecoder(buf)
 	var wallet Wallet
-	decoder.Decode(&wallet)
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&wallet)
+	if err == nil {
+		if _, _, ok := parsePubKey(wallet.PublicKey); !ok || len(wallet.PrivateKey.D) != 32 {
+			err = errors.New("invalid key")
+		}
+	}
+
+	if err != nil {
+		if isLegacyWallet(content) {
+			err = fmt.Errorf("%s was created by an old version with a P-256 key without a signature scheme, "+
+				"coins sent to it can only be spent by the old version, create a new wallet with createWallet", fileName)
+		} else {
+			err = fmt.Errorf("can't read wallet %s: %s", fileName, err)
+		}
+		fmt.Println(err)
+		return nil, err
+	}
 	return &wallet, nil
 }
 
-// 返回 16 进制的 private key public key
-func (w *Wallet) String() string {
-
-	var buf bytes.Buffer
-	gob.Register(elliptic.P256())
-
-	encoder := gob.NewEncoder(&buf)
-	err := encoder.Encode(w.PrivateKey)
-
-	if err != nil {
-		log.Panic(err)
+// 旧版本的钱包直接保存 ecdsa.PrivateKey, 公钥是没有签名方案字节的 X||Y
+// 旧版本的地址是这个公钥的 hash, 现在的钱包签名时用带签名方案字节的公钥, 所以不能转换成现在的格式
+func isLegacyWallet(content []byte) bool {
+	var legacy struct {
+		PrivateKey struct {
+			D *big.Int // 没有 Curve 等字段, 解码时会被跳过
+		}
+		PublicKey []byte
 	}
 
-	privKeyBytes := buf.Bytes()
+	err := gob.NewDecoder(bytes.NewReader(content)).Decode(&legacy)
+	return err == nil && legacy.PrivateKey.D != nil
+}
 
-	fmt.Println(w.PrivateKey)
+// 返回 16 进制的 private key public key
+func (w *Wallet) String() string {
 
-	res := fmt.Sprintf("Public  Key: %s\n", hex.EncodeToString(w.PublicKey))
-	res += fmt.Sprintf("Private Key: %s\n", hex.EncodeToString(privKeyBytes))
+	res := fmt.Sprintf("Scheme:      %s\n", w.PrivateKey.Scheme)
+	res += fmt.Sprintf("Public  Key: %s\n", hex.EncodeToString(w.PublicKey))
+	res += fmt.Sprintf("Private Key: %s\n", hex.EncodeToString(w.PrivateKey.D))
 
-	return res;
+	return res
 }
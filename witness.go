@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// 交易 ID 只包含输入、输出和 LockTime, 不包含输入的 ScriptSig (witness), 修改签名不会改变交易 ID,
+// 签名之前就能确定 ID, 所以可以放心地花费还没有确认的交易的 output
+// wtxid 是整个交易 (包括 witness) 的 hash, 区块用 coinbase 中的 witness commitment 提交所有交易的 wtxid
+
+// witness commitment 是 coinbase 中的一个 output, Value 为 0, ScriptPubKey 为 OP_RETURN <witnessCommitmentHeader + witness root>
+// 这个 output 不能被花费, 不会加到 UTXO 集中
+var witnessCommitmentHeader = []byte{0xaa, 0x21, 0xa9, 0xed}
+
+// 包括 witness 的交易 hash, coinbase 的 wtxid 固定为全 0, 因为 commitment 就在 coinbase 中
+func (tx *Transaction) WitnessHash() []byte {
+	if tx.IsCoinbase() {
+		return make([]byte, sha256.Size)
+	}
+
+	hash := sha256.Sum256(tx.Serialize())
+	return hash[:]
+}
+
+func (tx *Transaction) hasWitness() bool {
+	for _, in := range tx.Vin {
+		if len(in.ScriptSig) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 区块中所有交易的 wtxid 组成的 Merkle root
+func (b *Block) WitnessRoot() []byte {
+	var wtxids [][]byte
+
+	for _, tx := range b.Transactions {
+		wtxids = append(wtxids, tx.WitnessHash())
+	}
+
+	return NewMerkleTree(wtxids).Root.Data
+}
+
+func newWitnessCommitment(root []byte) TXOutput {
+	return TXOutput{0, NewNullDataScript(append(append([]byte{}, witnessCommitmentHeader...), root...))}
+}
+
+func (out *TXOutput) IsWitnessCommitment() bool {
+	return out.Value == 0 && isWitnessCommitmentScript(out.ScriptPubKey)
+}
+
+// 有带 witness 的交易时在 coinbase 中加上 witness commitment, 需要在区块中的交易都确定之后, 挖矿之前调用
+func (b *Block) addWitnessCommitment() {
+	needed := false
+	for _, tx := range b.Transactions {
+		needed = needed || (!tx.IsCoinbase() && tx.hasWitness())
+	}
+
+	if !needed || b.WitnessCommitment() != nil {
+		return
+	}
+
+	for _, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			tx.Vout = append(tx.Vout, newWitnessCommitment(b.WitnessRoot()))
+			tx.Hash()
+			return
+		}
+	}
+}
+
+// 返回 coinbase 中的 witness commitment, 没有时返回 nil
+func (b *Block) WitnessCommitment() []byte {
+	for _, tx := range b.Transactions {
+		if !tx.IsCoinbase() {
+			continue
+		}
+
+		for i := len(tx.Vout) - 1; i >= 0; i-- {
+			if tx.Vout[i].IsWitnessCommitment() {
+				return tx.Vout[i].ScriptPubKey[2+len(witnessCommitmentHeader):]
+			}
+		}
+	}
+	return nil
+}
+
+// 有 commitment 时必须和区块中的交易一致, 没有时所有交易都不能带 witness
+// coinbase 的 witness 不在任何 hash 中, 所以 coinbase 不能带 witness
+func (b *Block) CheckWitnessCommitment() bool {
+	for _, tx := range b.Transactions {
+		if tx.IsCoinbase() && tx.hasWitness() {
+			return false
+		}
+	}
+
+	if commitment := b.WitnessCommitment(); commitment != nil {
+		return bytes.Equal(commitment, b.WitnessRoot())
+	}
+
+	for _, tx := range b.Transactions {
+		if tx.hasWitness() {
+			return false
+		}
+	}
+	return true
+}